@@ -0,0 +1,10 @@
+// Package api holds the OpenAPI specification of the server's JSON API,
+// embedded into the binary so that the server can serve it.
+package api
+
+import _ "embed"
+
+// Spec is the OpenAPI specification, in YAML.
+//
+//go:embed openapi.yaml
+var Spec []byte
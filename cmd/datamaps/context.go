@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+type contextKey string
+
+const (
+	userContextKey  = contextKey("user")
+	tokenContextKey = contextKey("token")
+)
+
+// contextSetUser returns a copy of r with user added to its context.
+func (app *application) contextSetUser(r *http.Request, user *models.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the authenticated user making the request r,
+// or nil if there is none.
+func (app *application) contextGetUser(r *http.Request) *models.User {
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// contextSetToken returns a copy of r with the API token used to
+// authenticate it added to its context.
+func (app *application) contextSetToken(r *http.Request, token *models.APIToken) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the API token used to authenticate the request r,
+// or nil if it was not authenticated with a token.
+func (app *application) contextGetToken(r *http.Request) *models.APIToken {
+	token, ok := r.Context().Value(tokenContextKey).(*models.APIToken)
+	if !ok {
+		return nil
+	}
+	return token
+}
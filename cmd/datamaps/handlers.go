@@ -1,15 +1,914 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/api"
+	"git.yulqen.org/go/datamaps-go/internal/datamaps"
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// maxUploadSize is the largest request body accepted when uploading
+// populated spreadsheets.
+const maxUploadSize = 32 << 20
+
+// uploadMemory is how much of an upload is held in memory while it is read.
+// The rest is written to temporary files, and each file is read back in
+// turn as it is stored with its job.
+const uploadMemory = 1 << 20
+
+// uploadTimeout is how long an upload of populated spreadsheets is given to
+// be read and answered, in place of the server's read and write timeouts,
+// which are too short for maxUploadSize bytes over a slow connection.
+const uploadTimeout = 10 * time.Minute
+
+const (
+	// sessionCookieName is the name of the cookie holding the session token.
+	sessionCookieName = "datamaps_session"
+
+	// sessionTTL is how long a login session lasts.
+	sessionTTL = 12 * time.Hour
 )
 
+// openAPISpec sends the OpenAPI specification of the JSON API.
+func (app *application) openAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(api.Spec)
+}
+
+// home lists every datamap and return the user can see.
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.Error(w, "Not found", 404)
+	dms, err := app.visibleDatamaps(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	rs, err := app.visibleReturns(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Datamaps = dms
+	data.Returns = rs
+	app.render(w, r, http.StatusOK, "home.tmpl", data)
+}
+
+// datamapView shows the lines in the datamap named in the URL.
+func (app *application) datamapView(w http.ResponseWriter, r *http.Request) {
+	dm, err := app.visibleDatamap(r, r.PathValue("name"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.NotFound(w, r)
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	lines, err := app.store.DatamapLines(dm.Name)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Datamap = dm
+	data.Lines = lines
+	app.render(w, r, http.StatusOK, "datamap.tmpl", data)
+}
+
+// returnView shows the data in the return named in the URL as a table of
+// keys against files, using the datamap given by the "datamap" parameter or,
+// if there is none, the first datamap used to import data into the return.
+func (app *application) returnView(w http.ResponseWriter, r *http.Request) {
+	ret, err := app.visibleReturn(r, r.PathValue("name"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.NotFound(w, r)
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	dms, err := app.returnDatamaps(r, ret.Name)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Return = ret
+	data.ReturnDatamaps = dms
+
+	if len(dms) > 0 {
+		dmName := r.URL.Query().Get("datamap")
+		if dmName == "" {
+			dmName = dms[0].Name
+		}
+		if _, err := app.visibleDatamap(r, dmName); err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				http.NotFound(w, r)
+				return
+			}
+			app.serverError(w, r, err)
+			return
+		}
+		m, err := datamaps.AssembleMaster(dmName, ret.Name, app.store)
+		if err != nil {
+			if errors.Is(err, datamaps.ErrNoDatamap) {
+				http.NotFound(w, r)
+				return
+			}
+			app.serverError(w, r, err)
+			return
+		}
+		data.Master = m
+	}
+
+	app.render(w, r, http.StatusOK, "return.tmpl", data)
+}
+
+// search lists the lines, in datamaps the user can see, whose keys contain
+// the "q" parameter.
+func (app *application) search(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+
+	if data.Query != "" {
+		matches, err := app.store.SearchLines(data.Query)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		dms, err := app.visibleDatamaps(r)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		visible := make(map[string]bool, len(dms))
+		for _, dm := range dms {
+			visible[dm.Name] = true
+		}
+		for _, m := range matches {
+			if visible[m.Datamap] {
+				data.Matches = append(data.Matches, m)
+			}
+		}
+	}
+
+	app.render(w, r, http.StatusOK, "search.tmpl", data)
+}
+
+// datamapsList sends a page of the datamaps the user can see as JSON.
+func (app *application) datamapsList(w http.ResponseWriter, r *http.Request) {
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dms, next, err := app.store.Datamaps(opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"datamaps": dms, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// datamapGet sends the datamap named in the URL as JSON.
+func (app *application) datamapGet(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	dm, err := app.visibleDatamap(r, name)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoDatamap, name))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"datamap": dm}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// datamapLines sends a page of the lines in the datamap named in the URL
+// as JSON.
+func (app *application) datamapLines(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := app.visibleDatamap(r, name); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoDatamap, name))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	lines, next, err := app.store.ListLines(name, opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"lines": lines, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// returnsList sends a page of the returns the user can see as JSON.
+func (app *application) returnsList(w http.ResponseWriter, r *http.Request) {
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rs, next, err := app.store.Returns(opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"returns": rs, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// returnGet sends the return named in the URL, and the datamaps used to
+// import data into it, as JSON.
+func (app *application) returnGet(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	ret, err := app.visibleReturn(r, name)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoReturn, name))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	dms, err := app.returnDatamaps(r, ret.Name)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"return": ret, "datamaps": dms}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// returnValues sends a page of the values stored in the return named in the
+// URL, extracted using the datamap named by the "datamap" parameter, as JSON.
+func (app *application) returnValues(w http.ResponseWriter, r *http.Request) {
+	returnName := r.PathValue("name")
+
+	dmName := r.URL.Query().Get("datamap")
+	if dmName == "" {
+		app.clientError(w, http.StatusBadRequest, "a datamap name must be given in the datamap parameter")
+		return
+	}
+
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := app.visibleReturn(r, returnName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoReturn, returnName))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+	if _, err := app.visibleDatamap(r, dmName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoDatamap, dmName))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	values, next, err := app.store.ListReturnValues(dmName, returnName, opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"values": values, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// returnFilesCreate queues a job which extracts the data from one or more
+// populated spreadsheets uploaded as the "files" field of a multipart form,
+// using the datamap named by the "datamap" parameter, and stores it in the
+// return named in the URL. If the return does not exist it is created, owned
+// by the user, with the visibility given by the "visibility" parameter
+// (private by default). The result of the job is a JSON extraction report for
+// each file.
+func (app *application) returnFilesCreate(w http.ResponseWriter, r *http.Request) {
+	returnName := r.PathValue("name")
+	user := app.contextGetUser(r)
+
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(uploadTimeout)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(uploadMemory); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			app.clientError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload must not be larger than %d bytes", maxUploadSize))
+			return
+		}
+		app.clientError(w, http.StatusBadRequest, "request must be a multipart form containing xlsx files")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	dmName := r.FormValue("datamap")
+	if dmName == "" {
+		app.clientError(w, http.StatusBadRequest, "a datamap name must be given in the datamap parameter")
+		return
+	}
+
+	files := r.MultipartForm.File["files"]
+	if len(files) == 0 {
+		app.clientError(w, http.StatusBadRequest, "at least one file must be uploaded in the files field")
+		return
+	}
+
+	for _, fh := range files {
+		if ext := strings.ToLower(filepath.Ext(fh.Filename)); ext != ".xlsx" && ext != ".xlsm" {
+			app.clientError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("%s is not an xlsx or xlsm file", fh.Filename))
+			return
+		}
+	}
+
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = models.Private
+	}
+	if visibility != models.Public && visibility != models.Private {
+		app.clientError(w, http.StatusBadRequest, "visibility must be public or private")
+		return
+	}
+
+	if _, err := app.visibleDatamap(r, dmName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("there is no datamap named %q", dmName))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	ret, err := app.store.GetReturn(returnName)
+	if errors.Is(err, models.ErrNoRecord) {
+		ret, err = app.store.InsertReturn(models.Return{Name: returnName, OwnerID: user.ID, Visibility: visibility})
+		if errors.Is(err, models.ErrDuplicateName) {
+			// Another upload created it first.
+			ret, err = app.store.GetReturn(returnName)
+		}
+	}
+	switch {
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	case !ret.VisibleTo(user.ID):
+		app.clientError(w, http.StatusNotFound, fmt.Sprintf("there is no return named %q", returnName))
+		return
+	case !ret.WritableBy(user.ID):
+		app.clientError(w, http.StatusForbidden, fmt.Sprintf("you do not have permission to add files to %q", returnName))
+		return
+	}
+
+	jobFiles := make([]models.JobFile, 0, len(files))
+	for _, fh := range files {
+		open := func() (io.ReadCloser, error) { return fh.Open() }
+		jobFiles = append(jobFiles, models.JobFile{Filename: filepath.Base(fh.Filename), Open: open})
 	}
 
-	fmt.Fprintf(w, "home page")
+	app.enqueue(w, r, jobImport, importParams{Datamap: dmName, Return: ret.Name}, jobFiles)
+}
+
+// returnMaster streams a master for the return named in the URL, built using
+// the datamap named by the "datamap" query parameter. The "format" parameter
+// selects xlsx (the default), csv or json output.
+func (app *application) returnMaster(w http.ResponseWriter, r *http.Request) {
+	returnName := r.PathValue("name")
+
+	dmName := r.URL.Query().Get("datamap")
+	if dmName == "" {
+		app.clientError(w, http.StatusBadRequest, "a datamap name must be given in the datamap parameter")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = datamaps.MasterXLSX
+	}
+
+	contentType, ok := masterContentType(format)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest, "format must be one of xlsx, csv or json")
+		return
+	}
 
+	if _, err := app.visibleReturn(r, returnName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoReturn, returnName))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+	if _, err := app.visibleDatamap(r, dmName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoDatamap, dmName))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	m, err := datamaps.AssembleMaster(dmName, returnName, app.store)
+	if err != nil {
+		if errors.Is(err, datamaps.ErrNoDatamap) || errors.Is(err, datamaps.ErrNoReturn) {
+			app.clientError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	setMasterDisposition(w, returnName, format)
+
+	// The response has been started by now so all we can do is log any error.
+	if err := datamaps.WriteMaster(w, m, format); err != nil {
+		app.logger.Error("cannot write master", "return", returnName, "err", err)
+	}
+}
+
+// returnMasterCreate queues a job building a master for the return named in
+// the URL, with the datamap and format given by the "datamap" and "format"
+// parameters as for returnMaster. The master is the result of the job.
+func (app *application) returnMasterCreate(w http.ResponseWriter, r *http.Request) {
+	returnName := r.PathValue("name")
+
+	dmName := r.FormValue("datamap")
+	if dmName == "" {
+		app.clientError(w, http.StatusBadRequest, "a datamap name must be given in the datamap parameter")
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = datamaps.MasterXLSX
+	}
+	if _, ok := masterContentType(format); !ok {
+		app.clientError(w, http.StatusBadRequest, "format must be one of xlsx, csv or json")
+		return
+	}
+
+	if _, err := app.visibleReturn(r, returnName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoReturn, returnName))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+	if _, err := app.visibleDatamap(r, dmName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", datamaps.ErrNoDatamap, dmName))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.enqueue(w, r, jobMaster, masterParams{Datamap: dmName, Return: returnName, Format: format}, nil)
+}
+
+// userLogin shows the login form.
+func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, http.StatusOK, "login.tmpl", app.newTemplateData(r))
+}
+
+// userLoginPost checks the "name" and "password" form fields and, if they
+// match a user, starts a session and redirects to the home page.
+func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, http.StatusBadRequest, "cannot parse login form")
+		return
+	}
+
+	name := r.PostForm.Get("name")
+	id, err := app.store.Authenticate(name, r.PostForm.Get("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			data := app.newTemplateData(r)
+			data.LoginName = name
+			data.LoginError = "Name or password is incorrect."
+			app.render(w, r, http.StatusUnprocessableEntity, "login.tmpl", data)
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	token, err := app.store.CreateSession(id, sessionTTL)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// userLogoutPost ends the user's session and redirects to the login page.
+func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := app.store.DeleteSession(cookie.Value); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// keyHistory sends a page of the values stored for the key in the URL, in
+// returns and datamaps the user can see, ordered by the date the return was
+// created.
+// The "file" parameter restricts the values to files with that name and the
+// "format" parameter selects json (the default) or csv output.
+func (app *application) keyHistory(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = datamaps.HistoryJSON
+	}
+
+	var contentType string
+	switch format {
+	case datamaps.HistoryJSON:
+		contentType = "application/json"
+	case datamaps.HistoryCSV:
+		contentType = "text/csv; charset=utf-8"
+	default:
+		app.clientError(w, http.StatusBadRequest, "format must be one of json or csv")
+		return
+	}
+
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	values, next, err := app.store.KeyHistory(key, r.URL.Query().Get("file"), opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	w.Header().Set("Content-Type", contentType)
+	if err := datamaps.WriteKeyHistory(w, key, values, next, format); err != nil {
+		app.logger.Error("cannot write key history", "key", key, "err", err)
+	}
+}
+
+// tokensList sends a page of the user's API tokens as JSON. The secret
+// tokens themselves are never shown again after they are created.
+func (app *application) tokensList(w http.ResponseWriter, r *http.Request) {
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tokens, next, err := app.store.Tokens(app.contextGetUser(r).ID, opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"tokens": tokens, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// tokenCreate creates an API token for the user named by the "name"
+// parameter with the scope given by the "scope" parameter, which defaults
+// to read. The response includes the secret token, which cannot be
+// retrieved later.
+func (app *application) tokenCreate(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		app.clientError(w, http.StatusBadRequest, "a token name must be given in the name parameter")
+		return
+	}
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = models.ScopeRead
+	}
+
+	token, secret, err := app.store.CreateToken(app.contextGetUser(r).ID, name, scope)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidScope) {
+			app.clientError(w, http.StatusBadRequest, fmt.Sprintf("scope must be %s or %s", models.ScopeRead, models.ScopeReadWrite))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusCreated, envelope{"token": token, "secret": secret}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// tokenDelete revokes the user's API token with the id in the URL.
+func (app *application) tokenDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		app.clientError(w, http.StatusNotFound, "no matching token found")
+		return
+	}
+
+	if err := app.store.DeleteToken(app.contextGetUser(r).ID, id); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, "no matching token found")
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jobsList sends a page of the user's background jobs as JSON.
+func (app *application) jobsList(w http.ResponseWriter, r *http.Request) {
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	jobs, next, err := app.store.Jobs(app.contextGetUser(r).ID, opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"jobs": jobs, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// jobGet sends the status and progress of the user's job with the id in
+// the URL as JSON.
+func (app *application) jobGet(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.userJob(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"job": job}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// jobResult sends the result of the user's job with the id in the URL,
+// such as the reports of an import or a master file, once it has
+// succeeded.
+func (app *application) jobResult(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.userJob(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != models.JobSucceeded {
+		app.clientError(w, http.StatusConflict, fmt.Sprintf("job %d has no result because it is %s", job.ID, job.Status))
+		return
+	}
+
+	contentType, result, err := app.store.JobResult(job.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if job.Kind == jobMaster {
+		var params masterParams
+		if err := json.Unmarshal(job.Params, &params); err == nil {
+			setMasterDisposition(w, params.Return, params.Format)
+		}
+	}
+	w.Write(result)
+}
+
+// jobCancel asks the user's job with the id in the URL to stop and sends
+// the job as JSON. A queued job is cancelled at once and a running job
+// stops before it next makes progress.
+func (app *application) jobCancel(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.userJob(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := app.jobs.Cancel(job.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrJobFinished) {
+			app.clientError(w, http.StatusConflict, fmt.Sprintf("job %d has already %s", job.ID, job.Status))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusAccepted, envelope{"job": job}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// webhooksList sends a page of the user's webhooks as JSON. Their secrets
+// are never shown again after they are created.
+func (app *application) webhooksList(w http.ResponseWriter, r *http.Request) {
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hooks, next, err := app.store.Webhooks(app.contextGetUser(r).ID, opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"webhooks": hooks, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// webhookCreate subscribes the http or https URL given by the "url"
+// parameter to the user's events named by the "events" parameters, or to
+// every event if there are none. The URL must not be one which the server
+// would refuse to deliver to, such as localhost. The response includes the
+// secret which signs the deliveries, which cannot be retrieved later.
+func (app *application) webhookCreate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, err := url.Parse(r.PostForm.Get("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		app.clientError(w, http.StatusBadRequest, "an http or https URL must be given in the url parameter")
+		return
+	}
+	if err := app.webhooks.CheckURL(u); err != nil {
+		app.clientError(w, http.StatusBadRequest, "the url must be a public address")
+		return
+	}
+
+	hook, err := app.store.CreateWebhook(app.contextGetUser(r).ID, u.String(), r.PostForm["events"])
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidEvent) {
+			app.clientError(w, http.StatusBadRequest, "events must be among "+strings.Join(models.Events, ", "))
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusCreated, envelope{"webhook": hook, "secret": hook.Secret}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// webhookDelete removes the user's webhook with the id in the URL, along
+// with its delivery log.
+func (app *application) webhookDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		app.clientError(w, http.StatusNotFound, "no matching webhook found")
+		return
+	}
+
+	if err := app.store.DeleteWebhook(app.contextGetUser(r).ID, id); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, "no matching webhook found")
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webhookDeliveries sends a page of the attempts to deliver events to the
+// user's webhook with the id in the URL as JSON, oldest first.
+func (app *application) webhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		app.clientError(w, http.StatusNotFound, "no matching webhook found")
+		return
+	}
+
+	hook, err := app.store.GetWebhook(app.contextGetUser(r).ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, "no matching webhook found")
+			return
+		}
+		app.serverError(w, r, err)
+		return
+	}
+
+	opts, err := app.readListOptions(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	deliveries, next, err := app.store.Deliveries(hook.ID, opts)
+	if err != nil {
+		app.listError(w, r, err)
+		return
+	}
+
+	app.setNextLink(w, r, next)
+	if err := app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "next_cursor": next}); err != nil {
+		app.serverError(w, r, err)
+	}
 }
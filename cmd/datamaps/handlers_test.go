@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"git.yulqen.org/go/datamaps-go/internal/webhooks"
+)
+
+const testTemplate = "../../internal/datamaps/testdata/test_template.xlsx"
+
+func TestReturnFilesCreate(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		files    []string
+		wantCode int
+	}{
+		{"Valid upload", map[string]string{"datamap": testDatamapName}, []string{testTemplate}, http.StatusAccepted},
+		{"No datamap", nil, []string{testTemplate}, http.StatusBadRequest},
+		{"Unknown datamap", map[string]string{"datamap": "Bobbins"}, []string{testTemplate}, http.StatusNotFound},
+		{"No files", map[string]string{"datamap": testDatamapName}, nil, http.StatusBadRequest},
+		{"Not a spreadsheet", map[string]string{"datamap": testDatamapName}, []string{"handlers_test.go"}, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.do(t, ts.uploadRequest(t, "/returns/Q1/files", tt.fields, tt.files...))
+			if code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantCode, code, body)
+			}
+		})
+	}
+
+	code, header, body := ts.do(t, ts.uploadRequest(t, "/returns/Q2/files", map[string]string{"datamap": testDatamapName}, testTemplate))
+	if code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, code)
+	}
+	job := ts.waitForJob(t, header.Get("Location"))
+	if job.Kind != jobImport || job.Status != models.JobSucceeded || job.Done != 1 || job.Total != 1 {
+		t.Fatalf("unexpected import job %+v", job)
+	}
+
+	code, _, body = ts.get(t, header.Get("Location")+"/result")
+	if code != http.StatusOK {
+		t.Fatalf("expected status %d for the job result, got %d: %s", http.StatusOK, code, body)
+	}
+	var report struct {
+		Files []struct {
+			Filename string
+			Mapped   []struct{ Key, Value string }
+			Missing  []struct{ Key, Error string }
+		}
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 {
+		t.Fatalf("expected a report for 1 file, got %d", len(report.Files))
+	}
+	if got := len(report.Files[0].Mapped); got != 4 {
+		t.Errorf("expected 4 mapped cells, got %d", got)
+	}
+	if got := len(report.Files[0].Missing); got != 1 || report.Files[0].Missing[0].Key != "Missing Sheet" {
+		t.Errorf("expected Missing Sheet to be reported missing, got %v", report.Files[0].Missing)
+	}
+}
+
+func TestSlowUpload(t *testing.T) {
+	app := newTestApplication(t)
+	srv := httptest.NewUnstartedServer(app.routes())
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	ts := startTestServer(t, srv)
+	ts.login(t, "alice")
+
+	// Send the upload more slowly than the server's timeouts allow.
+	req := ts.uploadRequest(t, "/returns/Q1/files", map[string]string{"datamap": testDatamapName}, testTemplate)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(body[:len(body)/2])
+		time.Sleep(300 * time.Millisecond)
+		pw.Write(body[len(body)/2:])
+		pw.Close()
+	}()
+	req.Body, req.ContentLength = pr, int64(len(body))
+
+	if code, _, body := ts.do(t, req); code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, code, body)
+	}
+}
+
+func TestReturnMaster(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	ts.importFiles(t, "Q1", map[string]string{"datamap": testDatamapName}, testTemplate)
+
+	tests := []struct {
+		name            string
+		urlPath         string
+		wantCode        int
+		wantContentType string
+	}{
+		{"Default xlsx", "/returns/Q1/master?datamap=Test+Datamap", http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"CSV", "/returns/Q1/master?datamap=Test+Datamap&format=csv", http.StatusOK, "text/csv; charset=utf-8"},
+		{"JSON", "/returns/Q1/master?datamap=Test+Datamap&format=json", http.StatusOK, "application/json"},
+		{"Bad format", "/returns/Q1/master?datamap=Test+Datamap&format=pdf", http.StatusBadRequest, "application/json"},
+		{"No datamap", "/returns/Q1/master", http.StatusBadRequest, "application/json"},
+		{"Unknown return", "/returns/Q9/master?datamap=Test+Datamap", http.StatusNotFound, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header, _ := ts.get(t, tt.urlPath)
+			if code != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, code)
+			}
+			if got := header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("expected Content-Type %q, got %q", tt.wantContentType, got)
+			}
+		})
+	}
+
+	_, _, body := ts.get(t, "/returns/Q1/master?datamap=Test+Datamap&format=csv")
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0][1] != "test_template.xlsx" || rows[3][0] != "A Vunt" || rows[3][1] != "VUNT" {
+		t.Errorf("unexpected CSV master %v", rows)
+	}
+}
+
+func TestUI(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	ts.importFiles(t, "Q1", map[string]string{"datamap": testDatamapName}, testTemplate)
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+		wantBody string
+	}{
+		{"Home", "/", http.StatusOK, "Test Datamap"},
+		{"Datamap", "/ui/datamaps/Test%20Datamap", http.StatusOK, "A Parrot"},
+		{"Unknown datamap", "/ui/datamaps/Bobbins", http.StatusNotFound, ""},
+		{"Return", "/ui/returns/Q1", http.StatusOK, "Greedy Parrots"},
+		{"Unknown return", "/ui/returns/Q9", http.StatusNotFound, ""},
+		{"Search", "/ui/search?q=parrot", http.StatusOK, "A Parrot"},
+		{"Static", "/static/css/main.css", http.StatusOK, "body"},
+		{"Not found", "/bobbins", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.urlPath)
+			if code != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, code)
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("expected body to contain %q", tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	code, _, _ := ts.get(t, "/datamaps")
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for API request without session, got %d", http.StatusUnauthorized, code)
+	}
+
+	code, header, _ := ts.get(t, "/")
+	if code != http.StatusSeeOther || header.Get("Location") != "/user/login" {
+		t.Errorf("expected redirect to login page, got %d to %q", code, header.Get("Location"))
+	}
+
+	code, _, body := ts.postForm(t, "/user/login", url.Values{"name": {"alice"}, "password": {"wrong"}})
+	if code != http.StatusUnprocessableEntity || !strings.Contains(string(body), "incorrect") {
+		t.Errorf("expected status %d for wrong password, got %d", http.StatusUnprocessableEntity, code)
+	}
+
+	ts.login(t, "alice")
+	code, _, body = ts.get(t, "/datamaps")
+	if code != http.StatusOK || !strings.Contains(string(body), testDatamapName) {
+		t.Errorf("expected datamaps after login, got %d: %s", code, body)
+	}
+
+	ts.logout(t)
+	if code, _, _ := ts.get(t, "/datamaps"); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d after logout, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	ts.login(t, "alice")
+	for _, r := range []struct{ name, visibility string }{{"Private", ""}, {"Public", "public"}} {
+		fields := map[string]string{"datamap": testDatamapName, "visibility": r.visibility}
+		ts.importFiles(t, r.name, fields, testTemplate)
+	}
+	ts.logout(t)
+	ts.login(t, "bob")
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+	}{
+		{"Private return", "/returns/Private", http.StatusNotFound},
+		{"Public return", "/returns/Public", http.StatusOK},
+		{"Private master", "/returns/Private/master?datamap=Test+Datamap&format=csv", http.StatusNotFound},
+		{"Public master", "/returns/Public/master?datamap=Test+Datamap&format=csv", http.StatusOK},
+		{"Private return page", "/ui/returns/Private", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _, body := ts.get(t, tt.urlPath); code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %s", tt.wantCode, code, body)
+			}
+		})
+	}
+
+	_, _, body := ts.get(t, "/returns")
+	var list struct{ Returns []struct{ Name string } }
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Returns) != 1 || list.Returns[0].Name != "Public" {
+		t.Errorf("expected bob to see only the public return, got %+v", list.Returns)
+	}
+
+	fields := map[string]string{"datamap": testDatamapName}
+	if code, _, _ := ts.do(t, ts.uploadRequest(t, "/returns/Public/files", fields, testTemplate)); code != http.StatusForbidden {
+		t.Errorf("expected status %d uploading to another user's return, got %d", http.StatusForbidden, code)
+	}
+	if code, _, _ := ts.do(t, ts.uploadRequest(t, "/returns/Private/files", fields, testTemplate)); code != http.StatusNotFound {
+		t.Errorf("expected status %d uploading to a private return, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	secrets := map[string]string{}
+	var readID int64
+	for _, scope := range []string{"read", "read-write"} {
+		code, _, body := ts.postForm(t, "/tokens", url.Values{"name": {scope + " token"}, "scope": {scope}})
+		if code != http.StatusCreated {
+			t.Fatalf("cannot create %s token: %d: %s", scope, code, body)
+		}
+		var created struct {
+			Token  struct{ ID int64 }
+			Secret string
+		}
+		if err := json.Unmarshal(body, &created); err != nil {
+			t.Fatal(err)
+		}
+		secrets[scope] = created.Secret
+		if scope == "read" {
+			readID = created.Token.ID
+		}
+	}
+	if code, _, _ := ts.postForm(t, "/tokens", url.Values{"name": {"bad"}, "scope": {"admin"}}); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid scope, got %d", http.StatusBadRequest, code)
+	}
+
+	_, _, body := ts.get(t, "/tokens")
+	if strings.Contains(string(body), secrets["read"]) || !strings.Contains(string(body), "read token") {
+		t.Errorf("expected tokens to be listed without their secrets: %s", body)
+	}
+	ts.logout(t)
+
+	withToken := func(req *http.Request, secret string) *http.Request {
+		req.Header.Set("Authorization", "Bearer "+secret)
+		return req
+	}
+	getWithToken := func(secret string) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/datamaps", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _, _ := ts.do(t, withToken(req, secret))
+		return code
+	}
+	upload := func(secret string) int {
+		req := ts.uploadRequest(t, "/returns/Q1/files", map[string]string{"datamap": testDatamapName}, testTemplate)
+		code, _, _ := ts.do(t, withToken(req, secret))
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     int
+		wantCode int
+	}{
+		{"Read with read token", getWithToken(secrets["read"]), http.StatusOK},
+		{"Write with read token", upload(secrets["read"]), http.StatusForbidden},
+		{"Write with read-write token", upload(secrets["read-write"]), http.StatusAccepted},
+		{"Unknown token", getWithToken("bobbins"), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.code != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, tt.code)
+			}
+		})
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/tokens/%d", ts.URL, readID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, _ := ts.do(t, withToken(req, secrets["read-write"])); code != http.StatusNoContent {
+		t.Fatalf("expected status %d revoking token, got %d", http.StatusNoContent, code)
+	}
+	if code := getWithToken(secrets["read"]); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d with a revoked token, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestKeyHistory(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	for _, ret := range []string{"Q1", "Q2"} {
+		ts.importFiles(t, ret, map[string]string{"datamap": testDatamapName}, testTemplate)
+	}
+
+	code, _, body := ts.get(t, "/keys/A%20Vunt/history?file=test_template.xlsx")
+	if code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, code, body)
+	}
+	var history struct {
+		Key    string
+		Values []struct{ Return, Value string }
+	}
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if history.Key != "A Vunt" || len(history.Values) != 2 || history.Values[0].Return != "Q1" || history.Values[1].Value != "VUNT" {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	code, header, body := ts.get(t, "/keys/A%20Vunt/history?format=csv")
+	if code != http.StatusOK || !strings.HasPrefix(header.Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected CSV, got %d %s", code, header.Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "return" || rows[2][0] != "Q2" {
+		t.Errorf("unexpected CSV history %v", rows)
+	}
+
+	if code, _, _ := ts.get(t, "/keys/A%20Vunt/history?format=xml"); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an unknown format, got %d", http.StatusBadRequest, code)
+	}
+
+	ts.logout(t)
+	ts.login(t, "bob")
+	_, _, body = ts.get(t, "/keys/A%20Vunt/history")
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Values) != 0 {
+		t.Errorf("expected bob to see no values from alice's private returns, got %+v", history.Values)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	var keys []string
+	urlPath := "/datamaps/Test%20Datamap/lines?limit=2&sort=-key"
+	for pages := 0; urlPath != ""; pages++ {
+		if pages > len(testLines) {
+			t.Fatal("too many pages")
+		}
+		code, header, body := ts.get(t, urlPath)
+		if code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, code, body)
+		}
+		var page struct {
+			Lines      []struct{ Key string }
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range page.Lines {
+			keys = append(keys, l.Key)
+		}
+
+		link := header.Get("Link")
+		if (page.NextCursor == "") != (link == "") {
+			t.Fatalf("expected a Link header only with a next cursor, got %q and %q", link, page.NextCursor)
+		}
+		urlPath = ""
+		if link != "" {
+			u, err := url.Parse(strings.TrimPrefix(strings.SplitN(link, ">", 2)[0], "<"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Query().Get("cursor") != page.NextCursor {
+				t.Errorf("expected the Link header to use cursor %q, got %q", page.NextCursor, link)
+			}
+			urlPath = u.RequestURI()
+		}
+	}
+
+	want := []string{"Missing Sheet", "A Vunt", "A Test", "A Ten", "A Parrot"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("expected keys %v, got %v", want, keys)
+	}
+
+	for _, urlPath := range []string{
+		"/datamaps?limit=1001",
+		"/datamaps?limit=x",
+		"/datamaps?sort=size",
+		"/datamaps?cursor=bobbins",
+	} {
+		if code, _, _ := ts.get(t, urlPath); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", urlPath, http.StatusBadRequest, code)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	ts.importFiles(t, "Q1", map[string]string{"datamap": testDatamapName}, testTemplate)
+
+	code, header, body := ts.postForm(t, "/returns/Q1/master", url.Values{"datamap": {testDatamapName}, "format": {"csv"}})
+	if code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, code, body)
+	}
+	jobURL := header.Get("Location")
+	if job := ts.waitForJob(t, jobURL); job.Kind != jobMaster || job.Status != models.JobSucceeded {
+		t.Fatalf("unexpected master job %+v", job)
+	}
+
+	code, header, body = ts.get(t, jobURL+"/result")
+	if code != http.StatusOK || header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("expected a CSV master, got %d %s: %s", code, header.Get("Content-Type"), body)
+	}
+	if !strings.Contains(header.Get("Content-Disposition"), "Q1 master.csv") {
+		t.Errorf("unexpected Content-Disposition %q", header.Get("Content-Disposition"))
+	}
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[3][0] != "A Vunt" || rows[3][1] != "VUNT" {
+		t.Errorf("unexpected CSV master %v", rows)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+jobURL+"/cancel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, _ := ts.do(t, req); code != http.StatusConflict {
+		t.Errorf("expected status %d cancelling a finished job, got %d", http.StatusConflict, code)
+	}
+
+	// A datamap without lines cannot be used to build a master.
+	if _, err := app.store.InsertDatamap(models.Datamap{Name: "Empty"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, header, _ = ts.postForm(t, "/returns/Q1/master", url.Values{"datamap": {"Empty"}})
+	if job := ts.waitForJob(t, header.Get("Location")); job.Status != models.JobFailed || job.Error == "" {
+		t.Errorf("expected the master job to fail, got %+v", job)
+	}
+	if code, _, _ := ts.get(t, header.Get("Location")+"/result"); code != http.StatusConflict {
+		t.Errorf("expected status %d for the result of a failed job, got %d", http.StatusConflict, code)
+	}
+
+	_, _, body = ts.get(t, "/jobs?sort=-created")
+	var list struct{ Jobs []models.Job }
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Jobs) != 3 || list.Jobs[0].Status != models.JobFailed || list.Jobs[2].Kind != jobImport {
+		t.Errorf("unexpected jobs %+v", list.Jobs)
+	}
+
+	ts.logout(t)
+	ts.login(t, "bob")
+	for _, urlPath := range []string{jobURL, jobURL + "/result", "/jobs/bobbins"} {
+		if code, _, _ := ts.get(t, urlPath); code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d for another user's job, got %d", urlPath, http.StatusNotFound, code)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	received := make(chan delivery, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- delivery{r.Header, body}
+	}))
+	t.Cleanup(receiver.Close)
+
+	app := newTestApplication(t)
+	app.publicURL = "https://datamaps.example.com"
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	// Only test receivers may be on the server's own network.
+	app.webhooks.AllowPrivate = false
+	for _, u := range []string{receiver.URL, "http://localhost/hook", "http://169.254.169.254/latest", "http://[::1]:8080/"} {
+		if code, _, body := ts.postForm(t, "/webhooks", url.Values{"url": {u}}); code != http.StatusBadRequest {
+			t.Errorf("expected status %d subscribing %s, got %d: %s", http.StatusBadRequest, u, code, body)
+		}
+	}
+	app.webhooks.AllowPrivate = true
+
+	code, _, body := ts.postForm(t, "/webhooks", url.Values{"url": {receiver.URL}, "events": {models.EventImportFinished}})
+	if code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, code, body)
+	}
+	var created struct {
+		Webhook models.Webhook
+		Secret  string
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Secret == "" || !slices.Equal(created.Webhook.Events, []string{models.EventImportFinished}) {
+		t.Fatalf("unexpected webhook %s", body)
+	}
+
+	broken := filepath.Join(t.TempDir(), "broken.xlsx")
+	if err := os.WriteFile(broken, []byte("not a spreadsheet"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts.importFiles(t, "Q1", map[string]string{"datamap": testDatamapName}, testTemplate, broken)
+
+	var d delivery
+	select {
+	case d = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the webhook to be sent the import")
+	}
+	if !webhooks.Verify(created.Secret, d.body, d.header.Get(webhooks.SignatureHeader)) {
+		t.Errorf("signature %q does not verify", d.header.Get(webhooks.SignatureHeader))
+	}
+	if d.header.Get(webhooks.EventHeader) != models.EventImportFinished {
+		t.Errorf("unexpected event %q", d.header.Get(webhooks.EventHeader))
+	}
+
+	var ev jobEvent
+	if err := json.Unmarshal(d.body, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Return != "Q1" || ev.Datamap != testDatamapName || ev.Status != models.JobSucceeded || ev.Files != 1 {
+		t.Errorf("unexpected event %s", d.body)
+	}
+	if len(ev.Errors) != 1 || !strings.HasPrefix(ev.Errors[0], "broken.xlsx: ") {
+		t.Errorf("expected an error for the file which is not a spreadsheet, got %q", ev.Errors)
+	}
+	if ev.JobURL != fmt.Sprintf("https://datamaps.example.com/jobs/%d", ev.JobID) {
+		t.Errorf("unexpected job URL %q", ev.JobURL)
+	}
+
+	// The webhook is not subscribed to masters.
+	_, header, _ := ts.postForm(t, "/returns/Q1/master", url.Values{"datamap": {testDatamapName}})
+	ts.waitForJob(t, header.Get("Location"))
+	app.webhooks.Wait()
+	if len(received) != 0 {
+		t.Errorf("expected no delivery for the master, got %d", len(received))
+	}
+
+	deliveriesURL := fmt.Sprintf("/webhooks/%d/deliveries", created.Webhook.ID)
+	_, _, body = ts.get(t, deliveriesURL)
+	var list struct{ Deliveries []models.WebhookDelivery }
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Deliveries) != 1 || list.Deliveries[0].StatusCode != http.StatusOK || list.Deliveries[0].Delivery != d.header.Get(webhooks.DeliveryHeader) {
+		t.Errorf("unexpected delivery log %s", body)
+	}
+
+	ts.logout(t)
+	ts.login(t, "bob")
+	if code, _, _ := ts.get(t, deliveriesURL); code != http.StatusNotFound {
+		t.Errorf("expected status %d for another user's webhook, got %d", http.StatusNotFound, code)
+	}
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+fmt.Sprintf("/webhooks/%d", created.Webhook.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, _ := ts.do(t, req); code != http.StatusNotFound {
+		t.Errorf("expected status %d deleting another user's webhook, got %d", http.StatusNotFound, code)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/datamaps"
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// envelope wraps JSON responses so that the top-level value is always an object.
+type envelope map[string]any
+
+// serverError logs an error and stack trace, then sends a generic
+// 500 Internal Server Error response to the user.
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Error(err.Error(),
+		"method", r.Method,
+		"uri", r.URL.RequestURI(),
+		"trace", string(debug.Stack()),
+	)
+
+	app.errorJSON(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
+
+// clientError sends a specific status code and corresponding description
+// to the user.
+func (app *application) clientError(w http.ResponseWriter, status int, message string) {
+	app.errorJSON(w, status, message)
+}
+
+// invalidTokenResponse tells the user that the API token in the
+// Authorization header is not valid.
+func (app *application) invalidTokenResponse(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	app.errorJSON(w, http.StatusUnauthorized, "invalid or missing authentication token")
+}
+
+// errorJSON sends message to the user as a JSON error document.
+func (app *application) errorJSON(w http.ResponseWriter, status int, message string) {
+	if err := app.writeJSON(w, status, envelope{"error": message}); err != nil {
+		app.logger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// writeJSON encodes data as JSON and writes it to w with the given status.
+func (app *application) writeJSON(w http.ResponseWriter, status int, data any) error {
+	js, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+
+	return nil
+}
+
+// newTemplateData returns a templateData with the fields common to every page set.
+func (app *application) newTemplateData(r *http.Request) templateData {
+	return templateData{
+		CurrentYear: time.Now().Year(),
+		Query:       r.URL.Query().Get("q"),
+		User:        app.contextGetUser(r),
+	}
+}
+
+// render executes the template for page into a buffer, so that errors can be
+// reported properly, then writes it to w with the given status.
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, page string, data templateData) {
+	ts, ok := app.templateCache[page]
+	if !ok {
+		app.serverError(w, r, fmt.Errorf("the template %s does not exist", page))
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := ts.ExecuteTemplate(buf, "base", data); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+const (
+	// defaultPageSize is the number of items in a page of a list unless the
+	// "limit" parameter says otherwise.
+	defaultPageSize = 100
+
+	// maxPageSize is the largest "limit" accepted.
+	maxPageSize = 1000
+)
+
+// readListOptions reads the "limit", "cursor", "q", "sheet" and "sort"
+// parameters of a request for a page of a list. The list is restricted to
+// records the user making the request can see.
+func (app *application) readListOptions(r *http.Request) (models.ListOptions, error) {
+	qs := r.URL.Query()
+	opts := models.ListOptions{
+		Limit:  defaultPageSize,
+		Cursor: qs.Get("cursor"),
+		Query:  qs.Get("q"),
+		Sheet:  qs.Get("sheet"),
+		Sort:   qs.Get("sort"),
+		UserID: app.userID(r),
+	}
+
+	if s := qs.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return opts, fmt.Errorf("limit must be a number from 1 to %d", maxPageSize)
+		}
+		opts.Limit = n
+	}
+	return opts, nil
+}
+
+// listError sends a 400 Bad Request response if err is due to an invalid
+// cursor or sort parameter and a 500 Internal Server Error otherwise.
+func (app *application) listError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidCursor):
+		app.clientError(w, http.StatusBadRequest, "cursor is not valid for this list")
+	case errors.Is(err, models.ErrInvalidSort):
+		app.clientError(w, http.StatusBadRequest, "the list cannot be sorted by "+r.URL.Query().Get("sort"))
+	default:
+		app.serverError(w, r, err)
+	}
+}
+
+// setNextLink adds a Link header pointing to the next page of a list, with
+// the cursor next, if there is one.
+func (app *application) setNextLink(w http.ResponseWriter, r *http.Request, next string) {
+	if next == "" {
+		return
+	}
+	u := *r.URL
+	qs := u.Query()
+	qs.Set("cursor", next)
+	u.RawQuery = qs.Encode()
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", u.RequestURI()))
+}
+
+// userID returns the id of the user making the request r, or 0 if the
+// request is not authenticated.
+func (app *application) userID(r *http.Request) int64 {
+	if user := app.contextGetUser(r); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+// visibleDatamap returns the datamap named name, or models.ErrNoRecord if
+// there is none or the user making the request r cannot see it.
+func (app *application) visibleDatamap(r *http.Request, name string) (models.Datamap, error) {
+	dm, err := app.store.GetDatamap(name)
+	if err != nil {
+		return models.Datamap{}, err
+	}
+	if !dm.VisibleTo(app.userID(r)) {
+		return models.Datamap{}, models.ErrNoRecord
+	}
+	return dm, nil
+}
+
+// visibleReturn returns the return named name, or models.ErrNoRecord if
+// there is none or the user making the request r cannot see it.
+func (app *application) visibleReturn(r *http.Request, name string) (models.Return, error) {
+	ret, err := app.store.GetReturn(name)
+	if err != nil {
+		return models.Return{}, err
+	}
+	if !ret.VisibleTo(app.userID(r)) {
+		return models.Return{}, models.ErrNoRecord
+	}
+	return ret, nil
+}
+
+// visibleDatamaps returns every datamap the user making the request r can see.
+func (app *application) visibleDatamaps(r *http.Request) ([]models.Datamap, error) {
+	dms, _, err := app.store.Datamaps(models.ListOptions{UserID: app.userID(r)})
+	return dms, err
+}
+
+// visibleReturns returns every return the user making the request r can see.
+func (app *application) visibleReturns(r *http.Request) ([]models.Return, error) {
+	rs, _, err := app.store.Returns(models.ListOptions{UserID: app.userID(r)})
+	return rs, err
+}
+
+// returnDatamaps returns the datamaps, which the user making the request r
+// can see, used to import data into the return named name.
+func (app *application) returnDatamaps(r *http.Request, name string) ([]models.Datamap, error) {
+	dms, err := app.store.ReturnDatamaps(name)
+	if err != nil {
+		return nil, err
+	}
+	return filterDatamaps(dms, app.userID(r)), nil
+}
+
+// filterDatamaps returns the datamaps in dms which the user with id userID
+// can see.
+func filterDatamaps(dms []models.Datamap, userID int64) []models.Datamap {
+	visible := []models.Datamap{}
+	for _, dm := range dms {
+		if dm.VisibleTo(userID) {
+			visible = append(visible, dm)
+		}
+	}
+	return visible
+}
+
+// masterContentType returns the media type of a master written in format,
+// or false if format is not one which datamaps.WriteMaster supports.
+func masterContentType(format string) (string, bool) {
+	switch format {
+	case datamaps.MasterXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", true
+	case datamaps.MasterCSV:
+		return "text/csv; charset=utf-8", true
+	case datamaps.MasterJSON:
+		return "application/json", true
+	}
+	return "", false
+}
+
+// setMasterDisposition names the file a master for the return named
+// returnName in format is saved as. JSON masters are shown rather than
+// saved.
+func setMasterDisposition(w http.ResponseWriter, returnName, format string) {
+	if format != datamaps.MasterJSON {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": fmt.Sprintf("%s master.%s", returnName, format),
+		}))
+	}
+}
+
+// enqueue queues a job of kind with params, and files, for the user making
+// the request r and sends a 202 Accepted response holding the job, with a
+// Location header giving the URL of its status.
+func (app *application) enqueue(w http.ResponseWriter, r *http.Request, kind string, params any, files []models.JobFile) {
+	js, err := json.Marshal(params)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	job, err := app.jobs.Enqueue(models.Job{UserID: app.userID(r), Kind: kind, Params: js}, files)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+	if err := app.writeJSON(w, http.StatusAccepted, envelope{"job": job}); err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// userJob returns the job with the id in the URL of r if it belongs to the
+// user making the request. Otherwise it sends a 404 Not Found response and
+// returns false.
+func (app *application) userJob(w http.ResponseWriter, r *http.Request) (models.Job, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		app.clientError(w, http.StatusNotFound, "no matching job found")
+		return models.Job{}, false
+	}
+
+	job, err := app.store.GetJob(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound, "no matching job found")
+			return models.Job{}, false
+		}
+		app.serverError(w, r, err)
+		return models.Job{}, false
+	}
+	if job.UserID != app.userID(r) {
+		app.clientError(w, http.StatusNotFound, "no matching job found")
+		return models.Job{}, false
+	}
+	return job, true
+}
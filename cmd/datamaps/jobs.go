@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"git.yulqen.org/go/datamaps-go/internal/datamaps"
+	"git.yulqen.org/go/datamaps-go/internal/jobs"
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// Kinds of background job run by the server.
+const (
+	// jobImport imports the files uploaded to a return.
+	jobImport = "import"
+
+	// jobMaster builds a master for a return.
+	jobMaster = "master"
+)
+
+// importParams are the parameters of a jobImport job.
+type importParams struct {
+	Datamap string `json:"datamap"`
+	Return  string `json:"return"`
+}
+
+// masterParams are the parameters of a jobMaster job.
+type masterParams struct {
+	Datamap string `json:"datamap"`
+	Return  string `json:"return"`
+	Format  string `json:"format"`
+}
+
+// jobEvent is the payload of the webhook event sent when a job finishes.
+type jobEvent struct {
+	Event   string `json:"event"`
+	JobID   int64  `json:"job_id"`
+	Status  string `json:"status"`
+	Return  string `json:"return"`
+	Datamap string `json:"datamap"`
+
+	// Files is the number of files imported, not counting those which
+	// could not be, or zero for a master.
+	Files int `json:"files"`
+
+	// Errors are why the job failed or, for an import, why any of its
+	// files could not be imported.
+	Errors []string `json:"errors"`
+
+	// MasterURL is where a master which was built can be downloaded.
+	MasterURL string `json:"master_url,omitempty"`
+
+	// JobURL is where the status of the job is shown.
+	JobURL string `json:"job_url"`
+}
+
+// newJobRunner returns a Runner for the application's jobs, running workers
+// jobs at a time, which notifies the owner's webhooks as each job finishes.
+func (app *application) newJobRunner(workers int) *jobs.Runner {
+	r := jobs.NewRunner(app.store, app.logger, workers)
+	r.Register(jobImport, app.importJob)
+	r.Register(jobMaster, app.masterJob)
+	r.OnFinish = app.jobFinished
+	return r
+}
+
+// jobFinished sends the webhook event describing job, which has just
+// finished, to the webhooks of the user who queued it.
+func (app *application) jobFinished(job models.Job) {
+	if app.webhooks == nil {
+		return
+	}
+
+	var params importParams
+	if err := json.Unmarshal(job.Params, &params); err != nil {
+		app.logger.Error("cannot read job parameters", "id", job.ID, "error", err)
+		return
+	}
+
+	jobURL := fmt.Sprintf("%s/jobs/%d", app.publicURL, job.ID)
+	ev := jobEvent{
+		JobID:   job.ID,
+		Status:  job.Status,
+		Return:  params.Return,
+		Datamap: params.Datamap,
+		Errors:  []string{},
+		JobURL:  jobURL,
+	}
+	if job.Error != "" {
+		ev.Errors = append(ev.Errors, job.Error)
+	}
+
+	switch job.Kind {
+	case jobImport:
+		ev.Event = models.EventImportFinished
+		if job.Status == models.JobSucceeded {
+			imported, fileErrors, err := app.importResult(job.ID)
+			if err != nil {
+				app.logger.Error("cannot read import result", "id", job.ID, "error", err)
+			}
+			ev.Files = imported
+			ev.Errors = append(ev.Errors, fileErrors...)
+		}
+	case jobMaster:
+		ev.Event = models.EventMasterFinished
+		if job.Status == models.JobSucceeded {
+			ev.MasterURL = jobURL + "/result"
+		}
+	default:
+		return
+	}
+
+	if err := app.webhooks.Notify(job.UserID, ev.Event, ev); err != nil {
+		app.logger.Error("cannot send webhooks", "id", job.ID, "event", ev.Event, "error", err)
+	}
+}
+
+// importResult returns the number of files which the import job with id
+// imported, and the errors of those it could not, each prefixed by the name
+// of the file.
+func (app *application) importResult(id int64) (int, []string, error) {
+	_, data, err := app.store.JobResult(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var result struct {
+		Files []datamaps.ExtractionReport `json:"files"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		imported int
+		errs     []string
+	)
+	for _, f := range result.Files {
+		if f.Error != "" {
+			errs = append(errs, f.Filename+": "+f.Error)
+		} else {
+			imported++
+		}
+	}
+	return imported, errs, nil
+}
+
+// importJob imports the files of job into a return, one at a time, and
+// results in the extraction report of each file. A file which cannot be
+// imported does not stop the others, but cancelling the job stops it
+// before the next file.
+func (app *application) importJob(ctx context.Context, job models.Job, progress jobs.Progress) (jobs.Result, error) {
+	var params importParams
+	if err := json.Unmarshal(job.Params, &params); err != nil {
+		return jobs.Result{}, err
+	}
+
+	files, err := app.store.JobFiles(job.ID)
+	if err != nil {
+		return jobs.Result{}, err
+	}
+
+	reports := make([]*datamaps.ExtractionReport, 0, len(files))
+	progress(0, len(files))
+	for i, f := range files {
+		report, err := datamaps.ImportXLSX(ctx, params.Datamap, params.Return, f.Filename,
+			bytes.NewReader(f.Data), int64(len(f.Data)), app.store)
+		if ctx.Err() != nil {
+			return jobs.Result{}, ctx.Err()
+		}
+		if err != nil {
+			report = &datamaps.ExtractionReport{
+				Filename:    f.Filename,
+				Mapped:      []datamaps.CellReport{},
+				Missing:     []datamaps.CellReport{},
+				Unparseable: []datamaps.CellReport{},
+				Error:       err.Error(),
+			}
+		}
+		reports = append(reports, report)
+		progress(i+1, len(files))
+	}
+
+	return jsonResult(envelope{"return": params.Return, "datamap": params.Datamap, "files": reports})
+}
+
+// masterJob builds a master and results in the master file.
+func (app *application) masterJob(ctx context.Context, job models.Job, progress jobs.Progress) (jobs.Result, error) {
+	var params masterParams
+	if err := json.Unmarshal(job.Params, &params); err != nil {
+		return jobs.Result{}, err
+	}
+	contentType, ok := masterContentType(params.Format)
+	if !ok {
+		return jobs.Result{}, errors.New("format must be one of xlsx, csv or json")
+	}
+
+	progress(0, 1)
+	m, err := datamaps.AssembleMaster(params.Datamap, params.Return, app.store)
+	if err != nil {
+		return jobs.Result{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return jobs.Result{}, err
+	}
+
+	var buf bytes.Buffer
+	if err := datamaps.WriteMaster(&buf, m, params.Format); err != nil {
+		return jobs.Result{}, err
+	}
+	progress(1, 1)
+	return jobs.Result{Type: contentType, Data: buf.Bytes()}, nil
+}
+
+// jsonResult returns data encoded as the JSON result of a job.
+func jsonResult(data envelope) (jobs.Result, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return jobs.Result{}, err
+	}
+	return jobs.Result{Type: "application/json", Data: js}, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// statusRecorder wraps a http.ResponseWriter to record the status code
+// and number of bytes written for logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += n
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// logRequest logs each request along with the status of its response
+// and how long it took.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(sr, r)
+
+		app.logger.Info("request",
+			"ip", r.RemoteAddr,
+			"proto", r.Proto,
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"status", sr.status,
+			"size", sr.size,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// recoverPanic sends a 500 Internal Server Error response rather than
+// dropping the connection if a handler panics.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				w.Header().Set("Connection", "close")
+				app.serverError(w, r, fmt.Errorf("%s", err))
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate adds the user identified by the API token in the
+// Authorization header or, failing that, by the session cookie, if any,
+// to the request context. A request with an invalid token is rejected.
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Authorization"); header != "" {
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok || token == "" {
+				app.invalidTokenResponse(w)
+				return
+			}
+
+			user, apiToken, err := app.store.TokenUser(token)
+			if err != nil {
+				if errors.Is(err, models.ErrNoRecord) {
+					app.invalidTokenResponse(w)
+					return
+				}
+				app.serverError(w, r, err)
+				return
+			}
+
+			r = app.contextSetUser(r, &user)
+			next.ServeHTTP(w, app.contextSetToken(r, &apiToken))
+			return
+		}
+
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.store.SessionUser(cookie.Value)
+		if err != nil {
+			if !errors.Is(err, models.ErrNoRecord) {
+				app.serverError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, app.contextSetUser(r, &user))
+	})
+}
+
+// requireAuthentication sends a 401 Unauthorized JSON response unless
+// the request was made by an authenticated user.
+func (app *application) requireAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetUser(r) == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			app.clientError(w, http.StatusUnauthorized, "you must be authenticated to access this resource")
+			return
+		}
+
+		w.Header().Add("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireWriteScope sends a 403 Forbidden JSON response if the request was
+// authenticated with a read-only API token.
+func (app *application) requireWriteScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := app.contextGetToken(r); token != nil && !token.CanWrite() {
+			app.clientError(w, http.StatusForbidden, "this API token is read-only")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePageAuthentication redirects to the login page unless the
+// request was made by an authenticated user.
+func (app *application) requirePageAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetUser(r) == nil {
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+
+		w.Header().Add("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
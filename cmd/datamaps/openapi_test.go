@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"git.yulqen.org/go/datamaps-go/api"
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// loadSpec parses the embedded OpenAPI specification.
+func loadSpec(t *testing.T) map[string]any {
+	t.Helper()
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(api.Spec, &doc); err != nil {
+		t.Fatalf("cannot parse OpenAPI spec: %v", err)
+	}
+	return doc
+}
+
+// resolve follows node's $ref, if it has one, to a component in doc.
+func resolve(doc map[string]any, node any) any {
+	m, ok := node.(map[string]any)
+	if !ok {
+		return node
+	}
+	ref, ok := m["$ref"].(string)
+	if !ok {
+		return node
+	}
+
+	var target any = doc
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		obj, ok := target.(map[string]any)
+		if !ok {
+			return nil
+		}
+		target = obj[part]
+	}
+	return resolve(doc, target)
+}
+
+// specOperation returns the operation for method and path in doc.
+func specOperation(doc map[string]any, method, path string) (map[string]any, bool) {
+	paths, _ := doc["paths"].(map[string]any)
+	item, _ := paths[path].(map[string]any)
+	op, ok := item[strings.ToLower(method)].(map[string]any)
+	return op, ok
+}
+
+// validateSchema checks that v, decoded from JSON, matches schema. Only the
+// parts of JSON Schema used in api/openapi.yaml are supported, and properties
+// not in a schema are errors unless it allows additionalProperties.
+func validateSchema(doc map[string]any, schema any, v any, at string) error {
+	s, _ := resolve(doc, schema).(map[string]any)
+	if s == nil {
+		return nil
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+		}
+	}
+
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		matched := 0
+		for _, alt := range oneOf {
+			if validateSchema(doc, alt, v, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d of the oneOf schemas, not exactly one", at, matched)
+		}
+	}
+
+	switch s["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %T", at, v)
+		}
+		required, _ := s["required"].([]any)
+		for _, r := range required {
+			if _, ok := obj[r.(string)]; !ok {
+				return fmt.Errorf("%s: missing required property %q", at, r)
+			}
+		}
+		props, _ := s["properties"].(map[string]any)
+		for k, pv := range obj {
+			if ps, ok := props[k]; ok {
+				if err := validateSchema(doc, ps, pv, at+"."+k); err != nil {
+					return err
+				}
+				continue
+			}
+			additional, ok := s["additionalProperties"]
+			if !ok || additional == false {
+				return fmt.Errorf("%s: property %q is not in the spec", at, k)
+			}
+			if err := validateSchema(doc, additional, pv, at+"."+k); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %T", at, v)
+		}
+		for i, item := range arr {
+			if err := validateSchema(doc, s["items"], item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %T", at, v)
+		}
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", at, str)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: expected an integer, got %v", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean, got %T", at, v)
+		}
+	}
+	return nil
+}
+
+// TestOpenAPIRoutes checks that every API route in routeTable is in the spec
+// and every path in the spec is served.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadSpec(t)
+	app := newTestApplication(t)
+
+	served := map[string]bool{}
+	for _, rt := range app.routeTable() {
+		if rt.page {
+			continue
+		}
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		served[strings.ToLower(method)+" "+path] = true
+		if _, ok := specOperation(doc, method, path); !ok {
+			t.Errorf("route %q is not in the OpenAPI spec", rt.pattern)
+		}
+	}
+
+	paths, _ := doc["paths"].(map[string]any)
+	for path, item := range paths {
+		for method := range item.(map[string]any) {
+			if !served[method+" "+path] {
+				t.Errorf("%s %s is in the OpenAPI spec but is not served", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// TestOpenAPIResponses makes requests to every API route and checks that the
+// responses are described by the spec.
+func TestOpenAPIResponses(t *testing.T) {
+	doc := loadSpec(t)
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice")
+
+	alice, err := app.store.GetUserByName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := app.store.CreateToken(alice.ID, "ci", models.ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A datamap without lines cannot be used to build a master.
+	if _, err := app.store.InsertDatamap(models.Datamap{Name: "Empty"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every event is delivered to a webhook, so that there is a delivery
+	// log to list.
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(receiver.Close)
+	hook, err := app.store.CreateWebhook(alice.ID, receiver.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broken := filepath.Join(t.TempDir(), "broken.xlsx")
+	if err := os.WriteFile(broken, []byte("not a spreadsheet"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func(method, urlPath string) *http.Request {
+		req, err := http.NewRequest(method, ts.URL+urlPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	get := func(urlPath string) func() *http.Request {
+		return func() *http.Request { return newRequest(http.MethodGet, urlPath) }
+	}
+	upload := func(fields map[string]string, files ...string) func() *http.Request {
+		return func() *http.Request { return ts.uploadRequest(t, "/returns/Q1/files", fields, files...) }
+	}
+	postForm := func(urlPath string, form url.Values) func() *http.Request {
+		return func() *http.Request {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+urlPath, strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req
+		}
+	}
+	// afterJob is like newRequest but waits for the job with id to finish
+	// first. Jobs are numbered in the order the tests below queue them.
+	afterJob := func(id int, method, urlPath string) func() *http.Request {
+		return func() *http.Request {
+			ts.waitForJob(t, fmt.Sprintf("/jobs/%d", id))
+			return newRequest(method, urlPath)
+		}
+	}
+	// afterDelivery is like get but waits for an event to be delivered
+	// to hook first.
+	afterDelivery := func(urlPath string) func() *http.Request {
+		return func() *http.Request {
+			ts.waitForJob(t, "/jobs/1")
+			for range 500 {
+				if deliveries, _, err := app.store.Deliveries(hook.ID, models.ListOptions{}); err == nil && len(deliveries) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return newRequest(http.MethodGet, urlPath)
+		}
+	}
+	dm := map[string]string{"datamap": testDatamapName}
+
+	tests := []struct {
+		pattern  string
+		request  func() *http.Request
+		anon     bool
+		wantCode int
+	}{
+		{"GET /openapi.yaml", get("/openapi.yaml"), true, http.StatusOK},
+		{"POST /returns/{name}/files", upload(dm, testTemplate, broken), false, http.StatusAccepted},
+		{"POST /returns/{name}/files", upload(nil, testTemplate), false, http.StatusBadRequest},
+		{"POST /returns/{name}/files", upload(dm, "handlers_test.go"), false, http.StatusUnsupportedMediaType},
+		{"POST /returns/{name}/files", upload(dm, testTemplate), true, http.StatusUnauthorized},
+		{"GET /datamaps", get("/datamaps"), false, http.StatusOK},
+		{"GET /datamaps", get("/datamaps?limit=0"), false, http.StatusBadRequest},
+		{"GET /datamaps", get("/datamaps"), true, http.StatusUnauthorized},
+		{"GET /datamaps/{name}", get("/datamaps/Test%20Datamap"), false, http.StatusOK},
+		{"GET /datamaps/{name}", get("/datamaps/Bobbins"), false, http.StatusNotFound},
+		{"GET /datamaps/{name}/lines", get("/datamaps/Test%20Datamap/lines?limit=2&sort=key"), false, http.StatusOK},
+		{"GET /datamaps/{name}/lines", get("/datamaps/Test%20Datamap/lines?sort=size"), false, http.StatusBadRequest},
+		{"GET /datamaps/{name}/lines", get("/datamaps/Bobbins/lines"), false, http.StatusNotFound},
+		{"GET /returns", get("/returns"), false, http.StatusOK},
+		{"GET /returns/{name}", get("/returns/Q1"), false, http.StatusOK},
+		{"GET /returns/{name}", get("/returns/Q9"), false, http.StatusNotFound},
+		{"GET /returns/{name}/values", get("/returns/Q1/values?datamap=Test+Datamap&q=a+t"), false, http.StatusOK},
+		{"GET /returns/{name}/values", get("/returns/Q1/values?datamap=Test+Datamap&cursor=bobbins"), false, http.StatusBadRequest},
+		{"GET /returns/{name}/values", get("/returns/Q9/values?datamap=Test+Datamap"), false, http.StatusNotFound},
+		{"GET /returns/{name}/master", get("/returns/Q1/master?datamap=Test+Datamap"), false, http.StatusOK},
+		{"GET /returns/{name}/master", get("/returns/Q1/master?datamap=Test+Datamap&format=csv"), false, http.StatusOK},
+		{"GET /returns/{name}/master", get("/returns/Q1/master?datamap=Test+Datamap&format=json"), false, http.StatusOK},
+		{"GET /returns/{name}/master", get("/returns/Q1/master"), false, http.StatusBadRequest},
+		{"GET /returns/{name}/master", get("/returns/Q9/master?datamap=Test+Datamap"), false, http.StatusNotFound},
+		{"POST /returns/{name}/master", postForm("/returns/Q1/master", url.Values{"datamap": {testDatamapName}, "format": {"json"}}), false, http.StatusAccepted},
+		{"POST /returns/{name}/master", postForm("/returns/Q1/master", url.Values{"datamap": {"Empty"}}), false, http.StatusAccepted},
+		{"POST /returns/{name}/master", postForm("/returns/Q1/master", url.Values{"datamap": {testDatamapName}, "format": {"pdf"}}), false, http.StatusBadRequest},
+		{"POST /returns/{name}/master", postForm("/returns/Q9/master", url.Values{"datamap": {testDatamapName}}), false, http.StatusNotFound},
+		{"GET /jobs", get("/jobs"), false, http.StatusOK},
+		{"GET /jobs/{id}", get("/jobs/1"), false, http.StatusOK},
+		{"GET /jobs/{id}", get("/jobs/999"), false, http.StatusNotFound},
+		{"GET /jobs/{id}/result", afterJob(1, http.MethodGet, "/jobs/1/result"), false, http.StatusOK},
+		{"GET /jobs/{id}/result", afterJob(2, http.MethodGet, "/jobs/2/result"), false, http.StatusOK},
+		{"GET /jobs/{id}/result", afterJob(3, http.MethodGet, "/jobs/3/result"), false, http.StatusConflict},
+		{"POST /jobs/{id}/cancel", afterJob(1, http.MethodPost, "/jobs/1/cancel"), false, http.StatusConflict},
+		{"POST /jobs/{id}/cancel", func() *http.Request { return newRequest(http.MethodPost, "/jobs/999/cancel") }, false, http.StatusNotFound},
+		{"GET /keys/{key}/history", get("/keys/A%20Vunt/history"), false, http.StatusOK},
+		{"GET /keys/{key}/history", get("/keys/A%20Vunt/history?format=csv"), false, http.StatusOK},
+		{"GET /keys/{key}/history", get("/keys/A%20Vunt/history?format=xml"), false, http.StatusBadRequest},
+		{"GET /tokens", get("/tokens"), false, http.StatusOK},
+		{"POST /tokens", postForm("/tokens", url.Values{"name": {"notebook"}}), false, http.StatusCreated},
+		{"POST /tokens", postForm("/tokens", url.Values{"name": {"notebook"}, "scope": {"admin"}}), false, http.StatusBadRequest},
+		{"DELETE /tokens/{id}", func() *http.Request { return newRequest(http.MethodDelete, fmt.Sprintf("/tokens/%d", token.ID)) }, false, http.StatusNoContent},
+		{"DELETE /tokens/{id}", func() *http.Request { return newRequest(http.MethodDelete, "/tokens/999") }, false, http.StatusNotFound},
+		{"GET /webhooks", get("/webhooks?sort=-url"), false, http.StatusOK},
+		{"GET /webhooks", get("/webhooks?sort=secret"), false, http.StatusBadRequest},
+		{"POST /webhooks", postForm("/webhooks", url.Values{"url": {receiver.URL + "/masters"}, "events": {models.EventMasterFinished}}), false, http.StatusCreated},
+		{"POST /webhooks", postForm("/webhooks", url.Values{"url": {"ftp://example.com"}}), false, http.StatusBadRequest},
+		{"POST /webhooks", postForm("/webhooks", url.Values{"url": {receiver.URL}, "events": {"bobbins"}}), false, http.StatusBadRequest},
+		{"GET /webhooks/{id}/deliveries", afterDelivery(fmt.Sprintf("/webhooks/%d/deliveries", hook.ID)), false, http.StatusOK},
+		{"GET /webhooks/{id}/deliveries", get("/webhooks/999/deliveries"), false, http.StatusNotFound},
+		{"DELETE /webhooks/{id}", func() *http.Request { return newRequest(http.MethodDelete, fmt.Sprintf("/webhooks/%d", hook.ID+1)) }, false, http.StatusNoContent},
+		{"DELETE /webhooks/{id}", func() *http.Request { return newRequest(http.MethodDelete, "/webhooks/999") }, false, http.StatusNotFound},
+	}
+
+	tested := map[string]bool{}
+	for _, tt := range tests {
+		tested[tt.pattern] = true
+		req := tt.request()
+
+		t.Run(fmt.Sprintf("%s %s", req.Method, req.URL.RequestURI()), func(t *testing.T) {
+			var (
+				code   int
+				header http.Header
+				body   []byte
+			)
+			if tt.anon {
+				code, header, body = ts.doAnonymous(t, req)
+			} else {
+				code, header, body = ts.do(t, req)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantCode, code, body)
+			}
+
+			method, path, _ := strings.Cut(tt.pattern, " ")
+			op, ok := specOperation(doc, method, path)
+			if !ok {
+				t.Fatalf("%s is not in the OpenAPI spec", tt.pattern)
+			}
+			responses, _ := op["responses"].(map[string]any)
+			resp, _ := resolve(doc, responses[fmt.Sprint(code)]).(map[string]any)
+			if resp == nil {
+				t.Fatalf("status %d is not a documented response", code)
+			}
+
+			content, _ := resp["content"].(map[string]any)
+			if len(content) == 0 {
+				if len(body) != 0 {
+					t.Errorf("expected no body, got %s", body)
+				}
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			media, ok := content[mediaType]
+			if !ok {
+				t.Fatalf("content type %s is not documented", mediaType)
+			}
+			schema, ok := media.(map[string]any)["schema"]
+			if !ok || mediaType != "application/json" {
+				return
+			}
+
+			var v any
+			if err := json.Unmarshal(body, &v); err != nil {
+				t.Fatal(err)
+			}
+			if err := validateSchema(doc, schema, v, "response"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	for _, rt := range app.routeTable() {
+		if !rt.page && !tested[rt.pattern] {
+			t.Errorf("route %q has no contract test", rt.pattern)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	doc := loadSpec(t)
+	ref := map[string]any{"$ref": "#/components/schemas/DatamapLine"}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"Valid", `{"id": 1, "key": "A", "sheet": "S", "cellref": "A1"}`, false},
+		{"Missing property", `{"id": 1, "key": "A", "sheet": "S"}`, true},
+		{"Extra property", `{"id": 1, "key": "A", "sheet": "S", "cellref": "A1", "x": 1}`, true},
+		{"Wrong type", `{"id": "1", "key": "A", "sheet": "S", "cellref": "A1"}`, true},
+		{"Not an object", `[]`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			if err := json.Unmarshal([]byte(tt.value), &v); err != nil {
+				t.Fatal(err)
+			}
+			if err := validateSchema(doc, ref, v, "value"); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -1,10 +1,76 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
 
-func (app *application) routes() *http.ServeMux {
+	"git.yulqen.org/go/datamaps-go/ui"
+)
+
+// route is a pattern served by the application and its handler.
+type route struct {
+	pattern string
+	handler http.Handler
+
+	// page is true for routes serving the HTML interface, which are not
+	// part of the API described in api/openapi.yaml.
+	page bool
+}
+
+// routeTable returns every route served by the application.
+func (app *application) routeTable() []route {
+	page := func(pattern string, h http.HandlerFunc) route {
+		return route{pattern: pattern, handler: app.requirePageAuthentication(h), page: true}
+	}
+	api := func(pattern string, h http.HandlerFunc) route {
+		return route{pattern: pattern, handler: app.requireAuthentication(h)}
+	}
+	write := func(pattern string, h http.HandlerFunc) route {
+		return route{pattern: pattern, handler: app.requireAuthentication(app.requireWriteScope(h))}
+	}
+
+	return []route{
+		{pattern: "GET /static/", handler: http.FileServerFS(ui.Files), page: true},
+		{pattern: "GET /openapi.yaml", handler: http.HandlerFunc(app.openAPISpec)},
+
+		{pattern: "GET /user/login", handler: http.HandlerFunc(app.userLogin), page: true},
+		{pattern: "POST /user/login", handler: http.HandlerFunc(app.userLoginPost), page: true},
+		{pattern: "POST /user/logout", handler: http.HandlerFunc(app.userLogoutPost), page: true},
+
+		page("GET /{$}", app.home),
+		page("GET /ui/datamaps/{name}", app.datamapView),
+		page("GET /ui/returns/{name}", app.returnView),
+		page("GET /ui/search", app.search),
+
+		api("GET /tokens", app.tokensList),
+		write("POST /tokens", app.tokenCreate),
+		write("DELETE /tokens/{id}", app.tokenDelete),
+		api("GET /datamaps", app.datamapsList),
+		api("GET /datamaps/{name}", app.datamapGet),
+		api("GET /datamaps/{name}/lines", app.datamapLines),
+		api("GET /returns", app.returnsList),
+		api("GET /returns/{name}", app.returnGet),
+		write("POST /returns/{name}/files", app.returnFilesCreate),
+		api("GET /returns/{name}/values", app.returnValues),
+		api("GET /returns/{name}/master", app.returnMaster),
+		write("POST /returns/{name}/master", app.returnMasterCreate),
+		api("GET /keys/{key}/history", app.keyHistory),
+		api("GET /jobs", app.jobsList),
+		api("GET /jobs/{id}", app.jobGet),
+		api("GET /jobs/{id}/result", app.jobResult),
+		write("POST /jobs/{id}/cancel", app.jobCancel),
+		api("GET /webhooks", app.webhooksList),
+		write("POST /webhooks", app.webhookCreate),
+		write("DELETE /webhooks/{id}", app.webhookDelete),
+		api("GET /webhooks/{id}/deliveries", app.webhookDeliveries),
+	}
+}
+
+func (app *application) routes() http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/", app.home)
-	return mux
+	for _, rt := range app.routeTable() {
+		mux.Handle(rt.pattern, rt.handler)
+	}
+
+	return app.recoverPanic(app.logRequest(app.authenticate(mux)))
 }
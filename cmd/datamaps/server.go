@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/datamaps"
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"git.yulqen.org/go/datamaps-go/internal/webhooks"
+)
+
+// shutdownTimeout is how long in-flight requests are given to complete
+// once the server has been asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+// serve connects to the database and runs the API server, and the workers
+// running background jobs, until it receives SIGINT or SIGTERM, at which
+// point it shuts down gracefully. Jobs which are still running are run
+// again when the server next starts, and webhook deliveries waiting to be
+// retried are abandoned.
+func serve(opts *datamaps.Options) error {
+	logger := opts.Logger
+
+	store, err := models.Open(opts.ServerDSN())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	applied, err := store.MigrateUp()
+	if err != nil {
+		return err
+	}
+	for _, m := range applied {
+		logger.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	if err := models.CheckSchema(store); err != nil {
+		return err
+	}
+
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		return err
+	}
+
+	app := &application{
+		logger:        logger,
+		store:         store,
+		templateCache: templateCache,
+		webhooks:      webhooks.NewDispatcher(store, logger),
+		publicURL:     strings.TrimSuffix(opts.PublicURL, "/"),
+	}
+	app.jobs = app.newJobRunner(opts.Workers)
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	jobsErr := make(chan error, 1)
+	go func() {
+		jobsErr <- app.jobs.Run(jobsCtx)
+	}()
+
+	srv := &http.Server{
+		Addr:              opts.ServerAddr,
+		Handler:           app.routes(),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+	}
+
+	shutdownErr := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		logger.Info("shutting down server", "signal", s.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	logger.Info("starting server", "addr", srv.Addr)
+
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	if err := <-shutdownErr; err != nil {
+		return err
+	}
+
+	stopJobs()
+	if err := <-jobsErr; err != nil {
+		return err
+	}
+	app.webhooks.Close()
+
+	logger.Info("stopped server", "addr", srv.Addr)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"html/template"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/datamaps"
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"git.yulqen.org/go/datamaps-go/ui"
+)
+
+// templateData holds the dynamic data passed to the HTML templates.
+type templateData struct {
+	CurrentYear    int
+	Query          string
+	Datamap        models.Datamap
+	Datamaps       []models.Datamap
+	Lines          []models.DatamapLine
+	Return         models.Return
+	Returns        []models.Return
+	ReturnDatamaps []models.Datamap
+	Master         *datamaps.Master
+	Matches        []models.LineMatch
+	User           *models.User
+	LoginName      string
+	LoginError     string
+}
+
+// humanDate returns a nicely formatted string representation of t.
+func humanDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("02 Jan 2006 at 15:04")
+}
+
+var functions = template.FuncMap{
+	"humanDate": humanDate,
+}
+
+// newTemplateCache parses each page in ui/html/pages, along with the base
+// layout and partials, keyed on the page's file name.
+func newTemplateCache() (map[string]*template.Template, error) {
+	cache := map[string]*template.Template{}
+
+	pages, err := fs.Glob(ui.Files, "html/pages/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, page := range pages {
+		name := filepath.Base(page)
+
+		patterns := []string{
+			"html/base.tmpl",
+			"html/partials/*.tmpl",
+			page,
+		}
+
+		ts, err := template.New(name).Funcs(functions).ParseFS(ui.Files, patterns...)
+		if err != nil {
+			return nil, err
+		}
+
+		cache[name] = ts
+	}
+
+	return cache, nil
+}
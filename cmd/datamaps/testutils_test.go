@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"git.yulqen.org/go/datamaps-go/internal/webhooks"
+)
+
+// testDatamapName is the datamap loaded into the database of every test application.
+const testDatamapName = "Test Datamap"
+
+// testUsers are created in the database of every test application, with
+// testPassword as their password.
+var testUsers = []string{"alice", "bob"}
+
+const testPassword = "correct horse battery staple"
+
+// testLines matches cells in ../../internal/datamaps/testdata/test_template.xlsx.
+var testLines = []models.DatamapLine{
+	{Key: "A Ten", Sheet: "Introduction", Cellref: "A1"},
+	{Key: "A Test", Sheet: "Introduction", Cellref: "C9"},
+	{Key: "A Vunt", Sheet: "Introduction", Cellref: "C22"},
+	{Key: "A Parrot", Sheet: "Introduction", Cellref: "J9"},
+	{Key: "Missing Sheet", Sheet: "Nowhere", Cellref: "A1"},
+}
+
+// newTestApplication returns an application using a migrated SQLite database
+// in a temporary directory which holds a single datamap, with no owner,
+// and the users in testUsers.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	store, err := models.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if _, err := store.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.InsertDatamap(models.Datamap{Name: testDatamapName}, testLines); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range testUsers {
+		if _, err := store.InsertUser(name, testPassword); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		store:         store,
+		templateCache: templateCache,
+	}
+	app.webhooks = webhooks.NewDispatcher(store, app.logger)
+	app.webhooks.Backoff = time.Millisecond
+	app.webhooks.AllowPrivate = true
+
+	app.jobs = app.newJobRunner(2)
+	app.jobs.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := app.jobs.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		app.webhooks.Close()
+	})
+
+	return app
+}
+
+// importFiles uploads files, given as paths, to the return named returnName
+// with fields, waits for the import job to succeed and returns its result.
+func (ts *testServer) importFiles(t *testing.T, returnName string, fields map[string]string, files ...string) []byte {
+	t.Helper()
+
+	code, header, body := ts.do(t, ts.uploadRequest(t, "/returns/"+url.PathEscape(returnName)+"/files", fields, files...))
+	if code != http.StatusAccepted {
+		t.Fatalf("cannot upload to %s: status %d: %s", returnName, code, body)
+	}
+	if job := ts.waitForJob(t, header.Get("Location")); job.Status != models.JobSucceeded {
+		t.Fatalf("import into %s %s: %s", returnName, job.Status, job.Error)
+	}
+
+	code, _, body = ts.get(t, header.Get("Location")+"/result")
+	if code != http.StatusOK {
+		t.Fatalf("cannot get result of import into %s: status %d: %s", returnName, code, body)
+	}
+	return body
+}
+
+// waitForJob polls the status of the job at jobURL until it has finished,
+// failing the test if it takes too long, and returns the job.
+func (ts *testServer) waitForJob(t *testing.T, jobURL string) models.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		code, _, body := ts.get(t, jobURL)
+		if code != http.StatusOK {
+			t.Fatalf("cannot get job %s: status %d: %s", jobURL, code, body)
+		}
+		var rs struct{ Job models.Job }
+		if err := json.Unmarshal(body, &rs); err != nil {
+			t.Fatal(err)
+		}
+		if rs.Job.IsFinished() {
+			return rs.Job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is still %s", jobURL, rs.Job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testServer wraps httptest.Server with helpers for making requests.
+type testServer struct {
+	*httptest.Server
+}
+
+// newTestServer starts a test server for h whose client keeps cookies
+// and does not follow redirects.
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	return startTestServer(t, httptest.NewUnstartedServer(h))
+}
+
+// startTestServer starts ts, which may have been configured since it was
+// created, as newTestServer does.
+func startTestServer(t *testing.T, ts *httptest.Server) *testServer {
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Client().Jar = jar
+	ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return &testServer{ts}
+}
+
+// login logs in to the test server as the user name, so that later
+// requests carry the session cookie.
+func (ts *testServer) login(t *testing.T, name string) {
+	t.Helper()
+
+	code, _, body := ts.postForm(t, "/user/login", url.Values{"name": {name}, "password": {testPassword}})
+	if code != http.StatusSeeOther {
+		t.Fatalf("cannot log in as %s: status %d: %s", name, code, body)
+	}
+}
+
+// logout ends the test server client's session.
+func (ts *testServer) logout(t *testing.T) {
+	t.Helper()
+
+	if code, _, body := ts.postForm(t, "/user/logout", nil); code != http.StatusSeeOther {
+		t.Fatalf("cannot log out: status %d: %s", code, body)
+	}
+}
+
+// do sends req to the test server and returns the status code, headers and body.
+func (ts *testServer) do(t *testing.T, req *http.Request) (int, http.Header, []byte) {
+	t.Helper()
+	return send(t, ts.Client(), req)
+}
+
+// doAnonymous is like do but sends req without any cookies.
+func (ts *testServer) doAnonymous(t *testing.T, req *http.Request) (int, http.Header, []byte) {
+	t.Helper()
+	return send(t, &http.Client{Transport: ts.Client().Transport}, req)
+}
+
+func send(t *testing.T, client *http.Client, req *http.Request) (int, http.Header, []byte) {
+	t.Helper()
+
+	rs, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	body, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs.StatusCode, rs.Header, body
+}
+
+func (ts *testServer) get(t *testing.T, urlPath string) (int, http.Header, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+urlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts.do(t, req)
+}
+
+func (ts *testServer) postForm(t *testing.T, urlPath string, form url.Values) (int, http.Header, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+urlPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return ts.do(t, req)
+}
+
+// uploadRequest returns a request uploading files, given as paths, to urlPath
+// as a multipart form along with fields.
+func (ts *testServer) uploadRequest(t *testing.T, urlPath string, fields map[string]string, files ...string) *http.Request {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := mw.CreateFormFile("files", filepath.Base(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+urlPath, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
@@ -0,0 +1,675 @@
+package datamaps
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// command is a datamaps sub-command and the flags it accepts.
+type command struct {
+	name    string
+	summary string
+
+	// aliases are other names for the command, kept so that scripts
+	// written for older versions of datamaps still work.
+	aliases []string
+
+	// args describes the arguments the command takes after its
+	// subcommand, if it takes any, such as "[PATH ...]".
+	args string
+
+	// subcommands are the actions the command takes as its first
+	// argument, such as "up" for "migrate". The first is the default.
+	subcommands []string
+
+	// help describes the command in "datamaps COMMAND --help", after its
+	// usage line and before its options.
+	help string
+
+	// flags defines the command's flags on fs, storing them in opts.
+	flags func(fs *flag.FlagSet, opts *Options)
+
+	// validate, if set, checks opts once the flags have been parsed.
+	validate func(opts *Options) error
+
+	// textOnly is true for commands which cannot write their output as
+	// JSON with --output json.
+	textOnly bool
+}
+
+// commands are the sub-commands of datamaps, in the order they are listed
+// by "datamaps help".
+var commands = []command{
+	{
+		name:    "setup",
+		summary: "Create the configuration directory and database",
+		help: `Creates the datamaps configuration directory, a configuration file listing
+the default settings, the SQLite database, which the other commands use
+unless given a DSN, and the default import and master output directories.
+It is the same as "datamaps doctor --fix". With --profile, the database is
+created at the profile's db_path, so that a new portfolio can be set up by
+adding its profile to the configuration file and running
+"datamaps setup --profile NAME".`,
+		flags: dsnFlag,
+	},
+	{
+		name:    "doctor",
+		summary: "Check that datamaps is set up and its database is healthy",
+		aliases: []string{"checkdb"},
+		help: `Checks the config directory and file, that the database exists and its schema
+is up to date, that no rows refer to missing rows and no return data belongs
+to a deleted datamap line or return, and that the import and master output
+directories exist. Each problem is printed with a hint on putting it right,
+and the command fails if any check does. With --fix, the problems which can
+be fixed without losing data are fixed: missing directories, the
+configuration file and the database are created, migrations are applied and
+orphaned return data, which can never be read, is deleted.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.BoolVar(&opts.Fix, "fix", false, "fix the problems which can be fixed safely")
+			dsnFlag(fs, opts)
+		},
+	},
+	{
+		name:        "datamap",
+		summary:     "Import a datamap from a CSV file, or list the datamaps",
+		subcommands: []string{"import", "list"},
+		help: `Before datamaps can do much, it must know about a datamap. A datamap starts
+life as a CSV file with the format:
+
+cell_key,template_sheet,cell_reference,type
+key1,sheet1,A10,TEXT
+key2,sheet1,A11,NUMBER
+...
+
+The type, which is TEXT, NUMBER or DATE, can be left out. It is used to check
+the values in spreadsheets by "datamaps import --dry-run".
+
+"datamap import", the default, imports the file given by --import as the
+datamap named by --datamapname. "datamap list" lists the datamaps in the
+database.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.DMPath, "import", opts.DMPath, "import the CSV datamap at `PATH`")
+			fs.StringVar(&opts.DMName, "datamapname", opts.DMName, "`NAME` for the imported datamap")
+			fs.StringVar(&opts.Owner, "owner", "", "`NAME` of the user who owns the datamap (default is no owner)")
+			fs.StringVar(&opts.Visibility, "visibility", "", "`VIS` is \"public\" (the default) or \"private\" to the owner")
+			fs.BoolVar(&opts.DMOverwrite, "overwrite", false, "currently not used")
+			fs.BoolVar(&opts.DMInitial, "initial", false, "currently not used")
+			dsnFlag(fs, opts)
+		},
+		validate: func(opts *Options) error {
+			return oneOf("--visibility", opts.Visibility, "", models.Public, models.Private)
+		},
+	},
+	{
+		name:    "import",
+		summary: "Import populated spreadsheets as a return",
+		args:    "[PATH ...]",
+		help: `Imports the files and directories given as arguments, and those listed in
+the file given by --from-list, or else the directory given by --xlsxpath, into
+the return named by --returnname, using the datamap named by --datamapname.
+
+Directories are searched, with their subdirectories unless --recursive=false
+is given, for files matching an --include pattern, which are .xlsx and .xlsm
+files unless any are given, and no --exclude pattern. Patterns such as
+"*Q1*.xlsx" match file names, and those containing a slash, such as
+"archive/*", match paths within the directory; an excluded directory is not
+searched. Files given directly must also match the patterns. Excel's lock
+files, named "~$...", are skipped. Each file's data is recorded under its path
+within the directory searched, so that files of the same name in different
+folders are kept apart, or under its name if it was given directly; two files
+which would be recorded under the same name are refused.
+
+--dry-run checks the files against the datamap without storing anything,
+printing how many of its keys were found in each file, were left blank, refer
+to cells which cannot exist or to missing sheets, or hold values which are not
+of the TEXT, NUMBER or DATE type given in the datamap, followed by a list of
+the problems. --report also writes every key of every file to a CSV file.
+
+While importing, the number of files imported, the file being imported and
+the time taken and left are shown on a line redrawn as the import goes, or
+logged for each file if the output is not a terminal. A table of the files
+imported, the values stored from each and any warnings and failures follows.
+A file which cannot be imported is skipped, and the command fails once the
+others have been imported. --quiet writes nothing but errors, and --json, the
+same as --output json, writes only the summary, as JSON.
+
+Ctrl-C stops the import after the file being imported.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.XLSXPath, "xlsxpath", opts.XLSXPath, "`DIR` holding the files to import, if none are given")
+			fs.StringVar(&opts.ReturnName, "returnname", opts.ReturnName, "`NAME` of the return to import into")
+			fs.StringVar(&opts.DMName, "datamapname", opts.DMName, "`NAME` of the datamap to import with")
+			fs.StringVar(&opts.FromList, "from-list", "", "import the files and directories listed in `FILE`, one to a line, or \"-\" for standard input")
+			fs.Var((*stringList)(&opts.Include), "include", "import files matching `PATTERN` (can be repeated)")
+			fs.Var((*stringList)(&opts.Exclude), "exclude", "skip files and directories matching `PATTERN` (can be repeated)")
+			fs.BoolVar(&opts.Recursive, "recursive", opts.Recursive, "search the subdirectories of directories")
+			fs.BoolVar(&opts.DryRun, "dry-run", false, "check the files against the datamap without importing them")
+			fs.BoolVar(&opts.Quiet, "quiet", false, "write nothing but errors")
+			fs.BoolFunc("json", "write the summary as JSON, without progress (the same as --output json)", func(string) error {
+				opts.Output = OutputJSON
+				return nil
+			})
+			fs.StringVar(&opts.Report, "report", "", "write the dry run's report of every key in every file as CSV to `FILE`, or \"-\" for standard output")
+			dsnFlag(fs, opts)
+		},
+		validate: func(opts *Options) error {
+			if opts.Report != "" && !opts.DryRun {
+				return errors.New("--report can only be given with --dry-run")
+			}
+			if opts.Quiet && opts.wantJSON() {
+				return errors.New("--quiet cannot be given with --output json")
+			}
+			if opts.Report == "-" && opts.wantJSON() {
+				return errors.New("--report - cannot be given with --output json")
+			}
+			if err := checkPatterns("--include", opts.Include); err != nil {
+				return err
+			}
+			return checkPatterns("--exclude", opts.Exclude)
+		},
+	},
+	{
+		name:    "createmaster",
+		summary: "Write the master spreadsheet of a return",
+		help:    `Saves master.xlsx, holding every value of a return, in --masteroutputdir.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.ReturnName, "returnname", opts.ReturnName, "`NAME` of the return")
+			fs.StringVar(&opts.DMName, "datamapname", opts.DMName, "`NAME` of the datamap whose keys are the rows")
+			fs.StringVar(&opts.MasterOutPutPath, "masteroutputdir", opts.MasterOutPutPath, "`DIR` to save master.xlsx in")
+			dsnFlag(fs, opts)
+		},
+	},
+	{
+		name:    "history",
+		summary: "Print the value of a key in every return",
+		help: `Prints the value of --key in every return, oldest return first. --output json
+is the same as --format json.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.Key, "key", "", "`KEY` whose values are wanted")
+			fs.StringVar(&opts.Filename, "file", "", "only include values from files named `NAME`")
+			fs.StringVar(&opts.Format, "format", opts.Format, "`FORMAT` is \"csv\" or \"json\"")
+			dsnFlag(fs, opts)
+		},
+		validate: func(opts *Options) error {
+			if opts.Key == "" {
+				return errors.New("a key must be given with --key")
+			}
+			return oneOf("--format", opts.Format, HistoryCSV, HistoryJSON)
+		},
+	},
+	{
+		name:    "query",
+		summary: "Find the values stored in returns",
+		help: `Finds the values, in any return, matching every filter given, and writes where
+each came from and its value. Each filter can be repeated to match any of its
+patterns, and with none, every value is written.
+
+Patterns are matched ignoring case as in SQL's LIKE: % matches any text, _ any
+single character and \ makes the next one literal, so that --key "Total RDEL%"
+finds every key beginning "Total RDEL" and --key "Total RDEL" only that key.
+They are passed to the database as parameters, never as SQL.
+
+--format table, the default, writes a table, csv and json write every column,
+and xlsx writes a spreadsheet, with numbers as numbers, which must be saved
+with --save or redirected. --output json is the same as --format json.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.Var((*stringList)(&opts.Filter.Keys), "key", "only values of keys matching `PATTERN` (can be repeated)")
+			fs.Var((*stringList)(&opts.Filter.Sheets), "sheet", "only values from sheets matching `PATTERN` (can be repeated)")
+			fs.Var((*stringList)(&opts.Filter.Files), "file", "only values from files matching `PATTERN` (can be repeated)")
+			fs.Var((*stringList)(&opts.Filter.Returns), "return", "only values in returns matching `PATTERN` (can be repeated)")
+			fs.Var((*stringList)(&opts.Filter.Datamaps), "datamap", "only values of datamaps matching `PATTERN` (can be repeated)")
+			fs.StringVar(&opts.Sort, "sort", "", "sort by `FIELD`, which is \"key\", \"sheet\", \"filename\", \"return\" or \"datamap\", or prefixed with \"-\" for descending order (default is the order imported)")
+			fs.IntVar(&opts.Limit, "limit", 0, "write at most `N` values (default is all)")
+			fs.StringVar(&opts.Format, "format", QueryTable, "`FORMAT` is \"table\", \"csv\", \"json\" or \"xlsx\"")
+			fs.StringVar(&opts.SavePath, "save", "", "save the values in `FILE` instead of writing them")
+			dsnFlag(fs, opts)
+		},
+		validate: func(opts *Options) error {
+			if err := oneOf("--format", opts.Format, QueryTable, QueryCSV, QueryJSON, QueryXLSX); err != nil {
+				return err
+			}
+			if err := oneOf("--sort", strings.TrimPrefix(opts.Sort, "-"), append([]string{""}, querySorts...)...); err != nil {
+				return err
+			}
+			if opts.Limit < 0 {
+				return errors.New("--limit cannot be negative")
+			}
+			for _, f := range []struct {
+				flag     string
+				patterns []string
+			}{
+				{"--key", opts.Filter.Keys},
+				{"--sheet", opts.Filter.Sheets},
+				{"--file", opts.Filter.Files},
+				{"--return", opts.Filter.Returns},
+				{"--datamap", opts.Filter.Datamaps},
+			} {
+				if err := checkLikePatterns(f.flag, f.patterns); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:        "migrate",
+		summary:     "Show or apply the database's schema migrations",
+		subcommands: []string{"status", "up"},
+		help: `"migrate up" applies any schema migrations which the database is missing,
+keeping existing data. "migrate status" lists every migration and when it was
+applied. Other commands refuse to run against an out of date database.`,
+		flags: dsnFlag,
+	},
+	{
+		name:        "user",
+		summary:     "Add or list the users who can log in to the server",
+		subcommands: []string{"list", "add"},
+		help: `Users can only see datamaps and returns which have no owner, which they own
+or which are public. Only the owner of a return can upload files to it.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.UserName, "username", "", "`NAME` of the user to add")
+			fs.StringVar(&opts.PasswordFile, "password-file", "", "`FILE` holding the password for the new user (read from standard input if not given)")
+			dsnFlag(fs, opts)
+		},
+		validate: func(opts *Options) error {
+			if opts.Subcommand == "add" && opts.UserName == "" {
+				return errors.New("a user name must be given with --username")
+			}
+			return nil
+		},
+	},
+	{
+		name:        "token",
+		summary:     "Create, list or revoke a user's API tokens",
+		subcommands: []string{"list", "create", "revoke"},
+		help: `Scripts can call the server's JSON endpoints by sending a token in the
+header "Authorization: Bearer TOKEN". Read tokens cannot upload files or
+manage tokens.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.UserName, "username", "", "`NAME` of the user who owns the tokens")
+			fs.StringVar(&opts.TokenName, "tokenname", "", "`NAME` for a new token, such as \"ci\"")
+			fs.StringVar(&opts.Scope, "scope", opts.Scope, "`SCOPE` of a new token, \"read\" or \"read-write\"")
+			fs.Int64Var(&opts.TokenID, "id", 0, "`ID` of the token to revoke, as shown by \"token list\"")
+			dsnFlag(fs, opts)
+		},
+		validate: func(opts *Options) error {
+			switch {
+			case opts.UserName == "":
+				return errors.New("a user name must be given with --username")
+			case opts.Subcommand == "create" && opts.TokenName == "":
+				return errors.New("a token name must be given with --tokenname")
+			case opts.Subcommand == "revoke" && opts.TokenID < 1:
+				return errors.New("the id of the token to revoke must be given with --id")
+			}
+			return oneOf("--scope", opts.Scope, models.ScopeRead, models.ScopeReadWrite)
+		},
+	},
+	{
+		name:        "config",
+		summary:     "Show the configuration and where each setting came from",
+		subcommands: []string{"show", "profiles"},
+		help: `Settings are read from the configuration file, which "datamaps setup" creates
+in the user config directory unless $DATAMAPS_CONFIG names another, then from
+DATAMAPS_* environment variables and then from flags, each overriding the
+last. A profile, chosen with --profile or $DATAMAPS_PROFILE, overrides the
+file's settings with those in its block under "profiles".
+
+"config show" prints every setting in use and where it came from; it takes
+the flags of the other commands to show their effect. "config profiles" lists
+the profiles in the configuration file.`,
+		flags: settingFlags,
+	},
+	{
+		name:    "server",
+		summary: "Run the API server",
+		help: `The server applies any outstanding migrations when it starts. Every request
+other than logging in must come from a user who has logged in at /user/login.
+Uploads and master builds are queued as background jobs, whose progress is
+shown at /jobs/ID. Jobs left running when a server stopped are queued again
+once their lease expires, a minute later. Users can register webhooks at /webhooks to be sent a signed
+notification when their jobs finish.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.ServerAddr, "addr", opts.ServerAddr, "`ADDR` to listen on, or $DATAMAPS_ADDR")
+			fs.StringVar(&opts.DSN, "dsn", opts.DSN, "database connection `DSN` (default is PostgreSQL on localhost, or $DATAMAPS_DSN)")
+			fs.DurationVar(&opts.ReadHeaderTimeout, "read-header-timeout", opts.ReadHeaderTimeout, "maximum `DURATION` for reading a request's headers")
+			fs.DurationVar(&opts.ReadTimeout, "read-timeout", opts.ReadTimeout, "maximum `DURATION` for reading a request other than an upload")
+			fs.DurationVar(&opts.WriteTimeout, "write-timeout", opts.WriteTimeout, "maximum `DURATION` for writing a response")
+			fs.DurationVar(&opts.IdleTimeout, "idle-timeout", opts.IdleTimeout, "maximum `DURATION` to keep idle connections open")
+			fs.IntVar(&opts.Workers, "workers", opts.Workers, "`N`umber of background jobs run at once")
+			fs.StringVar(&opts.PublicURL, "public-url", opts.PublicURL, "`URL` the server is reached at, used in webhook payloads, or $DATAMAPS_PUBLIC_URL")
+		},
+		textOnly: true,
+		validate: func(opts *Options) error {
+			if opts.Workers < 1 {
+				return errors.New("--workers must be at least 1")
+			}
+			return nil
+		},
+	},
+	{
+		name:    "shell",
+		summary: "Explore the database at an interactive prompt",
+		help: `Starts a prompt at which the datamaps, returns, keys and values in the
+database can be explored without writing SQL. Type "help" at the prompt for
+the commands, which include:
+
+  datamaps, returns       list the datamaps and returns
+  use datamap|return NAME choose the datamap and return used by the others
+  keys [LIKE] PATTERN     list the datamap's keys, such as keys LIKE 'Total%'
+  value KEY [FILE]        show the value of a key in the return
+  history KEY [FILE]      show the value of a key in every return
+  master [RETURN]         show the master of the return
+  diff RETURN [RETURN]    show the values which differ between two returns
+
+The datamap and return are --datamapname and --returnname to begin with. At a
+terminal, earlier commands are recalled with the arrow keys and Tab completes
+commands, names, keys and files. Commands can also be piped in, one to a line,
+in which case the shell fails if any of them does.`,
+		flags: func(fs *flag.FlagSet, opts *Options) {
+			fs.StringVar(&opts.DMName, "datamapname", opts.DMName, "`NAME` of the datamap to begin with")
+			fs.StringVar(&opts.ReturnName, "returnname", opts.ReturnName, "`NAME` of the return to begin with")
+			dsnFlag(fs, opts)
+		},
+		textOnly: true,
+	},
+	{
+		name:        "completion",
+		summary:     "Write a shell completion script",
+		subcommands: []string{"bash", "zsh", "fish"},
+		help: `Writes a script which completes the commands, subcommands and flags of
+datamaps in bash, zsh or fish, along with the names of the datamaps, returns
+and users in the database for --datamapname, --returnname, --username and
+--owner. The names are read from the database the command line being
+completed would use, so a --dsn or --profile typed earlier in the line is
+taken into account.
+
+To load completions in the current shell:
+
+  bash: source <(datamaps completion bash)
+  zsh:  source <(datamaps completion zsh)
+  fish: datamaps completion fish | source
+
+To load them in every shell, save the script where the shell looks for
+completions, such as ~/.local/share/bash-completion/completions/datamaps,
+a directory in $fpath as _datamaps, or ~/.config/fish/completions/datamaps.fish.`,
+		textOnly: true,
+	},
+}
+
+// dsnFlag defines the --dsn flag shared by the commands which use the
+// database.
+func dsnFlag(fs *flag.FlagSet, opts *Options) {
+	fs.StringVar(&opts.DSN, "dsn", opts.DSN, "database connection `DSN` (default is the database created by setup, or $DATAMAPS_DSN)")
+}
+
+// stringList is a flag which can be given more than once, collecting its
+// values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// oneOf returns an error naming flag unless value is one of values.
+func oneOf(flag, value string, values ...string) error {
+	if slices.Contains(values, value) {
+		return nil
+	}
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" {
+			quoted = append(quoted, fmt.Sprintf("%q", v))
+		}
+	}
+	return fmt.Errorf("%s must be %s, not %q", flag, strings.Join(quoted, " or "), value)
+}
+
+// lookupCommand returns the command called name.
+func lookupCommand(name string) (command, bool) {
+	i := slices.IndexFunc(commands, func(c command) bool {
+		return c.name == name || slices.Contains(c.aliases, name)
+	})
+	if i < 0 {
+		return command{}, false
+	}
+	return commands[i], true
+}
+
+// flagSet returns a FlagSet holding the flags of c, and the --profile and
+// --output flags taken by every command, which are stored in opts as they
+// are parsed. It reports errors rather than printing them.
+func (c command) flagSet(opts *Options) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.Profile, "profile", opts.Profile, "`NAME` of the profile in the configuration file to use, or $DATAMAPS_PROFILE")
+	if !c.textOnly {
+		fs.StringVar(&opts.Output, "output", opts.Output, "`FORMAT` of the output, \"text\" or \"json\"")
+	}
+	fs.StringVar(&opts.LogLevel, "log-level", opts.LogLevel, "write logs at `LEVEL` or above: \"debug\", \"info\", \"warn\" or \"error\"")
+	fs.StringVar(&opts.LogFormat, "log-format", opts.LogFormat, "`FORMAT` of the logs on standard error, \"text\" or \"json\"")
+	if c.flags != nil {
+		c.flags(fs, opts)
+	}
+	return fs
+}
+
+// ParseArgs parses the command line arguments which follow the program
+// name into Options. The first argument names the command; commands with
+// subcommands take one as the second argument, and the rest are the
+// command's flags, which may be written with one dash or two. Asking for
+// help, with no arguments, "help [COMMAND]" or a command's --help flag,
+// sets Command to "help" and HelpTopic to the command, if any. The error
+// describes an unknown command, subcommand or flag, or an invalid value.
+func ParseArgs(args []string) (*Options, error) {
+	opts, err := defaultOptions()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return opts, nil
+	}
+
+	name, args := args[0], args[1:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			return nil, errors.New("help takes at most one command")
+		}
+		if len(args) == 1 {
+			if _, ok := lookupCommand(args[0]); !ok {
+				return nil, unknownCommand(args[0])
+			}
+			opts.HelpTopic = args[0]
+		}
+		return opts, nil
+	}
+
+	c, ok := lookupCommand(name)
+	if !ok {
+		return nil, unknownCommand(name)
+	}
+	opts.Command = c.name
+
+	if len(c.subcommands) > 0 {
+		opts.Subcommand = c.subcommands[0]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			if !slices.Contains(c.subcommands, args[0]) {
+				return nil, fmt.Errorf("unknown %s command %q - use %s", c.name, args[0], strings.Join(c.subcommands, ", "))
+			}
+			opts.Subcommand, args = args[0], args[1:]
+		}
+	}
+
+	// The flags are parsed twice: first to find the profile, which picks
+	// settings from the configuration file, and then into the Options once
+	// the file and environment have been applied, so that they override
+	// both.
+	probe := *opts
+	if _, err := parseFlags(c.flagSet(&probe), args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			opts.Command, opts.Subcommand, opts.HelpTopic = "help", "", c.name
+			return opts, nil
+		}
+		return nil, fmt.Errorf("%s: %v", c.name, err)
+	}
+	opts.Profile = probe.Profile
+	if err := applyConfig(opts); err != nil {
+		return nil, err
+	}
+
+	fs := c.flagSet(opts)
+	rest, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.name, err)
+	}
+	fs.Visit(func(f *flag.Flag) { opts.setByFlag(f.Name) })
+	if len(rest) > 0 {
+		if c.args == "" {
+			return nil, fmt.Errorf("%s: unexpected argument %q", c.name, rest[0])
+		}
+		opts.Files = rest
+	}
+	if err := oneOf("--output", opts.Output, OutputText, OutputJSON); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.name, err)
+	}
+	if err := oneOf("--log-level", opts.LogLevel, LogDebug, LogInfo, LogWarn, LogError); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.name, err)
+	}
+	if err := oneOf("--log-format", opts.LogFormat, LogText, LogJSON); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.name, err)
+	}
+	if c.validate != nil {
+		if err := c.validate(opts); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.name, err)
+		}
+	}
+	return opts, nil
+}
+
+// parseFlags parses args with fs and returns the arguments which are not
+// flags. Unlike fs.Parse, it parses flags which follow such arguments, up
+// to a "--".
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		parsed := args[:len(args)-fs.NArg()]
+		args = fs.Args()
+		if len(args) == 0 {
+			return rest, nil
+		}
+		if len(parsed) > 0 && parsed[len(parsed)-1] == "--" {
+			return append(rest, args...), nil
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// unknownCommand returns the error for a command which does not exist.
+func unknownCommand(name string) error {
+	return fmt.Errorf("unknown command %q - run \"datamaps help\" for a list of commands", name)
+}
+
+// WriteUsage writes the help for the command named topic to w, or the list
+// of commands if topic is empty.
+func WriteUsage(w io.Writer, topic string) error {
+	if topic == "" {
+		return writeOverview(w)
+	}
+	c, ok := lookupCommand(topic)
+	if !ok {
+		return unknownCommand(topic)
+	}
+
+	usage := "usage: datamaps " + c.name
+	if len(c.subcommands) > 0 {
+		usage += " " + strings.Join(c.subcommands, "|")
+	}
+	usage += " [OPTIONS]"
+	if c.args != "" {
+		usage += " " + c.args
+	}
+	fmt.Fprintf(w, "%s\n\n%s.\n", usage, c.summary)
+	if c.help != "" {
+		fmt.Fprintf(w, "\n%s\n", c.help)
+	}
+
+	// The defaults shown are the user's, so fall back to none if they
+	// cannot be worked out.
+	opts, err := defaultOptions()
+	if err != nil {
+		opts = &Options{}
+	}
+	// Never show a password given in $DATAMAPS_DSN.
+	opts.DSN = ""
+	fs := c.flagSet(opts)
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	if len(flags) == 0 {
+		return nil
+	}
+
+	fmt.Fprint(w, "\nOptions:\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, f := range flags {
+		argName, usage := flag.UnquoteUsage(f)
+		if _, isBool := f.Value.(interface{ IsBoolFlag() bool }); isBool {
+			argName = ""
+		}
+		if argName != "" {
+			argName = " " + argName
+		}
+		if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" {
+			usage += fmt.Sprintf(" (default %q)", f.DefValue)
+		}
+		fmt.Fprintf(tw, "  --%s%s\t%s\n", f.Name, argName, usage)
+	}
+	return tw.Flush()
+}
+
+// writeOverview writes the list of commands to w.
+func writeOverview(w io.Writer) error {
+	fmt.Fprint(w, `usage: datamaps COMMAND [OPTIONS]
+
+Other commands do not create the configuration directory, configuration file
+or database. Run "datamaps setup", or "datamaps doctor --fix", to create them
+before first use.
+
+Commands:
+`)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w, `
+Run "datamaps help COMMAND", or "datamaps COMMAND --help", for the options of
+a command.
+
+With --output json, every command but server writes a single JSON document to
+standard output, holding its results, warnings and errors, and logs only to
+standard error. A command which fails before it has a result writes
+{"error": "..."}.
+
+All commands use the SQLite database created by "datamaps setup" unless given
+a DSN, either with --dsn or $DATAMAPS_DSN. A DSN beginning postgres:// selects a
+PostgreSQL database; anything else is taken as the path to a SQLite file.
+`)
+	return err
+}
@@ -0,0 +1,317 @@
+package datamaps
+
+import (
+	"bytes"
+	"flag"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	t.Setenv("DATAMAPS_DSN", "")
+	t.Setenv("DATAMAPS_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    func(o *Options) bool
+		wantErr string
+	}{
+		{
+			name: "no arguments",
+			args: nil,
+			want: func(o *Options) bool { return o.Command == "help" && o.HelpTopic == "" },
+		},
+		{
+			name: "help for a command",
+			args: []string{"help", "token"},
+			want: func(o *Options) bool { return o.Command == "help" && o.HelpTopic == "token" },
+		},
+		{
+			name: "help flag",
+			args: []string{"import", "--help"},
+			want: func(o *Options) bool { return o.Command == "help" && o.HelpTopic == "import" },
+		},
+		{
+			name:    "help for an unknown command",
+			args:    []string{"help", "bobbins"},
+			wantErr: `unknown command "bobbins"`,
+		},
+		{
+			name:    "unknown command",
+			args:    []string{"bobbins"},
+			wantErr: `unknown command "bobbins"`,
+		},
+		{
+			name: "import",
+			args: []string{"import", "--xlsxpath", "/tmp/q1", "--returnname", "Q1", "-datamapname=DM", "--dsn", "test.db"},
+			want: func(o *Options) bool {
+				return o.Command == "import" && o.XLSXPath == "/tmp/q1" && o.ReturnName == "Q1" && o.DMName == "DM" && o.DSN == "test.db"
+			},
+		},
+		{
+			name:    "flag of another command",
+			args:    []string{"import", "--workers", "2"},
+			wantErr: "import: flag provided but not defined: -workers",
+		},
+		{
+			name:    "unexpected argument",
+			args:    []string{"history", "--key", "K", "bobbins"},
+			wantErr: `history: unexpected argument "bobbins"`,
+		},
+		{
+			name: "import files",
+			args: []string{"import", "a.xlsx", "--returnname", "Q1", "dept", "--exclude", "archive", "--exclude", "*old*", "--", "--odd.xlsx"},
+			want: func(o *Options) bool {
+				return slices.Equal(o.Files, []string{"a.xlsx", "dept", "--odd.xlsx"}) && o.ReturnName == "Q1" &&
+					slices.Equal(o.Exclude, []string{"archive", "*old*"}) && o.Include == nil && o.Recursive
+			},
+		},
+		{
+			name: "import without recursion",
+			args: []string{"import", "--recursive=false", "--from-list", "files.txt"},
+			want: func(o *Options) bool { return !o.Recursive && o.FromList == "files.txt" && o.Files == nil },
+		},
+		{
+			name: "import dry run",
+			args: []string{"import", "--dry-run", "--report", "-"},
+			want: func(o *Options) bool { return o.DryRun && o.Report == "-" },
+		},
+		{
+			name:    "report without dry run",
+			args:    []string{"import", "--report", "report.csv"},
+			wantErr: "import: --report can only be given with --dry-run",
+		},
+		{
+			name: "import json",
+			args: []string{"import", "--json"},
+			want: func(o *Options) bool { return o.Output == OutputJSON && !o.Quiet },
+		},
+		{
+			name:    "quiet and json",
+			args:    []string{"import", "--quiet", "--json"},
+			wantErr: "import: --quiet cannot be given with --output json",
+		},
+		{
+			name: "output json",
+			args: []string{"doctor", "--output", "json"},
+			want: func(o *Options) bool { return o.Command == "doctor" && o.Output == OutputJSON },
+		},
+		{
+			name: "output text by default",
+			args: []string{"history", "--key", "Project Name"},
+			want: func(o *Options) bool { return o.Output == OutputText },
+		},
+		{
+			name:    "unknown output",
+			args:    []string{"doctor", "--output", "yaml"},
+			wantErr: `doctor: --output must be "text" or "json", not "yaml"`,
+		},
+		{
+			name:    "server output",
+			args:    []string{"server", "--output", "json"},
+			wantErr: "server: flag provided but not defined: -output",
+		},
+		{
+			name:    "report to output json",
+			args:    []string{"import", "--dry-run", "--report", "-", "--output", "json"},
+			wantErr: "import: --report - cannot be given with --output json",
+		},
+		{
+			name: "datamap default subcommand",
+			args: []string{"datamap", "--import", "dm.csv"},
+			want: func(o *Options) bool { return o.Subcommand == "import" && o.DMPath == "dm.csv" },
+		},
+		{
+			name: "datamap list",
+			args: []string{"datamap", "list", "--output", "json"},
+			want: func(o *Options) bool { return o.Subcommand == "list" && o.Output == OutputJSON },
+		},
+		{
+			name:    "import pattern",
+			args:    []string{"import", "--include", "[x"},
+			wantErr: `import: --include: "[x" is not a valid pattern`,
+		},
+		{
+			name:    "missing flag value",
+			args:    []string{"import", "--returnname"},
+			wantErr: "import: flag needs an argument: -returnname",
+		},
+		{
+			name: "server",
+			args: []string{"server", "--addr", ":9000", "--workers", "4", "--read-timeout", "10s"},
+			want: func(o *Options) bool {
+				return o.ServerAddr == ":9000" && o.Workers == 4 && o.ReadTimeout == 10*time.Second && o.WriteTimeout == 60*time.Second
+			},
+		},
+		{
+			name:    "invalid duration",
+			args:    []string{"server", "--idle-timeout", "soon"},
+			wantErr: `server: invalid value "soon" for flag -idle-timeout`,
+		},
+		{
+			name:    "no workers",
+			args:    []string{"server", "--workers", "0"},
+			wantErr: "server: --workers must be at least 1",
+		},
+		{
+			name: "doctor",
+			args: []string{"doctor", "--fix"},
+			want: func(o *Options) bool { return o.Command == "doctor" && o.Fix },
+		},
+		{
+			name: "checkdb is doctor",
+			args: []string{"checkdb"},
+			want: func(o *Options) bool { return o.Command == "doctor" && !o.Fix },
+		},
+		{
+			name: "default subcommand",
+			args: []string{"migrate"},
+			want: func(o *Options) bool { return o.Command == "migrate" && o.Subcommand == "status" },
+		},
+		{
+			name: "subcommand",
+			args: []string{"migrate", "up", "--dsn", "test.db"},
+			want: func(o *Options) bool { return o.Subcommand == "up" && o.DSN == "test.db" },
+		},
+		{
+			name:    "unknown subcommand",
+			args:    []string{"migrate", "sideways"},
+			wantErr: `unknown migrate command "sideways" - use status, up`,
+		},
+		{
+			name: "token create",
+			args: []string{"token", "create", "--username", "alice", "--tokenname", "ci", "--scope", "read-write"},
+			want: func(o *Options) bool {
+				return o.Subcommand == "create" && o.UserName == "alice" && o.TokenName == "ci" && o.Scope == "read-write"
+			},
+		},
+		{
+			name:    "token scope",
+			args:    []string{"token", "create", "--username", "alice", "--tokenname", "ci", "--scope", "admin"},
+			wantErr: `token: --scope must be "read" or "read-write", not "admin"`,
+		},
+		{
+			name:    "token revoke without id",
+			args:    []string{"token", "revoke", "--username", "alice"},
+			wantErr: "token: the id of the token to revoke must be given with --id",
+		},
+		{
+			name: "token revoke",
+			args: []string{"token", "revoke", "--username", "alice", "--id", "3"},
+			want: func(o *Options) bool { return o.Subcommand == "revoke" && o.TokenID == 3 },
+		},
+		{
+			name:    "user add without name",
+			args:    []string{"user", "add"},
+			wantErr: "user: a user name must be given with --username",
+		},
+		{
+			name: "history",
+			args: []string{"history", "--key", "Total RDEL", "--format", "json"},
+			want: func(o *Options) bool { return o.Key == "Total RDEL" && o.Format == HistoryJSON },
+		},
+		{
+			name:    "history without key",
+			args:    []string{"history"},
+			wantErr: "history: a key must be given with --key",
+		},
+		{
+			name:    "history format",
+			args:    []string{"history", "--key", "K", "--format", "xml"},
+			wantErr: `history: --format must be "csv" or "json", not "xml"`,
+		},
+		{
+			name: "query",
+			args: []string{"query", "--key", "Total RDEL%", "--key", "Project Name", "--return", "Q1%", "--sort", "-return"},
+			want: func(o *Options) bool {
+				return slices.Equal(o.Filter.Keys, []string{"Total RDEL%", "Project Name"}) && o.Filter.Returns[0] == "Q1%" &&
+					o.Sort == "-return" && o.Format == QueryTable
+			},
+		},
+		{
+			name:    "query format",
+			args:    []string{"query", "--format", "pdf"},
+			wantErr: `query: --format must be "table" or "csv" or "json" or "xlsx", not "pdf"`,
+		},
+		{
+			name:    "query sort",
+			args:    []string{"query", "--sort", "-value"},
+			wantErr: `query: --sort must be "key" or "sheet" or "filename" or "return" or "datamap", not "value"`,
+		},
+		{
+			name:    "query pattern",
+			args:    []string{"query", "--sheet", `Finance\\`, "--file", `a\`},
+			wantErr: `query: --file: "a\\" ends with a \ which escapes nothing`,
+		},
+		{
+			name: "log flags",
+			args: []string{"migrate", "--log-level", "debug", "--log-format", "json"},
+			want: func(o *Options) bool { return o.LogLevel == LogDebug && o.LogFormat == LogJSON },
+		},
+		{
+			name:    "log level",
+			args:    []string{"server", "--log-level", "loud"},
+			wantErr: `server: --log-level must be "debug" or "info" or "warn" or "error", not "loud"`,
+		},
+		{
+			name:    "datamap visibility",
+			args:    []string{"datamap", "--visibility", "secret"},
+			wantErr: `datamap: --visibility must be "public" or "private", not "secret"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := ParseArgs(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(opts) {
+				t.Errorf("unexpected options %+v", opts)
+			}
+		})
+	}
+}
+
+func TestWriteUsage(t *testing.T) {
+	for _, c := range commands {
+		t.Run(c.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := WriteUsage(buf, c.name); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(buf.String(), "usage: datamaps "+c.name) {
+				t.Errorf("unexpected usage line in %q", buf)
+			}
+			c.flagSet(&Options{}).VisitAll(func(f *flag.Flag) {
+				if !strings.Contains(buf.String(), "--"+f.Name) {
+					t.Errorf("--%s is not documented", f.Name)
+				}
+			})
+		})
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteUsage(buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range commands {
+		if !strings.Contains(buf.String(), "  "+c.name+" ") {
+			t.Errorf("%s is not listed in the overview", c.name)
+		}
+	}
+
+	if err := WriteUsage(buf, "bobbins"); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
@@ -0,0 +1,321 @@
+package datamaps
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// completeCommand is the hidden command run by the completion scripts to
+// find the candidates for the word being completed.
+const completeCommand = "__complete"
+
+// valueCompleters return the candidate values of flags, by flag name. The
+// values of other flags, most of which are paths, are left to the shell.
+var valueCompleters = map[string]func(opts *Options) []string{
+	"datamapname": inStore(datamapNames),
+	"returnname":  inStore(returnNames),
+	"datamap":     inStore(datamapNames),
+	"return":      inStore(returnNames),
+	"username":    inStore(userNames),
+	"owner":       inStore(userNames),
+	"profile":     profileNames,
+	"output":      fixedValues(OutputText, OutputJSON),
+	"log-level":   fixedValues(LogDebug, LogInfo, LogWarn, LogError),
+	"log-format":  fixedValues(LogText, LogJSON),
+	"format":      formatNames,
+	"sort":        fixedValues(querySorts...),
+	"scope":       fixedValues(models.ScopeRead, models.ScopeReadWrite),
+	"visibility":  fixedValues(models.Public, models.Private),
+}
+
+// Complete writes to w, one to a line, the candidates for the last of
+// words, which are the words of a datamaps command line after the program
+// name. The candidates are the commands, subcommands, flags and flag values
+// which begin with the last word, with datamap, return and user names read
+// from the database the command line would use. Nothing is written where
+// the shell should complete a path.
+func Complete(w io.Writer, words []string) error {
+	for _, c := range completions(words) {
+		if _, err := fmt.Fprintln(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completions returns the candidates for the last of words.
+func completions(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur, before := words[len(words)-1], words[:len(words)-1]
+
+	names := []string{"help"}
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	if len(before) == 0 {
+		return matching(names, cur, "")
+	}
+	if before[0] == "help" {
+		if len(before) == 1 {
+			return matching(names[1:], cur, "")
+		}
+		return nil
+	}
+	c, ok := lookupCommand(before[0])
+	if !ok {
+		return nil
+	}
+	args := before[1:]
+	fs := c.flagSet(&Options{})
+
+	// Find the flag whose value is being completed, if any. Bash splits
+	// "--flag=value" into three words, "--flag", "=" and "value", while
+	// other shells pass it whole.
+	var name, prefix string
+	last := func(n int) string {
+		if len(args) < n {
+			return ""
+		}
+		return args[len(args)-n]
+	}
+	switch {
+	case cur == "=" && isFlag(last(1)):
+		name, cur = last(1), ""
+		args = args[:len(args)-1]
+	case last(1) == "=" && isFlag(last(2)):
+		name = last(2)
+		args = args[:len(args)-2]
+	case isFlag(cur) && strings.Contains(cur, "="):
+		name, cur, _ = strings.Cut(cur, "=")
+		prefix = name + "="
+	case isFlag(last(1)) && !strings.Contains(last(1), "=") && takesValue(fs, last(1)):
+		name = last(1)
+		args = args[:len(args)-1]
+	}
+	if name != "" {
+		complete, ok := valueCompleters[strings.TrimLeft(name, "-")]
+		if !ok {
+			return nil
+		}
+		return matching(complete(completionOptions(c, args)), cur, prefix)
+	}
+
+	if strings.HasPrefix(cur, "-") {
+		var flags []string
+		fs.VisitAll(func(f *flag.Flag) { flags = append(flags, "--"+f.Name) })
+		return matching(flags, cur, "")
+	}
+	// A subcommand can only be the first argument.
+	if len(c.subcommands) > 0 && len(args) == 0 {
+		return matching(c.subcommands, cur, "")
+	}
+	return nil
+}
+
+// isFlag reports whether word is a flag, such as "--dsn" or "-dsn=x".
+func isFlag(word string) bool {
+	return len(word) > 1 && word[0] == '-' && word != "--"
+}
+
+// takesValue reports whether the flag given as word is defined on fs and
+// takes a value in the following word, as all but boolean flags do.
+func takesValue(fs *flag.FlagSet, word string) bool {
+	f := fs.Lookup(strings.TrimLeft(word, "-"))
+	if f == nil {
+		return false
+	}
+	b, isBool := f.Value.(interface{ IsBoolFlag() bool })
+	return !isBool || !b.IsBoolFlag()
+}
+
+// matching returns the candidates which begin with cur, ignoring a quote
+// the user has opened, each with prefix added.
+func matching(candidates []string, cur, prefix string) []string {
+	cur = strings.TrimLeft(cur, `"'`)
+	var out []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, cur) && !slices.Contains(out, prefix+c) {
+			out = append(out, prefix+c)
+		}
+	}
+	return out
+}
+
+// completionOptions returns the Options given by args, the flags and
+// arguments of c typed so far, as far as they can be parsed. Errors are
+// ignored, as the command line is not finished.
+func completionOptions(c command, args []string) *Options {
+	opts, err := defaultOptions()
+	if err != nil {
+		return &Options{Command: c.name, sources: make(map[string]string)}
+	}
+	opts.Command = c.name
+	probe := *opts
+	parseFlags(c.flagSet(&probe), args)
+	opts.Profile = probe.Profile
+	applyConfig(opts)
+	parseFlags(c.flagSet(opts), args)
+	return opts
+}
+
+// fixedValues returns a completer of values.
+func fixedValues(values ...string) func(*Options) []string {
+	return func(*Options) []string { return values }
+}
+
+// formatNames returns the formats of the command in opts.
+func formatNames(opts *Options) []string {
+	if opts.Command == "query" {
+		return []string{QueryTable, QueryCSV, QueryJSON, QueryXLSX}
+	}
+	return []string{HistoryCSV, HistoryJSON}
+}
+
+// inStore returns a completer calling names with the database used by
+// opts, which completes nothing if the database cannot be opened.
+func inStore(names func(s models.Store) []string) func(opts *Options) []string {
+	return func(opts *Options) []string {
+		s, err := openStore(opts)
+		if err != nil {
+			return nil
+		}
+		defer s.Close()
+		return names(s)
+	}
+}
+
+// datamapNames returns the names of the datamaps in s.
+func datamapNames(s models.Store) []string {
+	dms, _, err := s.Datamaps(models.ListOptions{})
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(dms))
+	for _, dm := range dms {
+		names = append(names, dm.Name)
+	}
+	return names
+}
+
+// returnNames returns the names of the returns in s.
+func returnNames(s models.Store) []string {
+	returns, _, err := s.Returns(models.ListOptions{})
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(returns))
+	for _, r := range returns {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// userNames returns the names of the users in s.
+func userNames(s models.Store) []string {
+	users, err := s.Users()
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+// profileNames returns the names of the profiles in the configuration file
+// used by opts.
+func profileNames(opts *Options) []string {
+	cf, err := readConfigFile(opts.ConfigPath)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(cf.Profiles))
+	for name := range cf.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// WriteCompletion writes the completion script for shell, which is "bash",
+// "zsh" or "fish", to w.
+func WriteCompletion(w io.Writer, shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("there is no completion script for %q - use bash, zsh or fish", shell)
+	}
+	_, err := io.WriteString(w, script)
+	return err
+}
+
+// completionScripts are the completion scripts, by shell. Each asks
+// "datamaps __complete" for the candidates, and completes a path when
+// there are none.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for datamaps.
+# Load it with: source <(datamaps completion bash)
+
+_datamaps() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	local IFS=$'\n'
+	local candidates c
+	candidates=($(datamaps ` + completeCommand + ` "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+	COMPREPLY=()
+	if [ ${#candidates[@]} -eq 0 ]; then
+		[ "$cur" = "=" ] && cur=""
+		compopt -o filenames 2>/dev/null
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+	fi
+	for c in "${candidates[@]}"; do
+		COMPREPLY+=("$(printf '%q' "$c")")
+	done
+}
+
+complete -F _datamaps datamaps
+`,
+	"zsh": `#compdef datamaps
+# zsh completion for datamaps.
+# Load it with: source <(datamaps completion zsh)
+# or save it as _datamaps in a directory in $fpath.
+
+_datamaps() {
+	local -a candidates
+	candidates=("${(@f)$(datamaps ` + completeCommand + ` "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ -z ${candidates[1]} ]]; then
+		_files
+		return
+	fi
+	compadd -- "${candidates[@]}"
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+	_datamaps "$@"
+else
+	compdef _datamaps datamaps
+fi
+`,
+	"fish": `# fish completion for datamaps.
+# Load it with: datamaps completion fish | source
+# or save it as ~/.config/fish/completions/datamaps.fish.
+
+function __datamaps_complete
+	set -l candidates (datamaps ` + completeCommand + ` (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)
+	if test (count $candidates) -eq 0
+		__fish_complete_path (commandline -ct)
+		return
+	end
+	printf '%s\n' $candidates
+end
+
+complete -c datamaps -f -a '(__datamaps_complete)'
+`,
+}
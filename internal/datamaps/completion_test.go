@@ -0,0 +1,96 @@
+package datamaps
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+func TestCompletions(t *testing.T) {
+	t.Setenv("DATAMAPS_DSN", "")
+	t.Setenv("DATAMAPS_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+
+	dsn := filepath.Join(t.TempDir(), "test.db")
+	db, err := setupDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := models.NewSQLiteStore(db)
+	for _, name := range []string{"Q1 Datamap", "Q2 Datamap", "Other"} {
+		if _, err := s.InsertDatamap(models.Datamap{Name: name}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.GetOrCreateReturn("Q1 2026"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	missing := filepath.Join(t.TempDir(), "missing.db")
+
+	tests := []struct {
+		name  string
+		words []string
+		want  []string
+	}{
+		{"command", []string{"im"}, []string{"import"}},
+		{"help topic", []string{"help", "to"}, []string{"token"}},
+		{"subcommand", []string{"migrate", ""}, []string{"status", "up"}},
+		{"no subcommand after flags", []string{"migrate", "--dsn", dsn, ""}, nil},
+		{"flag", []string{"createmaster", "--master"}, []string{"--masteroutputdir"}},
+		{"fixed values", []string{"history", "--format", ""}, []string{"csv", "json"}},
+		{"query formats", []string{"query", "--format", "x"}, []string{"xlsx"}},
+		{"query returns", []string{"query", "--dsn", dsn, "--return", ""}, []string{"Q1 2026"}},
+		{"datamap names", []string{"import", "--dsn", dsn, "--datamapname", "Q"}, []string{"Q1 Datamap", "Q2 Datamap"}},
+		{"quoted", []string{"import", "--dsn", dsn, "--datamapname", `"Q2`}, []string{"Q2 Datamap"}},
+		{"with equals", []string{"createmaster", "--dsn", dsn, "--returnname=Q"}, []string{"--returnname=Q1 2026"}},
+		{"bash equals", []string{"createmaster", "--dsn", dsn, "--returnname", "=", "Q"}, []string{"Q1 2026"}},
+		{"bash equals before value", []string{"createmaster", "--dsn", dsn, "--returnname", "="}, []string{"Q1 2026"}},
+		{"path", []string{"datamap", "--import", ""}, nil},
+		{"after a boolean flag", []string{"import", "--dry-run", ""}, nil},
+		{"unknown command", []string{"bobbins", ""}, nil},
+		{"no database", []string{"import", "--dsn", filepath.Join(t.TempDir(), "missing", "x.db"), "--datamapname", ""}, nil},
+		{"missing database", []string{"import", "--dsn", missing, "--datamapname", ""}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := completions(tt.words)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("completions(%q) = %q, want %q", tt.words, got, tt.want)
+			}
+		})
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected completion not to create %s, got %v", missing, err)
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		buf := new(bytes.Buffer)
+		if err := WriteCompletion(buf, shell); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "datamaps "+completeCommand+" ") {
+			t.Errorf("expected the %s script to call %s", shell, completeCommand)
+		}
+		// Check the script's syntax if the shell is installed.
+		if path, err := exec.LookPath(shell); err == nil {
+			cmd := exec.Command(path, "-n")
+			cmd.Stdin = buf
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("%s script: %v\n%s", shell, err, out)
+			}
+		}
+	}
+	if err := WriteCompletion(new(bytes.Buffer), "tcsh"); err == nil {
+		t.Error("expected an error for an unknown shell")
+	}
+}
@@ -1,283 +1,403 @@
 package datamaps
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
 	"os"
-	"path"
+	"text/tabwriter"
 	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"git.yulqen.org/go/datamaps-go/internal/models"
 )
 
-// OpenDB wraps sql.Open() and returns a sql.DB connection pool
-// for a given DSN.
-func OpenDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", dsn)
-	if err != nil {
-		return nil, err
+// openStore opens the Store given by opts.DSN, falling back to the
+// SQLite database at opts.DBPath, and checks that its schema is up to date.
+// A SQLite database which does not exist is not created.
+func openStore(opts *Options) (models.Store, error) {
+	dsn := opts.DSN
+	if dsn == "" {
+		dsn = opts.DBPath
 	}
-
-	err = db.Ping()
-	if err != nil {
-		db.Close()
-		return nil, err
-	}
-
-	return db, nil
-}
-
-// setupDB creates the intitial database
-func setupDB(path string) (*sql.DB, error) {
-	stmtBase := `DROP TABLE IF EXISTS datamap;
-				 DROP TABLE IF EXISTS datamap_line;
-				 DROP TABLE IF EXISTS return;
-				 DROP TABLE IF EXISTS return_data;
-
-				  CREATE TABLE datamap(
-					  id INTEGER PRIMARY KEY,
-					  name TEXT,
-					  date_created TEXT);
-
-				  CREATE TABLE datamap_line(
-					id INTEGER PRIMARY KEY,   
-					dm_id INTEGER,            
-					key TEXT NOT NULL,        
-					sheet TEXT NOT NULL,      
-					cellref TEXT,             
-					FOREIGN KEY (dm_id)       
-					REFERENCES datamap(id) 
-					ON DELETE CASCADE      
-				  );                        
-
-				 CREATE TABLE return(
-					 id INTEGER PRIMARY KEY,
-					 name TEXT,
-					 date_created TEXT
-					);
-
-				 CREATE TABLE return_data(
-					 id INTEGER PRIMARY KEY,
-					 dml_id INTEGER,
-					 ret_id INTEGER,
-					 filename TEXT,
-					 value TEXT,
-					 numfmt TEXT,
-					 vFormatted TEXT,
-					 FOREIGN KEY (dml_id)
-					 REFERENCES datamap_line(id) 
-					 ON DELETE CASCADE
-					 FOREIGN KEY (ret_id)
-					 REFERENCES return(id) 
-					 ON DELETE CASCADE
-				 );
-				 `
-	if _, err := os.Create(path); err != nil {
-		return nil, err
-	}
-	db, err := sql.Open("sqlite3", path)
-	if err != nil {
-		return db, errors.New("Cannot open that damn database file")
+	if path, ok := sqlitePath(dsn); ok && path != ":memory:" {
+		if _, err := os.Stat(path); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("there is no database at %s - run \"datamaps setup\" to create it", path)
+			}
+			return nil, err
+		}
 	}
-
-	// We probably don't need pragma here but we have it for later.
-	pragma := "PRAGMA foreign_keys = ON;"
-	_, err = db.Exec(pragma)
+	s, err := models.Open(dsn)
 	if err != nil {
-		// log.Printf("%q: %s\n", err, pragma)
 		return nil, err
 	}
 
-	_, err = db.Exec(stmtBase)
-	if err != nil {
-		// log.Printf("%q: %s\n", err, stmt_base)
+	if err := models.CheckSchema(s); err != nil {
+		s.Close()
+		if errors.Is(err, models.ErrSchemaOutdated) {
+			return nil, fmt.Errorf("%v - run \"datamaps migrate up\" to update it", err)
+		}
 		return nil, err
 	}
-
-	return db, nil
+	return s, nil
 }
 
-// ImportToDB imports a directory of xlsx files to the database, using the datamap
-// to filter the data.
-func ImportToDB(opts *Options) error {
-	log.Printf("Importing files in %s as return named %s using datamap named %s.", opts.XLSXPath, opts.ReturnName, opts.DMName)
-
-	target, err := getTargetFiles(opts.XLSXPath)
-	if err != nil {
-		return err
+// Migrate runs the migrate sub-command given in opts.Subcommand: "up" applies
+// outstanding migrations and "status" lists every migration and whether it
+// has been applied, on w. Both are written as JSON if opts.Output is
+// OutputJSON.
+func Migrate(w io.Writer, opts *Options) error {
+	dsn := opts.DSN
+	if dsn == "" {
+		dsn = opts.DBPath
 	}
-
-	db, err := sql.Open("sqlite3", opts.DBPath)
+	s, err := models.Open(dsn)
 	if err != nil {
 		return err
 	}
+	defer s.Close()
 
-	for _, vv := range target {
-		// TODO: Do the work!
-
-		if err := importXLSXtoDB(opts.DMName, opts.ReturnName, vv, db); err != nil {
+	switch opts.Subcommand {
+	case "up":
+		applied, err := s.MigrateUp()
+		for _, m := range applied {
+			opts.logger().Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if opts.wantJSON() {
+			version, err := s.SchemaVersion()
+			if err != nil {
+				return err
+			}
+			names := make([]migrationJSON, 0, len(applied))
+			for _, m := range applied {
+				names = append(names, migrationJSON{Version: m.Version, Name: m.Name, Applied: true})
+			}
+			return writeJSON(w, struct {
+				Applied []migrationJSON `json:"applied"`
+				Version int             `json:"version"`
+			}{names, version})
+		}
+		if len(applied) == 0 {
+			opts.logger().Info("database schema is up to date")
+		}
+	case "status", "":
+		status, err := s.MigrationStatus()
+		if err != nil {
 			return err
 		}
+		if opts.wantJSON() {
+			migrations := make([]migrationJSON, 0, len(status))
+			for _, m := range status {
+				mj := migrationJSON{Version: m.Version, Name: m.Name, Applied: m.Applied}
+				if m.Applied {
+					mj.AppliedAt = &m.AppliedAt
+				}
+				migrations = append(migrations, mj)
+			}
+			return writeJSON(w, struct {
+				Migrations []migrationJSON `json:"migrations"`
+			}{migrations})
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, m := range status {
+			applied := "pending"
+			if m.Applied {
+				applied = m.AppliedAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q - use \"up\" or \"status\"", opts.Subcommand)
 	}
 	return nil
 }
 
-// DatamapToDB takes a slice of datamapLine and writes it to a sqlite3 db file.
-func DatamapToDB(opts *Options) error {
-	log.Printf("Importing datamap file %s and naming it %s.\n", opts.DMPath, opts.DMName)
-
-	data, err := ReadDML(opts.DMPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	d, err := sql.Open("sqlite3", opts.DBPath)
-	if err != nil {
-		return errors.New("Cannot open that damn database file")
-	}
+// migrationJSON is a migration, as written by Migrate with --output json.
+type migrationJSON struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
 
-	tx, err := d.Begin()
+// ImportToDB imports the xlsx files chosen by opts, as described by
+// findImportFiles, to the database, using the datamap to filter the data.
+// Files which cannot be imported are skipped. Progress is shown on w, which
+// is redrawn on a single line if w is a terminal, followed by a summary of
+// the files imported, or the summary alone as JSON if opts.Output is
+// OutputJSON. Nothing is written if opts.Quiet is set. If ctx is cancelled
+// the import stops before the next file, leaving the files already imported
+// in the database. The error reports a cancelled import or the files which
+// failed.
+func ImportToDB(ctx context.Context, w io.Writer, opts *Options) error {
+	target, err := findImportFiles(opts)
 	if err != nil {
 		return err
 	}
 
-	pragma := "PRAGMA foreign_keys = ON;"
-	_, err = d.Exec(pragma)
+	s, err := openStore(opts)
 	if err != nil {
-		log.Printf("%q: %s\n", err, pragma)
 		return err
 	}
-
-	stmtDm, err := tx.Prepare("INSERT INTO datamap (name, date_created) VALUES(?,?)")
-	if err != nil {
+	defer s.Close()
+	if err := checkDatamap(s, opts.DMName); err != nil {
 		return err
 	}
 
-	res, err := stmtDm.Exec(opts.DMName, time.Now())
+	summary := &ImportSummary{Return: opts.ReturnName, Datamap: opts.DMName, Total: len(target), Files: []ImportedFile{}}
+	p := newProgress(w, opts)
+	began := time.Now()
+	p.start(len(target))
+	for _, file := range target {
+		if ctx.Err() != nil {
+			break
+		}
+		p.file(file.name)
+		f := ImportedFile{Path: file.path, Name: file.name, Warnings: []string{}}
+		report, err := importXLSXtoDB(ctx, opts.DMName, opts.ReturnName, file, s)
+		if ctx.Err() != nil {
+			// Nothing was stored from the file being imported.
+			break
+		}
+		if err != nil {
+			f.Error = err.Error()
+			summary.Failed++
+		} else {
+			f.Values = len(report.Mapped) + len(report.Unparseable)
+			f.warnings = importWarnings(report)
+			for _, w := range f.warnings {
+				f.Warnings = append(f.Warnings, w.String())
+			}
+			summary.Imported++
+			summary.Values += f.Values
+			summary.Warnings += len(f.Warnings)
+		}
+		summary.Files = append(summary.Files, f)
+		p.done(f)
+	}
+	p.finish()
+	summary.Elapsed = time.Since(began)
+	summary.Stopped = len(summary.Files) < len(target)
+
+	switch {
+	case opts.Quiet:
+	case opts.wantJSON():
+		err = writeImportJSON(w, summary)
+	default:
+		err = writeImportSummary(w, summary)
+	}
 	if err != nil {
 		return err
 	}
 
-	lastID, err := res.LastInsertId()
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d file(s) could not be imported", summary.Failed, summary.Total)
+	}
+	return nil
+}
 
-	stmtDml, err := tx.Prepare("INSERT INTO datamap_line (dm_id, key, sheet, cellref) VALUES(?,?,?,?);")
+// checkDatamap returns an error if there is no datamap named name in s.
+func checkDatamap(s models.Store, name string) error {
+	lines, err := s.DatamapLines(name)
 	if err != nil {
 		return err
 	}
+	if len(lines) == 0 {
+		return fmt.Errorf("there is no datamap in the database matching name '%s'. Try running 'datamaps datamap --import...'", name)
+	}
+	return nil
+}
 
-	defer stmtDm.Close()
-	defer stmtDml.Close()
+// Datamaps runs the datamap sub-command given in opts.Subcommand, writing
+// to w: "import" imports the datamap at opts.DMPath, as DatamapToDB does, and
+// "list" lists the datamaps in the database. Both are written as JSON if
+// opts.Output is OutputJSON.
+func Datamaps(w io.Writer, opts *Options) error {
+	switch opts.Subcommand {
+	case "import", "":
+		dm, lines, err := importDatamap(opts)
+		if err != nil {
+			return err
+		}
+		if opts.wantJSON() {
+			return writeJSON(w, struct {
+				ID         int64  `json:"id"`
+				Name       string `json:"name"`
+				OwnerID    int64  `json:"owner_id,omitempty"`
+				Visibility string `json:"visibility"`
+				Path       string `json:"path"`
+				Lines      int    `json:"lines"`
+			}{dm.ID, dm.Name, dm.OwnerID, dm.Visibility, opts.DMPath, lines})
+		}
+		opts.logger().Info("imported datamap", "datamap", dm.Name, "lines", lines)
+		return nil
+	case "list":
+		s, err := openStore(opts)
+		if err != nil {
+			return fmt.Errorf("cannot open database - %v", err)
+		}
+		defer s.Close()
 
-	for _, dml := range data {
-		_, err = stmtDml.Exec(lastID, dml.Key, dml.Sheet, dml.Cellref)
+		dms, _, err := s.Datamaps(models.ListOptions{})
 		if err != nil {
 			return err
 		}
+		if opts.wantJSON() {
+			return writeJSON(w, struct {
+				Datamaps []models.Datamap `json:"datamaps"`
+			}{dms})
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tVISIBILITY\tCREATED")
+		for _, dm := range dms {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", dm.ID, dm.Name, dm.Visibility, dm.Created.Local().Format(time.DateTime))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown datamap command %q - use \"import\" or \"list\"", opts.Subcommand)
 	}
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
+}
 
-	return nil
+// DatamapToDB reads the datamap file at opts.DMPath and stores it in the database.
+func DatamapToDB(opts *Options) error {
+	_, _, err := importDatamap(opts)
+	return err
 }
 
-func importXLSXtoDB(dmName string, returnName string, file string, db *sql.DB) error {
-	// d, err := ExtractDBDatamap(dmName, file, db)
-	_, filename := path.Split(file)
-	d, err := ExtractDBDatamap(dmName, file, db)
-	if err != nil {
-		return err
+// importDatamap reads the datamap file at opts.DMPath and stores it in the
+// database, returning the datamap and the number of its lines.
+func importDatamap(opts *Options) (models.Datamap, int, error) {
+	dm := models.Datamap{Name: opts.DMName, Visibility: opts.Visibility}
+	if opts.Visibility != "" && opts.Visibility != models.Public && opts.Visibility != models.Private {
+		return dm, 0, fmt.Errorf("visibility must be %q or %q", models.Public, models.Private)
 	}
-	log.Printf("Extracting from %s.\n", file)
 
-	// If there is already a return with a matching name, use that.
-	rtnQuery, err := db.Prepare("select id from return where (return.name=?)")
+	opts.logger().Info("importing datamap", "path", opts.DMPath, "datamap", opts.DMName)
+
+	data, err := ReadDML(opts.DMPath)
 	if err != nil {
-		fmt.Errorf("cannot create a query to get the return - %v", err)
+		return dm, 0, err
 	}
-	defer rtnQuery.Close()
 
-	var retID int64
-	err = rtnQuery.QueryRow(returnName).Scan(&retID)
+	s, err := openStore(opts)
 	if err != nil {
-		log.Printf("Couldn't find an existing return named '%s' so let's create it.\n", returnName)
+		return dm, 0, fmt.Errorf("cannot open database - %v", err)
 	}
+	defer s.Close()
 
-	if retID == 0 {
-		stmtReturn, err := db.Prepare("insert into return(name, date_created) values(?,?)")
-		if err != nil {
-			fmt.Errorf("cannot prepare a statement to create a new return - %v", err)
-		}
-		defer stmtReturn.Close()
-
-		res, err := stmtReturn.Exec(returnName, time.Now())
-		if err != nil {
-			err := fmt.Errorf("%v\nCannot create %s", err, returnName)
-			log.Println(err.Error())
-			os.Exit(1)
-		}
+	lines := make([]models.DatamapLine, 0, len(data))
+	for _, dml := range data {
+		lines = append(lines, models.DatamapLine{Key: dml.Key, Sheet: dml.Sheet, Cellref: dml.Cellref, Type: dml.Type})
+	}
 
-		retID, err = res.LastInsertId()
+	if opts.Owner != "" {
+		owner, err := s.GetUserByName(opts.Owner)
 		if err != nil {
-			fmt.Errorf("cannot get id of return - %v", err)
+			return dm, 0, fmt.Errorf("cannot find owner %s - %v", opts.Owner, err)
 		}
+		dm.OwnerID = owner.ID
 	}
 
-	// We're going to need a transaction for the big stuff
-	tx, err := db.Begin()
+	dm.ID, err = s.InsertDatamap(dm, lines)
+	if errors.Is(err, models.ErrDuplicateName) {
+		return dm, 0, fmt.Errorf("there is already a datamap named '%s' - import it under another name", dm.Name)
+	}
 	if err != nil {
-		fmt.Errorf("cannot start a database transaction - %v", err)
+		return dm, 0, err
 	}
+	if dm.Visibility == "" {
+		dm.Visibility = models.Public
+	}
+	return dm, len(lines), nil
+}
 
-	for sheetName, sheetData := range d {
-
-		for cellRef, cellData := range sheetData {
+// importXLSXtoDB imports file with ImportXLSX.
+func importXLSXtoDB(ctx context.Context, dmName string, returnName string, file importFile, s models.Store) (*ExtractionReport, error) {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-			dmlQuery, err := db.Prepare("select id from datamap_line where (sheet=? and cellref=?)")
-			if err != nil {
-				fmt.Errorf("cannot prepare a statement to get the datamap line - %v", err)
-			}
-			defer dmlQuery.Close()
-			dmlIDRow := dmlQuery.QueryRow(sheetName, cellRef)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ImportXLSX(ctx, dmName, returnName, file.name, f, info.Size(), s)
+}
 
-			var dmlID *int
+// ImportXLSX extracts data from the populated spreadsheet of size bytes read from r,
+// using the datamap named dmName, and stores it in s as part of the return
+// named returnName. The return is created if it does not already exist. filename is
+// the name under which the data is recorded in the return, replacing any
+// recorded under that name by an earlier import. The returned
+// ExtractionReport lists which cells were mapped, missing or could not be parsed.
+// Nothing is stored if ctx is cancelled before the data has been extracted.
+func ImportXLSX(ctx context.Context, dmName, returnName, filename string, r io.ReaderAt, size int64, s models.Store) (*ExtractionReport, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, report, err := extractDBDatamapReport(dmName, r, size, s)
+	if err != nil {
+		return nil, err
+	}
+	report.Filename = filename
 
-			if err := dmlIDRow.Scan(&dmlID); err != nil {
-				err := fmt.Errorf("cannot find a datamap_line row for %s and %s: %s", sheetName, cellRef, err)
-				log.Println(err.Error())
-			}
+	// Extraction is the slow part, so check again before storing anything.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-			insertStmt, err := db.Prepare("insert into return_data (dml_id, ret_id, filename, value, numfmt, vFormatted) values(?,?,?,?,?,?)")
-			if err != nil {
-				fmt.Errorf("cannot insert row into return_data - %v", err)
-			}
-			defer insertStmt.Close()
+	dm, err := s.GetDatamap(dmName)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := s.GetOrCreateReturn(returnName)
+	if err != nil {
+		return nil, err
+	}
 
-			// Hack to fix bug in Libreoffice numformats for dates
-			if cellData.NumFmt == "DD/MM/YY" {
-				cellData.SetFormat("dd/mm/yy")
-			}
-			fValue, err := cellData.FormattedValue()
-			if err != nil {
-				fmt.Errorf("cannot get the formatted value for %#v, %v", cellData, err)
-			}
+	data := make([]models.ReturnData, 0, len(report.Mapped))
+	mapped := report.Mapped[:0]
+	for _, c := range report.Mapped {
+		cellData := d[c.Sheet][c.Cellref]
 
-			_, err = insertStmt.Exec(dmlID, retID, filename, cellData.Value, cellData.NumFmt, fValue)
-			if err != nil {
-				fmt.Errorf("cannot execute statement to insert return data - %v", err)
-			}
+		// Hack to fix bug in Libreoffice numformats for dates
+		if cellData.NumFmt == "DD/MM/YY" {
+			cellData.SetFormat("dd/mm/yy")
+		}
+		fValue, err := cellData.FormattedValue()
+		if err != nil {
+			c.Error = err.Error()
+			report.Unparseable = append(report.Unparseable, c)
+			fValue = cellData.Value
+		} else {
+			mapped = append(mapped, c)
 		}
+
+		data = append(data, models.ReturnData{
+			DatamapLineID: c.lineID,
+			ReturnID:      ret.ID,
+			Filename:      filename,
+			Value:         cellData.Value,
+			NumFmt:        cellData.NumFmt,
+			Formatted:     fValue,
+		})
 	}
+	report.Mapped = mapped
 
-	err = tx.Commit()
-	if err != nil {
-		return err
+	if err := s.ReplaceReturnData(dm.ID, ret.ID, filename, data); err != nil {
+		return nil, err
 	}
-	return nil
+	return report, nil
 }
@@ -1,12 +1,18 @@
 package datamaps
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
 )
 
 var singleTarget string = "./testdata/test_template.xlsm"
@@ -73,6 +79,9 @@ func TestDatamapGoesIntoDB(t *testing.T) {
 	if err := DatamapToDB(&opts); err != nil {
 		t.Errorf("unable to write datamap to database file because %v", err)
 	}
+	if err := DatamapToDB(&opts); err == nil || !strings.Contains(err.Error(), "already a datamap named") {
+		t.Errorf("expected an error importing a second datamap of the same name, got %v", err)
+	}
 }
 
 // TestImportSimpleTemplate uses importXLSXtoDB() to import data from a
@@ -106,7 +115,7 @@ func TestImportSimpleTemplate(t *testing.T) {
 	if err := DatamapToDB(&opts); err != nil {
 		t.Fatalf("cannot open %s", opts.DMPath)
 	}
-	if err := importXLSXtoDB(opts.DMName, "TEST RETURN", singleTarget, db); err != nil {
+	if _, err := importXLSXtoDB(context.Background(), opts.DMName, "TEST RETURN", importFile{path: singleTarget, name: "test_template.xlsm"}, models.NewSQLiteStore(db)); err != nil {
 		t.Fatalf("Something wrong: %v", err)
 	}
 
@@ -129,6 +138,61 @@ func TestImportSimpleTemplate(t *testing.T) {
 	}
 }
 
+// TestImportXLSXReport uses ImportXLSX() to import a populated template
+// held in memory and checks the ExtractionReport it returns.
+func TestImportXLSXReport(t *testing.T) {
+	db, err := dbSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbTeardown(db)
+
+	if err := DatamapToDB(&opts); err != nil {
+		t.Fatalf("cannot open %s", opts.DMPath)
+	}
+
+	data, err := os.ReadFile(singleTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ImportXLSX(context.Background(), opts.DMName, "TEST RETURN", "uploaded.xlsm", bytes.NewReader(data), int64(len(data)), models.NewSQLiteStore(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Filename != "uploaded.xlsm" {
+		t.Errorf("expected filename uploaded.xlsm in report, got %s", report.Filename)
+	}
+	if len(report.Mapped) == 0 {
+		t.Error("expected mapped cells in report but there are none")
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM return_data WHERE filename='uploaded.xlsm'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(report.Mapped)+len(report.Unparseable) {
+		t.Errorf("expected %d rows in return_data, got %d", len(report.Mapped)+len(report.Unparseable), count)
+	}
+
+	if _, err := ImportXLSX(context.Background(), "No Such Datamap", "TEST RETURN", "uploaded.xlsm", bytes.NewReader(data), int64(len(data)), models.NewSQLiteStore(db)); err == nil {
+		t.Error("expected an error when importing with a datamap that does not exist")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ImportXLSX(ctx, opts.DMName, "TEST RETURN", "cancelled.xlsm", bytes.NewReader(data), int64(len(data)), models.NewSQLiteStore(db)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled importing with a cancelled context, got %v", err)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM return_data WHERE filename='cancelled.xlsm'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected nothing stored by a cancelled import, got %d rows", count)
+	}
+}
+
 // TestImportToDB uses ImportToDB() to import data from a
 // directory of populated templates and then uses the sqlite3 executible to test the
 // contents of the database. This does not test datamaps functionality
@@ -189,8 +253,12 @@ func TestImportToDB(t *testing.T) {
 	}
 	defer dbTeardown(db)
 
-	if err := ImportToDB(&opts); err != nil {
-		t.Fatal(err)
+	// Importing the files again replaces their values, rather than
+	// adding a second copy of each.
+	for range 2 {
+		if err := ImportToDB(context.Background(), io.Discard, &opts); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,213 @@
+package datamaps
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultInclude are the patterns of the files imported unless --include
+// gives others.
+var defaultInclude = []string{"*.xlsx", "*.xlsm"}
+
+// importFile is a populated spreadsheet found for import.
+type importFile struct {
+	// path is where the file is.
+	path string
+
+	// name is the name under which the file's data is recorded in the
+	// return: its path relative to the directory it was found in, so that
+	// files of the same name in different folders are told apart, or its
+	// base name if it was named directly.
+	name string
+}
+
+// fileFinder collects the files to import.
+type fileFinder struct {
+	include   []string
+	exclude   []string
+	recursive bool
+
+	seen  map[string]bool
+	names map[string]string
+	files []importFile
+}
+
+// findImportFiles returns the files to import with opts: those named by
+// opts.Files and the list in opts.FromList, or else those in
+// opts.XLSXPath. Directories are searched, recursively unless
+// opts.Recursive is false, for files matching opts.Include, or
+// defaultInclude, and not opts.Exclude, which files named directly must also
+// match. Excel's lock files are skipped. An error is returned if two
+// different files would be recorded under the same name.
+func findImportFiles(opts *Options) ([]importFile, error) {
+	f := &fileFinder{
+		include:   opts.Include,
+		exclude:   opts.Exclude,
+		recursive: opts.Recursive,
+		seen:      make(map[string]bool),
+		names:     make(map[string]string),
+	}
+	if len(f.include) == 0 {
+		f.include = defaultInclude
+	}
+
+	targets := slices.Clone(opts.Files)
+	if opts.FromList != "" {
+		list, err := readFileList(opts.FromList)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, list...)
+	}
+	if len(targets) == 0 {
+		targets = []string{opts.XLSXPath}
+	}
+
+	for _, target := range targets {
+		info, err := os.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			if err := f.walk(target); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name := filepath.Base(target)
+		if !f.wanted(name) {
+			continue
+		}
+		if err := f.add(target, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(f.files) == 0 {
+		return nil, fmt.Errorf("cannot find any files matching %s in %s", strings.Join(f.include, " or "), strings.Join(targets, ", "))
+	}
+	return f.files, nil
+}
+
+// walk adds the files in the directory root which match f's patterns.
+func (f *fileFinder) walk(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if !f.recursive || matchAny(f.exclude, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !f.wanted(rel) {
+			return nil
+		}
+		return f.add(path, rel)
+	})
+}
+
+// wanted reports whether the file at rel, a slash-separated path, is to be
+// imported: it is not a lock file, matches an include pattern and matches
+// no exclude pattern.
+func (f *fileFinder) wanted(rel string) bool {
+	name := rel[strings.LastIndex(rel, "/")+1:]
+	return !isLockFile(name) && matchAny(f.include, rel) && !matchAny(f.exclude, rel)
+}
+
+// add adds the file at path, recorded as name, unless it has already been
+// added. It returns an error if another file has been recorded as name.
+func (f *fileFinder) add(path, name string) error {
+	key := filepath.Clean(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		key = abs
+	}
+	if f.seen[key] {
+		return nil
+	}
+	if other, ok := f.names[name]; ok {
+		return fmt.Errorf("%s and %s would both be recorded as %q - import them separately or name their directory instead", other, path, name)
+	}
+	f.seen[key] = true
+	f.names[name] = path
+	f.files = append(f.files, importFile{path: path, name: name})
+	return nil
+}
+
+// matchAny reports whether any of patterns matches rel, a slash-separated
+// path. A pattern containing a slash is matched against the whole of rel and
+// any other against its last element.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		name := rel
+		if !strings.Contains(p, "/") {
+			name = rel[strings.LastIndex(rel, "/")+1:]
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isLockFile reports whether name is one of the files Excel creates beside
+// a spreadsheet while it is open, such as "~$return.xlsx".
+func isLockFile(name string) bool {
+	return strings.HasPrefix(name, "~$")
+}
+
+// checkPatterns returns an error naming flag if any of patterns is
+// malformed.
+func checkPatterns(flag string, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("%s: %q is not a valid pattern", flag, p)
+		}
+	}
+	return nil
+}
+
+// readFileList returns the paths listed, one to a line, in the file at
+// path, or on standard input if path is "-". Blank lines and lines
+// beginning with # are ignored.
+func readFileList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var paths []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read file list %s - %v", path, err)
+	}
+	return paths, nil
+}
@@ -0,0 +1,129 @@
+package datamaps
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFindImportFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"top.xlsx",
+		"notes.txt",
+		"defence/q1.xlsx",
+		"defence/~$q1.xlsx",
+		"defence/old/q4.xlsx",
+		"health/q1.xlsm",
+		"archive/q1.xlsx",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := filepath.Join(root, "list.txt")
+	contents := "# returns\n" + filepath.Join(root, "health") + "\n\n" + filepath.Join(root, "top.xlsx") + "\n"
+	if err := os.WriteFile(list, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "recursive",
+			opts: Options{XLSXPath: root, Recursive: true},
+			want: []string{"archive/q1.xlsx", "defence/old/q4.xlsx", "defence/q1.xlsx", "health/q1.xlsm", "top.xlsx"},
+		},
+		{
+			name: "one directory",
+			opts: Options{XLSXPath: root},
+			want: []string{"top.xlsx"},
+		},
+		{
+			name: "exclude",
+			opts: Options{XLSXPath: root, Recursive: true, Exclude: []string{"archive", "defence/old"}},
+			want: []string{"defence/q1.xlsx", "health/q1.xlsm", "top.xlsx"},
+		},
+		{
+			name: "include",
+			opts: Options{XLSXPath: root, Recursive: true, Include: []string{"q1.*"}, Exclude: []string{"*.xlsm"}},
+			want: []string{"archive/q1.xlsx", "defence/q1.xlsx"},
+		},
+		{
+			name: "files and directories",
+			opts: Options{XLSXPath: root, Recursive: true, Files: []string{filepath.Join(root, "defence"), filepath.Join(root, "notes.txt")}},
+			want: []string{"old/q4.xlsx", "q1.xlsx"},
+		},
+		{
+			name: "files filtered",
+			opts: Options{Files: []string{
+				filepath.Join(root, "top.xlsx"),
+				filepath.Join(root, "defence", "~$q1.xlsx"),
+				filepath.Join(root, "health", "q1.xlsm"),
+			}, Exclude: []string{"*.xlsm"}},
+			want: []string{"top.xlsx"},
+		},
+		{
+			name: "same file twice",
+			opts: Options{Files: []string{filepath.Join(root, "top.xlsx"), filepath.Join(root, ".", "top.xlsx")}},
+			want: []string{"top.xlsx"},
+		},
+		{
+			name:    "same name",
+			opts:    Options{Files: []string{filepath.Join(root, "defence", "q1.xlsx"), filepath.Join(root, "archive", "q1.xlsx")}},
+			wantErr: `would both be recorded as "q1.xlsx"`,
+		},
+		{
+			name:    "same path in two directories",
+			opts:    Options{Files: []string{filepath.Join(root, "defence"), filepath.Join(root, "archive")}},
+			wantErr: `would both be recorded as "q1.xlsx"`,
+		},
+		{
+			name: "from list",
+			opts: Options{XLSXPath: root, Recursive: true, Files: []string{filepath.Join(root, "top.xlsx")}, FromList: list},
+			want: []string{"top.xlsx", "q1.xlsm"},
+		},
+		{
+			name:    "no files",
+			opts:    Options{XLSXPath: root, Include: []string{"*.csv"}},
+			wantErr: "cannot find any files matching *.csv",
+		},
+		{
+			name:    "missing file",
+			opts:    Options{Files: []string{filepath.Join(root, "missing.xlsx")}},
+			wantErr: "no such file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := findImportFiles(&tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range files {
+				names = append(names, f.name)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package datamaps
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// Statuses of the doctor's checks.
+const (
+	statusOK    = "ok"
+	statusWarn  = "warn"
+	statusFail  = "FAIL"
+	statusFixed = "fixed"
+	statusSkip  = "skip"
+)
+
+// finding is the outcome of one of the doctor's checks.
+type finding struct {
+	status string
+	detail string
+
+	// hint tells the user how to put a warning or failure right.
+	hint string
+
+	// fix puts a warning or failure right, if that can be done without
+	// losing anything of value, and describes what it did.
+	fix func() (string, error)
+}
+
+// doctorCheck is one of the checks made by the doctor.
+type doctorCheck struct {
+	name string
+	run  func(d *doctor) finding
+}
+
+// doctorChecks are the doctor's checks, in the order they are made. Later
+// checks are skipped when the database cannot be opened or its schema is
+// out of date.
+var doctorChecks = []doctorCheck{
+	{"config directory", (*doctor).checkConfigDir},
+	{"config file", (*doctor).checkConfigFile},
+	{"database", (*doctor).checkDatabase},
+	{"schema", (*doctor).checkSchema},
+	{"orphaned return data", (*doctor).checkOrphans},
+	{"foreign keys", (*doctor).checkForeignKeys},
+	{"import directory", func(d *doctor) finding { return d.checkDir(d.opts.XLSXPath, "xlsx_path") }},
+	{"master output directory", func(d *doctor) finding { return d.checkDir(d.opts.MasterOutPutPath, "master_output_dir") }},
+}
+
+// doctor checks the installation described by opts.
+type doctor struct {
+	opts *Options
+
+	// store is the database, once it has been opened.
+	store models.Store
+
+	// schemaOK is true once the database's schema is known to be up to
+	// date.
+	schemaOK bool
+}
+
+// checkResult is the outcome of one of the doctor's checks, as reported.
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// Doctor checks that datamaps is ready to use with opts: that the config
+// directory and file, the database and the default directories exist, that
+// the database's schema is up to date and that its data is consistent. It
+// writes a line to w for each check, with a hint for each problem, or every
+// check as JSON if opts.Output is OutputJSON. If opts.Fix is set, the
+// problems which can be fixed safely are fixed. The error reports the number
+// of failures which remain.
+func Doctor(w io.Writer, opts *Options) error {
+	d := &doctor{opts: opts}
+	defer func() {
+		if d.store != nil {
+			d.store.Close()
+		}
+	}()
+
+	results := make([]checkResult, 0, len(doctorChecks))
+	var failures, warnings int
+	for _, c := range doctorChecks {
+		f := c.run(d)
+		if opts.Fix && f.fix != nil {
+			if done, err := f.fix(); err != nil {
+				f.detail = fmt.Sprintf("%s - cannot fix: %v", f.detail, err)
+			} else {
+				f = finding{status: statusFixed, detail: done}
+			}
+		}
+
+		r := checkResult{Name: c.name, Status: f.status, Detail: f.detail}
+		switch f.status {
+		case statusFail:
+			failures++
+			r.Hint = f.hint
+		case statusWarn:
+			warnings++
+			r.Hint = f.hint
+		}
+		results = append(results, r)
+	}
+
+	if opts.wantJSON() {
+		err := writeJSON(w, struct {
+			Checks   []checkResult `json:"checks"`
+			Failures int           `json:"failures"`
+			Warnings int           `json:"warnings"`
+		}{results, failures, warnings})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			fmt.Fprintf(w, "%-6s %s: %s\n", r.Status, r.Name, r.Detail)
+			if r.Hint != "" {
+				fmt.Fprintf(w, "%-6s %s\n", "", r.Hint)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	switch {
+	case failures > 0:
+		return fmt.Errorf("%d check(s) failed", failures)
+	case opts.wantJSON():
+		return nil
+	case warnings > 0:
+		_, err := fmt.Fprintf(w, "No problems, but %d warning(s).\n", warnings)
+		return err
+	}
+	_, err := fmt.Fprintln(w, "No problems found.")
+	return err
+}
+
+// SetUp creates the config directory, a configuration file listing the
+// default settings, the database at opts.DBPath, which is the profile's
+// database if opts.Profile is set, and the default directories, by running
+// the doctor's fixes. The doctor's report is written to w.
+func SetUp(w io.Writer, opts *Options) error {
+	if opts.Profile != "" && !opts.wantJSON() {
+		fmt.Fprintf(w, "Setting up profile %s.\n\n", opts.Profile)
+	}
+	fix := *opts
+	fix.Fix = true
+	return Doctor(w, &fix)
+}
+
+// checkConfigDir checks that the config directory, which holds the
+// default database, exists.
+func (d *doctor) checkConfigDir() finding {
+	dir, err := userConfigDir()
+	if err != nil {
+		return finding{status: statusFail, detail: err.Error(), hint: "set $XDG_CONFIG_HOME or $HOME"}
+	}
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return finding{
+			status: statusFail,
+			detail: dir + " does not exist",
+			hint:   `run "datamaps setup" or "datamaps doctor --fix" to create it`,
+			fix:    func() (string, error) { return "created " + dir, os.MkdirAll(dir, 0700) },
+		}
+	}
+	return finding{status: statusOK, detail: dir}
+}
+
+// checkConfigFile checks that the configuration file exists. It need not,
+// as the defaults are used without it, but it lists the settings which can
+// be changed.
+func (d *doctor) checkConfigFile() finding {
+	path := d.opts.ConfigPath
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return finding{
+			status: statusWarn,
+			detail: path + " does not exist, so the defaults are used",
+			hint:   `run "datamaps setup" or "datamaps doctor --fix" to create one listing every setting`,
+			fix: func() (string, error) {
+				defaults, err := defaultOptions()
+				if err != nil {
+					return "", err
+				}
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					return "", err
+				}
+				return "created " + path, writeConfigTemplate(path, defaults)
+			},
+		}
+	}
+	return finding{status: statusOK, detail: path}
+}
+
+// checkDatabase checks that the database can be opened, creating it if
+// it is a missing SQLite file and d.opts.Fix is set.
+func (d *doctor) checkDatabase() finding {
+	dsn := d.opts.DSN
+	if dsn == "" {
+		dsn = d.opts.DBPath
+	}
+	path, isSQLite := sqlitePath(dsn)
+	if !isSQLite {
+		s, err := models.Open(dsn)
+		if err != nil {
+			return finding{
+				status: statusFail,
+				detail: fmt.Sprintf("cannot connect to %s - %v", redactDSN(dsn), err),
+				hint:   "check the DSN and that PostgreSQL is running",
+			}
+		}
+		d.store = s
+		return finding{status: statusOK, detail: redactDSN(dsn)}
+	}
+
+	open := func() error {
+		s, err := models.Open(dsn)
+		if err != nil {
+			return err
+		}
+		d.store = s
+		return nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return finding{
+			status: statusFail,
+			detail: path + " does not exist",
+			hint:   `run "datamaps setup" or "datamaps doctor --fix" to create it`,
+			fix: func() (string, error) {
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					return "", err
+				}
+				return "created " + path, open()
+			},
+		}
+	}
+	if err := open(); err != nil {
+		return finding{status: statusFail, detail: fmt.Sprintf("cannot open %s - %v", path, err)}
+	}
+	return finding{status: statusOK, detail: path}
+}
+
+// sqlitePath returns the path of the SQLite file named by dsn, and false
+// if dsn names a PostgreSQL database.
+func sqlitePath(dsn string) (string, bool) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "", false
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "sqlite://"), "?")
+	return path, true
+}
+
+// checkSchema checks that every migration has been applied.
+func (d *doctor) checkSchema() finding {
+	if d.store == nil {
+		return finding{status: statusSkip, detail: "no database"}
+	}
+	err := models.CheckSchema(d.store)
+	switch {
+	case errors.Is(err, models.ErrSchemaOutdated):
+		return finding{
+			status: statusFail,
+			detail: strings.TrimPrefix(err.Error(), "models: "),
+			hint:   `run "datamaps migrate up" or "datamaps doctor --fix" to update it, keeping its data`,
+			fix: func() (string, error) {
+				applied, err := d.store.MigrateUp()
+				if err != nil {
+					return "", err
+				}
+				d.schemaOK = true
+				return fmt.Sprintf("applied %d migration(s)", len(applied)), nil
+			},
+		}
+	case errors.Is(err, models.ErrSchemaTooNew):
+		return finding{
+			status: statusFail,
+			detail: strings.TrimPrefix(err.Error(), "models: "),
+			hint:   "upgrade datamaps",
+		}
+	case err != nil:
+		return finding{status: statusFail, detail: fmt.Sprintf("cannot read the schema - %v", err)}
+	}
+
+	version, err := d.store.SchemaVersion()
+	if err != nil {
+		return finding{status: statusFail, detail: fmt.Sprintf("cannot read the schema - %v", err)}
+	}
+	d.schemaOK = true
+	return finding{status: statusOK, detail: fmt.Sprintf("version %d, up to date", version)}
+}
+
+// skipped is the finding of a check of the database's data which cannot
+// be made.
+func (d *doctor) skipped() finding {
+	if d.store == nil {
+		return finding{status: statusSkip, detail: "no database"}
+	}
+	return finding{status: statusSkip, detail: "schema is not up to date"}
+}
+
+// checkOrphans checks for return data whose datamap line or return has
+// been deleted. Such rows can never be read, so fixing them deletes them.
+func (d *doctor) checkOrphans() finding {
+	if !d.schemaOK {
+		return d.skipped()
+	}
+	n, err := d.store.OrphanedReturnData()
+	if err != nil {
+		return finding{status: statusFail, detail: err.Error()}
+	}
+	if n == 0 {
+		return finding{status: statusOK, detail: "none"}
+	}
+	return finding{
+		status: statusFail,
+		detail: fmt.Sprintf("%d row(s) belong to a missing datamap line or return", n),
+		hint:   `the rows can never be read - run "datamaps doctor --fix" to delete them`,
+		fix: func() (string, error) {
+			deleted, err := d.store.DeleteOrphanedReturnData()
+			return fmt.Sprintf("deleted %d row(s)", deleted), err
+		},
+	}
+}
+
+// checkForeignKeys checks that no row refers to a row which does not
+// exist. Those in return_data are found, and fixed, by checkOrphans. It
+// only applies to SQLite, as PostgreSQL always enforces foreign keys.
+func (d *doctor) checkForeignKeys() finding {
+	if !d.schemaOK {
+		return d.skipped()
+	}
+	if _, ok := d.store.(*models.PostgresStore); ok {
+		return finding{status: statusSkip, detail: "not applicable, PostgreSQL checks references as rows are written"}
+	}
+	violations, err := d.store.ForeignKeyViolations()
+	if err != nil {
+		return finding{status: statusFail, detail: err.Error()}
+	}
+	if len(violations) == 0 {
+		return finding{status: statusOK, detail: "no broken references"}
+	}
+
+	counts := make(map[string]int)
+	var tables []string
+	for _, v := range violations {
+		if counts[v.Table] == 0 {
+			tables = append(tables, v.Table)
+		}
+		counts[v.Table]++
+	}
+	parts := make([]string, 0, len(tables))
+	for _, t := range tables {
+		parts = append(parts, fmt.Sprintf("%d in %s", counts[t], t))
+	}
+	return finding{
+		status: statusFail,
+		detail: fmt.Sprintf("%d row(s) refer to missing rows: %s", len(violations), strings.Join(parts, ", ")),
+		hint:   `list them with the query "PRAGMA foreign_key_check" and repair or delete them by hand`,
+	}
+}
+
+// checkDir checks that dir, the value of the setting with key, is an
+// existing directory.
+func (d *doctor) checkDir(dir, key string) finding {
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return finding{
+			status: statusWarn,
+			detail: dir + " does not exist",
+			hint:   fmt.Sprintf(`run "datamaps doctor --fix" to create it, or change %s (%s)`, key, d.opts.Source(key)),
+			fix:    func() (string, error) { return "created " + dir, os.MkdirAll(dir, 0700) },
+		}
+	case err != nil:
+		return finding{status: statusFail, detail: err.Error()}
+	case !info.IsDir():
+		return finding{
+			status: statusFail,
+			detail: dir + " is not a directory",
+			hint:   fmt.Sprintf("change %s (%s)", key, d.opts.Source(key)),
+		}
+	}
+	return finding{status: statusOK, detail: dir}
+}
@@ -0,0 +1,174 @@
+package datamaps
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// doctorOptions returns the Options for running the doctor in a new home
+// directory, in which nothing has been set up.
+func doctorOptions(t *testing.T, args ...string) *Options {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("DATAMAPS_CONFIG", "")
+	t.Setenv("DATAMAPS_PROFILE", "")
+	t.Setenv("DATAMAPS_DSN", "")
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+
+	opts, err := ParseArgs(append([]string{"doctor"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// statuses returns the status of each check in the doctor's report, by
+// check name.
+func statuses(report string) map[string]string {
+	found := make(map[string]string)
+	for _, line := range strings.Split(report, "\n") {
+		status, rest, _ := strings.Cut(line, " ")
+		switch status {
+		case statusOK, statusWarn, statusFail, statusFixed, statusSkip:
+		default:
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimSpace(rest), ":")
+		found[name] = status
+	}
+	return found
+}
+
+func TestDoctor(t *testing.T) {
+	opts := doctorOptions(t)
+
+	buf := new(bytes.Buffer)
+	if err := Doctor(buf, opts); err == nil {
+		t.Fatalf("expected the doctor to fail before setup, got\n%s", buf)
+	}
+	want := map[string]string{
+		"config directory":        statusFail,
+		"config file":             statusWarn,
+		"database":                statusFail,
+		"schema":                  statusSkip,
+		"orphaned return data":    statusSkip,
+		"foreign keys":            statusSkip,
+		"import directory":        statusWarn,
+		"master output directory": statusWarn,
+	}
+	got := statuses(buf.String())
+	for name, status := range want {
+		if got[name] != status {
+			t.Errorf("expected %s to be %q, got %q in\n%s", name, status, got[name], buf)
+		}
+	}
+	if !strings.Contains(buf.String(), `run "datamaps setup" or "datamaps doctor --fix" to create it`) {
+		t.Errorf("expected a hint in\n%s", buf)
+	}
+	if _, err := os.Stat(opts.DBPath); err == nil {
+		t.Error("expected the doctor not to create the database without --fix")
+	}
+
+	buf.Reset()
+	opts.Fix = true
+	if err := Doctor(buf, opts); err != nil {
+		t.Fatalf("expected --fix to fix every problem, got %v in\n%s", err, buf)
+	}
+	got = statuses(buf.String())
+	for name, status := range want {
+		if status != statusSkip && got[name] != statusFixed {
+			t.Errorf("expected %s to be fixed, got %q in\n%s", name, got[name], buf)
+		}
+	}
+
+	buf.Reset()
+	opts.Fix = false
+	if err := Doctor(buf, opts); err != nil {
+		t.Fatalf("expected the doctor to pass after fixing, got %v in\n%s", err, buf)
+	}
+	if !strings.HasSuffix(buf.String(), "No problems found.\n") {
+		t.Errorf("expected no problems, got\n%s", buf)
+	}
+}
+
+func TestDoctorOrphans(t *testing.T) {
+	opts := doctorOptions(t)
+	if err := SetUp(new(bytes.Buffer), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write return data for a missing return without foreign keys turned
+	// on, as older versions of datamaps did.
+	db, err := sql.Open("sqlite3", opts.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := models.NewSQLiteStore(db)
+	if _, err := s.InsertDatamap(models.Datamap{Name: "DM"}, []models.DatamapLine{{Key: "K", Sheet: "S", Cellref: "A1"}}); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := s.DatamapLines("DM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertReturnData([]models.ReturnData{{DatamapLineID: lines[0].ID, ReturnID: 99, Value: "V"}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	buf := new(bytes.Buffer)
+	if err := Doctor(buf, opts); err == nil {
+		t.Fatalf("expected the doctor to find the orphaned row, got\n%s", buf)
+	}
+	got := statuses(buf.String())
+	if got["orphaned return data"] != statusFail || got["foreign keys"] != statusFail {
+		t.Errorf("expected the orphaned row to fail two checks, got\n%s", buf)
+	}
+
+	buf.Reset()
+	opts.Fix = true
+	if err := Doctor(buf, opts); err != nil {
+		t.Fatalf("expected --fix to delete the orphaned row, got %v in\n%s", err, buf)
+	}
+	got = statuses(buf.String())
+	if got["orphaned return data"] != statusFixed || got["foreign keys"] != statusOK {
+		t.Errorf("expected the orphaned row to be deleted, got\n%s", buf)
+	}
+}
+
+func TestDoctorJSON(t *testing.T) {
+	opts := doctorOptions(t, "--output", "json")
+
+	buf := new(bytes.Buffer)
+	if err := Doctor(buf, opts); err == nil {
+		t.Fatalf("expected the doctor to fail before setup, got\n%s", buf)
+	}
+	var got struct {
+		Checks   []checkResult `json:"checks"`
+		Failures int           `json:"failures"`
+		Warnings int           `json:"warnings"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("cannot decode %s: %v", buf, err)
+	}
+	if len(got.Checks) != len(doctorChecks) || got.Failures != 2 || got.Warnings != 3 {
+		t.Errorf("unexpected report %s", buf)
+	}
+	for _, c := range got.Checks {
+		if c.Name == "database" && (c.Status != statusFail || c.Hint == "") {
+			t.Errorf("expected the database to fail with a hint, got %+v", c)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package datamaps
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"github.com/tealeg/xlsx/v3"
+)
+
+// Outcomes of a datamap line in a file checked by DryRunImport.
+const (
+	outcomeFound        = "found"
+	outcomeBlank        = "blank"
+	outcomeNoSuchCell   = "cell not found"
+	outcomeSheetMissing = "sheet missing"
+	outcomeWrongType    = "wrong type"
+	outcomeUnreadable   = "unreadable"
+)
+
+// outcomes are the outcomes counted for each file, in the order they are
+// reported.
+var outcomes = []string{outcomeFound, outcomeBlank, outcomeNoSuchCell, outcomeSheetMissing, outcomeWrongType}
+
+// lineOutcome is what a dry run found for a datamap line in a file.
+type lineOutcome struct {
+	CellReport
+	Type    string
+	Outcome string
+}
+
+// fileOutcome is what a dry run found in a file.
+type fileOutcome struct {
+	name  string
+	lines []lineOutcome
+
+	// err is the reason the file could not be read, if it could not.
+	err error
+}
+
+// count returns the number of f's lines with outcome.
+func (f fileOutcome) count(outcome string) int {
+	n := 0
+	for _, l := range f.lines {
+		if l.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// DryRunImport extracts the files chosen by opts with the datamap named by
+// opts.DMName, as ImportToDB does, but stores nothing. For each file it
+// writes to w the number of the datamap's keys which were found, left blank,
+// refer to cells which cannot exist or to missing sheets, or hold values
+// which are not of the key's type, and then lists every problem. If
+// opts.Report is set, a CSV report of every key in every file is written to
+// that file, or to w in place of the summary if it is "-". If opts.Output is
+// OutputJSON, the counts and every key of every file are written to w as
+// JSON instead of the summary.
+func DryRunImport(ctx context.Context, w io.Writer, opts *Options) error {
+	target, err := findImportFiles(opts)
+	if err != nil {
+		return err
+	}
+
+	s, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Fail now, rather than reporting every file unreadable, if there is
+	// no datamap to check them with.
+	if err := checkDatamap(s, opts.DMName); err != nil {
+		return err
+	}
+
+	results := make([]fileOutcome, 0, len(target))
+	for _, file := range target {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		results = append(results, dryRunFile(opts.DMName, file, s))
+	}
+
+	if opts.Report == "-" {
+		return writeDryRunCSV(w, results)
+	}
+	if opts.Report != "" {
+		f, err := os.Create(opts.Report)
+		if err != nil {
+			return err
+		}
+		if err := writeDryRunCSV(f, results); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if opts.wantJSON() {
+		return writeDryRunJSON(w, results)
+	}
+	return writeDryRunSummary(w, results)
+}
+
+// dryRunFile extracts file with the datamap named dmName in s and works out
+// the outcome of each of the datamap's lines.
+func dryRunFile(dmName string, file importFile, s models.Store) fileOutcome {
+	result := fileOutcome{name: file.name}
+
+	f, err := os.Open(file.path)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	data, report, err := extractDBDatamapReport(dmName, f, info.Size(), s)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	for _, c := range report.Mapped {
+		l := lineOutcome{CellReport: c, Type: c.lineType, Outcome: outcomeFound}
+		cell := data[c.Sheet][c.Cellref]
+		if strings.TrimSpace(cell.Value) == "" {
+			l.Outcome = outcomeBlank
+		} else if err := checkType(c.lineType, &cell); err != nil {
+			l.Outcome, l.Error = outcomeWrongType, err.Error()
+		}
+		result.lines = append(result.lines, l)
+	}
+	for _, c := range report.Missing {
+		l := lineOutcome{CellReport: c, Type: c.lineType}
+		switch c.Error {
+		case errSheetNotFound:
+			l.Outcome = outcomeSheetMissing
+		case errNoSuchCell:
+			l.Outcome = outcomeNoSuchCell
+		default:
+			l.Outcome = outcomeBlank
+		}
+		l.Error = ""
+		result.lines = append(result.lines, l)
+	}
+
+	// Report the lines in the order of the datamap.
+	slices.SortFunc(result.lines, func(a, b lineOutcome) int { return cmp.Compare(a.lineID, b.lineID) })
+	return result
+}
+
+// checkType returns an error if cell does not hold a value of typ, which
+// is one of models.LineTypes or empty for any value.
+func checkType(typ string, cell *xlsx.Cell) error {
+	switch typ {
+	case models.TypeNumber:
+		if _, err := strconv.ParseFloat(strings.TrimSpace(cell.Value), 64); err != nil {
+			return fmt.Errorf("%q is not a number", cell.Value)
+		}
+	case models.TypeDate:
+		if _, err := strconv.ParseFloat(cell.Value, 64); err != nil || !cell.IsTime() {
+			return fmt.Errorf("%q is not a date", cell.Value)
+		}
+	}
+	return nil
+}
+
+// writeDryRunSummary writes the number of keys with each outcome in each
+// file to w, followed by the problems found.
+func writeDryRunSummary(w io.Writer, results []fileOutcome) error {
+	fmt.Fprint(w, "Dry run - nothing has been stored.\n\n")
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\t%s\n", strings.ToUpper(strings.Join(outcomes, "\t")))
+	totals := make([]int, len(outcomes))
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(tw, "%s\t%s: %v\n", r.name, outcomeUnreadable, r.err)
+			continue
+		}
+		counts := make([]string, len(outcomes))
+		for i, o := range outcomes {
+			n := r.count(o)
+			totals[i] += n
+			counts[i] = strconv.Itoa(n)
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", r.name, strings.Join(counts, "\t"))
+	}
+	if len(results) > 1 {
+		counts := make([]string, len(totals))
+		for i, n := range totals {
+			counts[i] = strconv.Itoa(n)
+		}
+		fmt.Fprintf(tw, "TOTAL\t%s\n", strings.Join(counts, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, r := range results {
+		reported := make(map[string]bool)
+		for _, l := range r.lines {
+			switch l.Outcome {
+			case outcomeFound:
+				continue
+			case outcomeSheetMissing:
+				// One line for the sheet rather than one for each of
+				// its keys.
+				if reported[l.Sheet] {
+					continue
+				}
+				reported[l.Sheet] = true
+				problems = append(problems, fmt.Sprintf("%s\t%s\t\t%s", r.name, l.Sheet, l.Outcome))
+			default:
+				problem := l.Outcome
+				if l.Error != "" {
+					problem += ": " + l.Error
+				}
+				problems = append(problems, fmt.Sprintf("%s\t%s!%s\t%s\t%s", r.name, l.Sheet, l.Cellref, l.Key, problem))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		_, err := fmt.Fprint(w, "\nNo problems found.\n")
+		return err
+	}
+
+	fmt.Fprint(w, "\nProblems:\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tCELL\tKEY\tPROBLEM")
+	for _, p := range problems {
+		fmt.Fprintln(tw, p)
+	}
+	return tw.Flush()
+}
+
+// writeDryRunCSV writes a row to w for every datamap line in every file,
+// and for every file which could not be read.
+func writeDryRunCSV(w io.Writer, results []fileOutcome) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"file", "key", "sheet", "cellref", "type", "outcome", "value", "detail"})
+	for _, r := range results {
+		if r.err != nil {
+			cw.Write([]string{r.name, "", "", "", "", outcomeUnreadable, "", r.err.Error()})
+			continue
+		}
+		for _, l := range r.lines {
+			cw.Write([]string{r.name, l.Key, l.Sheet, l.Cellref, l.Type, l.Outcome, l.Value, l.Error})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// dryRunKey is the outcome of a datamap line in a file, as written by
+// writeDryRunJSON.
+type dryRunKey struct {
+	Key     string `json:"key"`
+	Sheet   string `json:"sheet"`
+	Cellref string `json:"cellref"`
+	Type    string `json:"type"`
+	Outcome string `json:"outcome"`
+	Value   string `json:"value"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// dryRunFileJSON is the outcome of a file, as written by writeDryRunJSON.
+type dryRunFileJSON struct {
+	Name   string         `json:"name"`
+	Error  string         `json:"error,omitempty"`
+	Counts map[string]int `json:"counts"`
+	Keys   []dryRunKey    `json:"keys"`
+}
+
+// writeDryRunJSON writes the number of keys with each outcome in each file,
+// and every key, to w as JSON.
+func writeDryRunJSON(w io.Writer, results []fileOutcome) error {
+	files := make([]dryRunFileJSON, 0, len(results))
+	totals := make(map[string]int, len(outcomes))
+	for _, o := range outcomes {
+		totals[o] = 0
+	}
+	for _, r := range results {
+		f := dryRunFileJSON{Name: r.name, Counts: make(map[string]int, len(outcomes)), Keys: []dryRunKey{}}
+		if r.err != nil {
+			f.Error = r.err.Error()
+		}
+		for _, o := range outcomes {
+			n := r.count(o)
+			f.Counts[o] = n
+			totals[o] += n
+		}
+		for _, l := range r.lines {
+			f.Keys = append(f.Keys, dryRunKey{l.Key, l.Sheet, l.Cellref, l.Type, l.Outcome, l.Value, l.Error})
+		}
+		files = append(files, f)
+	}
+	return writeJSON(w, struct {
+		DryRun bool             `json:"dry_run"`
+		Files  []dryRunFileJSON `json:"files"`
+		Totals map[string]int   `json:"totals"`
+	}{true, files, totals})
+}
@@ -0,0 +1,103 @@
+package datamaps
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+func TestDryRunImport(t *testing.T) {
+	o := newTestDB(t, "Typed Datamap", `cell_key,template_sheet,cell_reference,type
+A Date,Summary,B2,DATE
+A String,Summary,B3,NUMBER
+A Float,Summary,B4,number
+Nothing Here,Summary,Z99,TEXT
+Bad Cell,Summary,B0,
+Ghost One,Nowhere,A1,TEXT
+Ghost Two,Nowhere,A2,TEXT
+`)
+	o.Files = []string{"./testdata/test_template.xlsx"}
+	o.DryRun = true
+	o.Report = filepath.Join(t.TempDir(), "report.csv")
+
+	buf := new(bytes.Buffer)
+	if err := DryRunImport(context.Background(), buf, o); err != nil {
+		t.Fatal(err)
+	}
+	// Compare the report's lines without the padding of their columns.
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	out := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"Dry run - nothing has been stored.",
+		"test_template.xlsx 2 1 1 2 1",
+		`test_template.xlsx Summary!B3 A String wrong type: "This is a string" is not a number`,
+		"test_template.xlsx Summary!Z99 Nothing Here blank",
+		"test_template.xlsx Summary!B0 Bad Cell cell not found",
+		"test_template.xlsx Nowhere sheet missing",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "sheet missing") != 1 {
+		t.Errorf("expected the missing sheet to be reported once in\n%s", out)
+	}
+
+	f, err := os.Open(o.Report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"file", "key", "sheet", "cellref", "type", "outcome", "value", "detail"},
+		{"test_template.xlsx", "A Date", "Summary", "B2", "DATE", "found"},
+		{"test_template.xlsx", "A String", "Summary", "B3", "NUMBER", "wrong type"},
+		{"test_template.xlsx", "A Float", "Summary", "B4", "NUMBER", "found"},
+		{"test_template.xlsx", "Nothing Here", "Summary", "Z99", "TEXT", "blank"},
+		{"test_template.xlsx", "Bad Cell", "Summary", "B0", "", "cell not found"},
+		{"test_template.xlsx", "Ghost One", "Nowhere", "A1", "TEXT", "sheet missing"},
+		{"test_template.xlsx", "Ghost Two", "Nowhere", "A2", "TEXT", "sheet missing"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows in the report, got %v", len(want), rows)
+	}
+	for i, w := range want {
+		for j, v := range w {
+			if rows[i][j] != v {
+				t.Errorf("expected row %d column %d to be %q, got %q", i, j, v, rows[i][j])
+			}
+		}
+	}
+
+	s, err := models.Open(o.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.GetReturn(o.ReturnName); err == nil {
+		t.Error("expected a dry run not to create the return")
+	}
+}
+
+func TestReadDMLTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datamap.csv")
+	if err := os.WriteFile(path, []byte("cell_key,template_sheet,cell_reference,type\nK,S,A1,MONEY\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDML(path); err == nil || !strings.Contains(err.Error(), `unknown type "MONEY" for key K`) {
+		t.Errorf("expected an unknown type error, got %v", err)
+	}
+}
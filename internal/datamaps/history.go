@@ -0,0 +1,94 @@
+package datamaps
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// Formats in which a key history can be written by WriteKeyHistory.
+const (
+	HistoryCSV  = "csv"
+	HistoryJSON = "json"
+)
+
+// historyRow is a single value in a key history, as written by WriteKeyHistory.
+type historyRow struct {
+	Return        string    `json:"return"`
+	ReturnCreated time.Time `json:"return_created"`
+	Datamap       string    `json:"datamap"`
+	Filename      string    `json:"filename"`
+	Value         string    `json:"value"`
+	Formatted     string    `json:"formatted"`
+}
+
+// WriteKeyHistory writes the values of key, as returned by
+// models.Store.KeyHistory along with the cursor of the next page, to w in
+// the given format. The cursor is only written in JSON.
+func WriteKeyHistory(w io.Writer, key string, values []models.KeyValue, next, format string) error {
+	rows := make([]historyRow, 0, len(values))
+	for _, kv := range values {
+		rows = append(rows, historyRow{
+			Return:        kv.Return.Name,
+			ReturnCreated: kv.Return.Created,
+			Datamap:       kv.Datamap.Name,
+			Filename:      kv.Filename,
+			Value:         kv.Value,
+			Formatted:     kv.Formatted,
+		})
+	}
+
+	switch format {
+	case HistoryCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"return", "return_created", "datamap", "filename", "value", "formatted"})
+		for _, r := range rows {
+			cw.Write([]string{r.Return, r.ReturnCreated.UTC().Format(time.RFC3339), r.Datamap, r.Filename, r.Value, r.Formatted})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("cannot write history as CSV: %v", err)
+		}
+		return nil
+	case HistoryJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(struct {
+			Key        string       `json:"key"`
+			Values     []historyRow `json:"values"`
+			NextCursor string       `json:"next_cursor"`
+		}{key, rows, next})
+	default:
+		return fmt.Errorf("%q is not a supported history format", format)
+	}
+}
+
+// KeyHistory writes every value stored for the key given by --key to w,
+// oldest return first, restricted to the file given by --file if there is
+// one. It is written as JSON if opts.Output is OutputJSON, whatever
+// opts.Format says.
+func KeyHistory(w io.Writer, opts *Options) error {
+	if opts.Key == "" {
+		return fmt.Errorf("a key must be given with --key")
+	}
+
+	s, err := openStore(opts)
+	if err != nil {
+		return fmt.Errorf("cannot open database - %v", err)
+	}
+	defer s.Close()
+
+	values, _, err := s.KeyHistory(opts.Key, opts.Filename, models.ListOptions{})
+	if err != nil {
+		return err
+	}
+	format := opts.Format
+	if opts.wantJSON() {
+		format = HistoryJSON
+	}
+	return WriteKeyHistory(w, opts.Key, values, "", format)
+}
@@ -0,0 +1,51 @@
+package datamaps
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+func TestWriteKeyHistory(t *testing.T) {
+	created := time.Date(2020, 4, 1, 9, 0, 0, 0, time.UTC)
+	values := []models.KeyValue{
+		{Return: models.Return{Name: "Q1", Created: created}, Datamap: models.Datamap{Name: "DM"}, Filename: "a.xlsx", Value: "1.5", Formatted: "1.50"},
+		{Return: models.Return{Name: "Q2", Created: created.AddDate(0, 3, 0)}, Datamap: models.Datamap{Name: "DM"}, Filename: "a.xlsx", Value: "2", Formatted: "2.00"},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteKeyHistory(buf, "Total RDEL", values, "", HistoryCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[1][0] != "Q1" || rows[1][1] != "2020-04-01T09:00:00Z" || rows[2][5] != "2.00" {
+		t.Errorf("unexpected CSV history %v", rows)
+	}
+
+	buf.Reset()
+	if err := WriteKeyHistory(buf, "Total RDEL", values, "", HistoryJSON); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Key        string
+		Values     []historyRow
+		NextCursor string `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != "Total RDEL" || len(got.Values) != 2 || got.Values[1].Return != "Q2" {
+		t.Errorf("unexpected JSON history %+v", got)
+	}
+
+	if err := WriteKeyHistory(buf, "Total RDEL", values, "", "xml"); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,47 @@
+package datamaps
+
+import (
+	"io"
+	"log/slog"
+)
+
+// Levels of the logs written, chosen with --log-level.
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+)
+
+// Formats of the logs written, chosen with --log-format.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// logLevels are the slog levels of the log levels, by name.
+var logLevels = map[string]slog.Level{
+	LogDebug: slog.LevelDebug,
+	LogInfo:  slog.LevelInfo,
+	LogWarn:  slog.LevelWarn,
+	LogError: slog.LevelError,
+}
+
+// NewLogger returns a logger writing the logs at or above opts.LogLevel to
+// w, as text or as a JSON object on each line according to opts.LogFormat.
+func NewLogger(w io.Writer, opts *Options) *slog.Logger {
+	ho := &slog.HandlerOptions{Level: logLevels[opts.LogLevel]}
+	if opts.LogFormat == LogJSON {
+		return slog.New(slog.NewJSONHandler(w, ho))
+	}
+	return slog.New(slog.NewTextHandler(w, ho))
+}
+
+// logger returns the logger to which the package's entry points log: the
+// one set in o.Logger, or slog's default if there is none.
+func (o *Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,67 @@
+package datamaps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := NewLogger(buf, &Options{LogLevel: LogWarn, LogFormat: LogText})
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "Total RDEL")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, `level=WARN msg=shown key="Total RDEL"`) {
+		t.Errorf("expected only the warning, got %q", out)
+	}
+
+	buf.Reset()
+	logger = NewLogger(buf, &Options{LogLevel: LogDebug, LogFormat: LogJSON})
+	logger.Debug("shown", "file", "a.xlsx")
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected a JSON log, got %q - %v", buf.String(), err)
+	}
+	if got["level"] != "DEBUG" || got["msg"] != "shown" || got["file"] != "a.xlsx" {
+		t.Errorf("unexpected JSON log %v", got)
+	}
+}
+
+func TestImportWarningLogs(t *testing.T) {
+	o := importSummaryOptions(t)
+	logs := new(bytes.Buffer)
+	o.Logger = NewLogger(logs, &Options{LogLevel: LogInfo, LogFormat: LogJSON})
+	o.LogFormat = LogJSON
+
+	if err := ImportToDB(context.Background(), new(bytes.Buffer), o); err == nil {
+		t.Fatal("expected the broken file to fail")
+	}
+
+	var warnings, failures int
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var l map[string]any
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatalf("expected a JSON log, got %q - %v", line, err)
+		}
+		switch l["level"] {
+		case "WARN":
+			warnings++
+			if l["file"] == nil || l["sheet"] == nil {
+				t.Errorf("expected the file and sheet in %v", l)
+			}
+			if l["msg"] == warnNoSuchSheet && (l["sheet"] != "Nowhere" || l["keys"] != 2.0) {
+				t.Errorf("unexpected missing sheet warning %v", l)
+			}
+		case "ERROR":
+			failures++
+			if l["msg"] != "cannot import file" || l["file"] != "broken.xlsx" {
+				t.Errorf("unexpected failure %v", l)
+			}
+		}
+	}
+	if warnings != 2 || failures != 1 {
+		t.Errorf("expected 2 warnings and 1 failure, got %d and %d in\n%s", warnings, failures, logs.String())
+	}
+}
@@ -0,0 +1,36 @@
+package datamaps
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Forms of a command's output, chosen with --output.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// wantJSON reports whether the command's output should be a JSON document.
+func (o *Options) wantJSON() bool {
+	return o.Output == OutputJSON
+}
+
+// writeJSON writes v to w as the JSON document which is a command's output
+// with --output json.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	// The document is read by scripts, not browsers, so sheet names such
+	// as "DCA & Risk" are left as they are.
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// WriteJSONError writes err to w as a JSON document, for a command which
+// fails with --output json before writing a document of its own.
+func WriteJSONError(w io.Writer, err error) error {
+	return writeJSON(w, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
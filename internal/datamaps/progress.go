@@ -0,0 +1,163 @@
+package datamaps
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progress follows an import through its files.
+type progress interface {
+	// start is called before the first of total files is imported.
+	start(total int)
+
+	// file is called before the file called name is imported.
+	file(name string)
+
+	// done is called once f has been imported, or has failed.
+	done(f ImportedFile)
+
+	// finish is called once the import has stopped.
+	finish()
+}
+
+// newProgress returns the progress shown on w for opts: nothing if it is
+// quiet or its summary is JSON, a line redrawn as each file is imported if
+// w is a terminal and the logs are text, or else logs of each file and its
+// warnings.
+func newProgress(w io.Writer, opts *Options) progress {
+	switch {
+	case opts.Quiet || opts.wantJSON():
+		return noProgress{}
+	case isTerminal(w) && opts.LogFormat != LogJSON:
+		return &termProgress{w: w, tick: time.Second}
+	}
+	return logProgress{opts.logger()}
+}
+
+// isTerminal reports whether w is a terminal. w may wrap a file, such as
+// standard output, if it has the file's Fd method.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(interface{ Fd() uintptr })
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// noProgress shows nothing.
+type noProgress struct{}
+
+func (noProgress) start(int)         {}
+func (noProgress) file(string)       {}
+func (noProgress) done(ImportedFile) {}
+func (noProgress) finish()           {}
+
+// logProgress logs each file, for when the output is not a terminal. Each
+// warning is logged with the file, sheet, cell and key it concerns.
+type logProgress struct {
+	log *slog.Logger
+}
+
+func (p logProgress) start(total int) {
+	p.log.Info("importing files", "files", total)
+}
+
+func (p logProgress) file(name string) {
+	p.log.Info("extracting", "file", name)
+}
+
+func (p logProgress) done(f ImportedFile) {
+	for _, w := range f.warnings {
+		p.log.Warn(w.kind, append([]any{"file", f.Name}, w.attrs()...)...)
+	}
+	if f.Error != "" {
+		p.log.Error("cannot import file", "file", f.Name, "error", f.Error)
+	}
+}
+
+func (logProgress) finish() {}
+
+// termProgress redraws a single line on a terminal showing how many files
+// have been imported, the file being imported, the time taken and an
+// estimate of the time left. The line is redrawn every tick while a file
+// is imported, so that the time keeps moving.
+type termProgress struct {
+	w    io.Writer
+	tick time.Duration
+
+	mu       sync.Mutex
+	total    int
+	finished int
+	current  string
+	began    time.Time
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func (p *termProgress) start(total int) {
+	p.mu.Lock()
+	p.total, p.began = total, time.Now()
+	p.stop, p.stopped = make(chan struct{}), make(chan struct{})
+	p.mu.Unlock()
+
+	go func() {
+		defer close(p.stopped)
+		t := time.NewTicker(p.tick)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.mu.Lock()
+				p.draw()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *termProgress) file(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = name
+	p.draw()
+}
+
+func (p *termProgress) done(ImportedFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finished++
+	p.draw()
+}
+
+func (p *termProgress) finish() {
+	close(p.stop)
+	<-p.stopped
+	// Clear the line, leaving the terminal for the summary.
+	fmt.Fprint(p.w, "\r\033[K")
+}
+
+// draw redraws the progress line. p.mu must be held.
+func (p *termProgress) draw() {
+	elapsed := time.Since(p.began)
+	eta := "--:--"
+	if p.finished > 0 {
+		left := elapsed / time.Duration(p.finished) * time.Duration(p.total-p.finished)
+		eta = formatClock(left)
+	}
+	fmt.Fprintf(p.w, "\r\033[K[%d/%d] %s elapsed, %s left  %s", p.finished, p.total, formatClock(elapsed), eta, p.current)
+}
+
+// formatClock formats d as minutes and seconds, such as "02:05", or as
+// hours, minutes and seconds if it is an hour or more.
+func formatClock(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
@@ -0,0 +1,166 @@
+package datamaps
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"github.com/tealeg/xlsx/v3"
+)
+
+// Formats in which the values found by Query can be written.
+const (
+	QueryTable = "table"
+	QueryCSV   = "csv"
+	QueryJSON  = "json"
+	QueryXLSX  = "xlsx"
+)
+
+// querySorts are the fields by which Query can sort its values.
+var querySorts = []string{"key", "sheet", "filename", "return", "datamap"}
+
+// queryColumns are the columns of the values written by Query as CSV or
+// XLSX.
+var queryColumns = []string{"datamap", "return", "filename", "key", "sheet", "cellref", "value", "formatted"}
+
+// Query writes the values matching opts.Filter, in any return, to w in
+// opts.Format, or saves them in opts.SavePath if it is set. The filters are
+// SQL LIKE patterns, passed to the database as parameters, so they cannot
+// change the query which uses them. The values are written as JSON if
+// opts.Output is OutputJSON, whatever opts.Format says.
+func Query(w io.Writer, opts *Options) error {
+	format := opts.Format
+	if opts.wantJSON() {
+		format = QueryJSON
+	}
+	if format == QueryXLSX && opts.SavePath == "" && isTerminal(w) {
+		return errors.New("an xlsx file cannot be written to a terminal - give --save FILE or redirect the output")
+	}
+
+	s, err := openStore(opts)
+	if err != nil {
+		return fmt.Errorf("cannot open database - %v", err)
+	}
+	defer s.Close()
+
+	values, next, err := s.QueryValues(opts.Filter, models.ListOptions{Sort: opts.Sort, Limit: opts.Limit})
+	if err != nil {
+		return err
+	}
+	more := next != ""
+
+	if opts.SavePath == "" {
+		return writeQuery(w, values, more, format)
+	}
+	f, err := os.Create(opts.SavePath)
+	if err != nil {
+		return err
+	}
+	if err := writeQuery(f, values, more, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeQuery writes values to w in format. more reports whether values
+// were cut short by a limit.
+func writeQuery(w io.Writer, values []models.QueryValue, more bool, format string) error {
+	switch format {
+	case QueryTable:
+		return writeQueryTable(w, values, more)
+	case QueryCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(queryColumns)
+		for _, v := range values {
+			cw.Write(queryRow(v))
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("cannot write values as CSV: %v", err)
+		}
+		return nil
+	case QueryJSON:
+		return writeJSON(w, struct {
+			Values []models.QueryValue `json:"values"`
+			More   bool                `json:"more"`
+		}{values, more})
+	case QueryXLSX:
+		return writeQueryXLSX(w, values)
+	default:
+		return fmt.Errorf("%q is not a supported query format", format)
+	}
+}
+
+// queryRow returns v as a row of queryColumns.
+func queryRow(v models.QueryValue) []string {
+	return []string{v.Datamap, v.Return, v.Filename, v.Key, v.Sheet, v.Cellref, v.Value, v.Formatted}
+}
+
+// writeQueryTable writes values to w as a table, followed by their number.
+func writeQueryTable(w io.Writer, values []models.QueryValue, more bool) error {
+	if len(values) == 0 {
+		_, err := fmt.Fprintln(w, "No values match.")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RETURN\tFILE\tKEY\tCELL\tVALUE")
+	for _, v := range values {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s!%s\t%s\n", v.Return, v.Filename, v.Key, v.Sheet, v.Cellref, v.Formatted)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if more {
+		_, err := fmt.Fprintf(w, "%d value(s) shown - more match, raise --limit to see them\n", len(values))
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d value(s)\n", len(values))
+	return err
+}
+
+// writeQueryXLSX writes values to w as a spreadsheet with a row for each,
+// below a header. Values which are numbers are written as numbers, so that
+// they can be summed.
+func writeQueryXLSX(w io.Writer, values []models.QueryValue) error {
+	wb := xlsx.NewFile()
+	sh, err := wb.AddSheet("Query")
+	if err != nil {
+		return fmt.Errorf("cannot add 'Query' sheet to new XLSX file: %v", err)
+	}
+	defer sh.Close()
+
+	header := sh.AddRow()
+	header.WriteSlice(queryColumns, -1)
+	value := slices.Index(queryColumns, "value")
+	for _, v := range values {
+		row := sh.AddRow()
+		for i, s := range queryRow(v) {
+			c := row.AddCell()
+			if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); i == value && err == nil {
+				c.SetFloat(f)
+				continue
+			}
+			c.SetString(s)
+		}
+	}
+	return wb.Write(w)
+}
+
+// checkLikePatterns returns an error naming flag if any of patterns ends
+// with a \ which escapes nothing.
+func checkLikePatterns(flag string, patterns []string) error {
+	for _, p := range patterns {
+		if (len(p)-len(strings.TrimRight(p, `\`)))%2 == 1 {
+			return fmt.Errorf("%s: %q ends with a \\ which escapes nothing", flag, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package datamaps
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"github.com/tealeg/xlsx/v3"
+)
+
+func TestQuery(t *testing.T) {
+	o := shellOptions(t)
+	o.Filter = models.ValueFilter{Keys: []string{"a float"}}
+
+	buf := new(bytes.Buffer)
+	o.Format = QueryTable
+	if err := Query(buf, o); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"RETURN", "test_template.xlsx", "Q1 2026", "Summary!B4", "2 value(s)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	o.Format, o.Sort = QueryCSV, "-return"
+	if err := Query(buf, o); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "datamap" || rows[1][1] != "Q1 2026" || rows[1][3] != "A Float" {
+		t.Errorf("unexpected CSV %q", rows)
+	}
+
+	buf.Reset()
+	o.Format, o.Limit = QueryJSON, 1
+	o.Filter.Files = []string{"%template2%"}
+	if err := Query(buf, o); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Values []models.QueryValue
+		More   bool
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Values) != 1 || got.More || got.Values[0].Filename != "test_template2.xlsx" || got.Values[0].Datamap != "DM" {
+		t.Errorf("unexpected JSON %+v", got)
+	}
+
+	buf.Reset()
+	o.Format, o.Filter = QueryTable, models.ValueFilter{}
+	if err := Query(buf, o); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "1 value(s) shown - more match") {
+		t.Errorf("expected the limit to be reported in\n%s", buf.String())
+	}
+
+	buf.Reset()
+	o.Filter = models.ValueFilter{Keys: []string{"Bobbins"}}
+	if err := Query(buf, o); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "No values match.\n" {
+		t.Errorf("expected no values, got\n%s", buf.String())
+	}
+}
+
+func TestQueryXLSX(t *testing.T) {
+	o := shellOptions(t)
+	o.Format, o.Sort = QueryXLSX, "key"
+	o.Filter = models.ValueFilter{Returns: []string{"Q1"}}
+	o.SavePath = filepath.Join(t.TempDir(), "query.xlsx")
+	if err := Query(new(bytes.Buffer), o); err != nil {
+		t.Fatal(err)
+	}
+
+	wb, err := xlsx.OpenFile(o.SavePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := wb.Sheet["Query"]
+	if sh == nil {
+		t.Fatal("expected a Query sheet")
+	}
+	if sh.MaxRow != 3 {
+		t.Fatalf("expected a header and 2 rows, got %d rows", sh.MaxRow)
+	}
+	key, _ := sh.Cell(1, 3)
+	value, _ := sh.Cell(1, 6)
+	if key.Value != "A Float" || value.Type() != xlsx.CellTypeNumeric {
+		t.Errorf("expected A Float to be a number, got %q of type %v", key.Value, value.Type())
+	}
+	text, _ := sh.Cell(2, 6)
+	if text.Type() != xlsx.CellTypeString {
+		t.Errorf("expected A String to be text, got type %v", text.Type())
+	}
+}
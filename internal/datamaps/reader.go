@@ -4,16 +4,18 @@
 package datamaps
 
 import (
-	"database/sql"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"path/filepath"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
 	"strings"
 
+	"git.yulqen.org/go/datamaps-go/internal/models"
 	"github.com/tealeg/xlsx/v3"
 )
 
@@ -30,9 +32,11 @@ type (
 
 // datamapLine - a line from the datamap.
 type datamapLine struct {
+	ID      int64
 	Key     string
 	Sheet   string
 	Cellref string
+	Type    string
 }
 
 // extractedCell is data pulled from a cell.
@@ -43,10 +47,40 @@ type extractedCell struct {
 	Value string
 }
 
-var (
-	inner = make(sheetData)
+// CellReport describes a single datamap line encountered when extracting
+// data from a spreadsheet.
+type CellReport struct {
+	Key     string `json:"key"`
+	Sheet   string `json:"sheet"`
+	Cellref string `json:"cellref"`
+	Value   string `json:"value,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// lineID is the id of the datamap line in the database.
+	lineID int64
+
+	// lineType is the type of value the datamap line expects.
+	lineType string
+}
+
+// Errors of the CellReports of datamap lines which are missing from a
+// spreadsheet.
+const (
+	errSheetNotFound = "sheet not found"
+	errNoSuchCell    = "no such cell"
+	errCellEmpty     = "cell is empty"
 )
 
+// ExtractionReport lists the datamap lines which were mapped, were missing
+// from or could not be parsed in a single spreadsheet file.
+type ExtractionReport struct {
+	Filename    string       `json:"filename"`
+	Mapped      []CellReport `json:"mapped"`
+	Missing     []CellReport `json:"missing"`
+	Unparseable []CellReport `json:"unparseable"`
+	Error       string       `json:"error,omitempty"`
+}
+
 // ExtractedDatamapFile is a slice of datamapLine structs, each of which encodes a single line
 // in the datamap file/database table.
 type ExtractedDatamapFile []datamapLine
@@ -78,7 +112,8 @@ func getSheetNames(dmls ExtractedDatamapFile) []string {
 }
 
 // ReadDML returns a slice of datamapLine structs given a
-// path to a datamap file.
+// path to a datamap file. The fourth column, if there is one, gives the
+// type of each line's value, one of models.LineTypes or empty.
 func ReadDML(path string) (ExtractedDatamapFile, error) {
 	var s ExtractedDatamapFile
 
@@ -109,120 +144,143 @@ func ReadDML(path string) (ExtractedDatamapFile, error) {
 			Key:     strings.Trim(record[0], " "),
 			Sheet:   strings.Trim(record[1], " "),
 			Cellref: strings.Trim(record[2], " ")}
+		if len(record) > 3 {
+			dml.Type = strings.ToUpper(strings.TrimSpace(record[3]))
+			if dml.Type != "" && !slices.Contains(models.LineTypes, dml.Type) {
+				return s, fmt.Errorf("unknown type %q for key %s in %s - use %s", record[3], dml.Key, path, strings.Join(models.LineTypes, ", "))
+			}
+		}
 		s = append(s, dml)
 	}
 
 	return s, nil
 }
 
-// cellVisitor is used by datamaps.rowVisitor() and is called
-// on every cell in the target xlsx file in order to extract
-// the data.
-func cellVisitor(c *xlsx.Cell) error {
-	x, y := c.GetCoordinates()
-	cellref := xlsx.GetCellIDStringFromCoords(x, y)
-
-	// TODO: we need to store the c.NumFmt value here in the
-	// database so we can reply it again when we write the values
-	// to the master or elsewhere. We should keep the value itself
-	// in its unformatted state - i.e a date being something like 488594.
-
-	ex := extractedCell{
-		Cell:  c,
-		Value: c.Value,
-	}
-
-	inner[cellref] = ex
+// cellVisitor returns the func used by rowVisitor() which is called
+// on every cell in the target xlsx file in order to extract the data
+// into sd.
+func cellVisitor(sd sheetData) xlsx.CellVisitorFunc {
+	return func(c *xlsx.Cell) error {
+		x, y := c.GetCoordinates()
+		cellref := xlsx.GetCellIDStringFromCoords(x, y)
+
+		// TODO: we need to store the c.NumFmt value here in the
+		// database so we can reply it again when we write the values
+		// to the master or elsewhere. We should keep the value itself
+		// in its unformatted state - i.e a date being something like 488594.
+
+		sd[cellref] = extractedCell{
+			Cell:  c,
+			Value: c.Value,
+		}
 
-	return nil
+		return nil
+	}
 }
 
-// rowVisitor is used as a callback by xlsx.sheet.ForEachRow(). It wraps
-// a call to xlsx.Row.ForEachCell() which actually extracts the data.
-func rowVisitor(r *xlsx.Row) error {
-	if err := r.ForEachCell(cellVisitor, xlsx.SkipEmptyCells); err != nil {
-		return err
+// rowVisitor returns a callback for xlsx.sheet.ForEachRow(). It wraps
+// a call to xlsx.Row.ForEachCell() which actually extracts the data into sd.
+func rowVisitor(sd sheetData) xlsx.RowVisitor {
+	return func(r *xlsx.Row) error {
+		return r.ForEachCell(cellVisitor(sd), xlsx.SkipEmptyCells)
 	}
-	return nil
 }
 
 // ReadXLSX returns a file at path's data as a map,
 // keyed on sheet name. All values are returned as strings.
-// Paths to a datamap and the spreadsheet file required.
-func ReadXLSX(path string) FileData {
-	wb, err := xlsx.OpenFile(path)
+// A file which cannot be read is logged to logger and gives no data.
+func ReadXLSX(path string, logger *slog.Logger) FileData {
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Error("cannot open file", "path", path, "error", err)
+		return make(FileData)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		logger.Error("cannot stat file", "path", path, "error", err)
+		return make(FileData)
+	}
+
+	outer, err := ReadXLSXReaderAt(f, info.Size())
 	if err != nil {
-		fmt.Errorf("cannot open file at %s - %v", path, err)
+		logger.Error("cannot read file", "path", path, "error", err)
 	}
 
+	return outer
+}
+
+// ReadXLSXReaderAt returns the data of the spreadsheet of size bytes
+// in r as a map, keyed on sheet name. All values are returned as strings.
+func ReadXLSXReaderAt(r io.ReaderAt, size int64) (FileData, error) {
 	outer := make(FileData, 1)
 
+	wb, err := xlsx.OpenReaderAt(r, size)
+	if err != nil {
+		return outer, fmt.Errorf("cannot open spreadsheet - %v", err)
+	}
+
 	// get the data
 	for _, sheet := range wb.Sheets {
-
-		if err := sheet.ForEachRow(rowVisitor); err != nil {
-			fmt.Errorf("cannot call ForEachRow() in sheet %s - %v", sheet.Name, err)
+		inner := make(sheetData)
+		if err := sheet.ForEachRow(rowVisitor(inner)); err != nil {
+			return outer, fmt.Errorf("cannot call ForEachRow() in sheet %s - %v", sheet.Name, err)
 		}
 		outer[sheet.Name] = inner
-		inner = make(sheetData)
 	}
 
-	return outer
+	return outer, nil
 }
 
 // DatamapFromDB creates an ExtractedDatamapFile from the database given
 // the name of a datamap. Of course, in this instance, the data is not
 // coming from a datamap file (such as datamap.csv) but from datamap data
 // previous stored in the database by DatamapToDB or similar.
-func DatamapFromDB(name string, db *sql.DB) (ExtractedDatamapFile, error) {
-
-	var out ExtractedDatamapFile
-
-	query := `
-	select
-		key, sheet, cellref
-	from datamap_line
-		join datamap on datamap_line.dm_id = datamap.id where datamap.name = ?;
-	`
-	rows, err := db.Query(query, name)
+func DatamapFromDB(name string, s models.Store) (ExtractedDatamapFile, error) {
+	lines, err := s.DatamapLines(name)
 	if err != nil {
-		erstr := fmt.Sprintf("cannot query for datamap key, sheet and cellref - %v", err)
-		return nil, errors.New(erstr)
+		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var (
-			key     string
-			sheet   string
-			cellref string
-		)
-		if err := rows.Scan(&key, &sheet, &cellref); err != nil {
-			return nil, err
-		}
 
-		out = append(out, datamapLine{Key: key, Sheet: sheet, Cellref: cellref})
+	var out ExtractedDatamapFile
+	for _, l := range lines {
+		out = append(out, datamapLine{ID: l.ID, Key: l.Key, Sheet: l.Sheet, Cellref: l.Cellref, Type: l.Type})
 	}
 
 	return out, nil
 }
 
-// ExtractDBDatamap uses a datamap named from the database db to extract values
-// from the populated spreadsheet file file.
-func ExtractDBDatamap(name string, file string, db *sql.DB) (ExtractedData, error) {
-	ddata, err := DatamapFromDB(name, db) // this will need to return an ExtractedDatamapFile
+// ExtractDBDatamap uses a datamap named from the database s to extract values
+// from the populated spreadsheet of size bytes read from r.
+func ExtractDBDatamap(name string, r io.ReaderAt, size int64, s models.Store) (ExtractedData, error) {
+	out, _, err := extractDBDatamapReport(name, r, size, s)
+	return out, err
+}
+
+// extractDBDatamapReport does the work for ExtractDBDatamap but also returns an
+// ExtractionReport detailing which lines in the datamap were mapped and which
+// could not be found in the spreadsheet.
+func extractDBDatamapReport(name string, r io.ReaderAt, size int64, s models.Store) (ExtractedData, *ExtractionReport, error) {
+	ddata, err := DatamapFromDB(name, s) // this will need to return an ExtractedDatamapFile
 	if err != nil {
-		erstr := fmt.Sprintf("cannot call DatamapFromDB() - %v", err)
-		return nil, errors.New(erstr)
+		return nil, nil, fmt.Errorf("cannot call DatamapFromDB() - %v", err)
 	}
 	if len(ddata) == 0 {
-		return nil, fmt.Errorf("there is no datamap in the database matching name '%s'. Try running 'datamaps datamap --import...'", name)
+		return nil, nil, fmt.Errorf("there is no datamap in the database matching name '%s'. Try running 'datamaps datamap --import...'", name)
+	}
+	xdata, err := ReadXLSXReaderAt(r, size)
+	if err != nil {
+		return nil, nil, err
 	}
-	xdata := ReadXLSX(file)
 
 	names := getSheetNames(ddata)
 	outer := make(ExtractedData, len(names))
-	// var inner map[string]xlsx.Cell
+	report := &ExtractionReport{
+		Mapped:      []CellReport{},
+		Missing:     []CellReport{},
+		Unparseable: []CellReport{},
+	}
 
 	for _, s := range names {
 		outer[s] = make(map[string]xlsx.Cell)
@@ -231,25 +289,54 @@ func ExtractDBDatamap(name string, file string, db *sql.DB) (ExtractedData, erro
 	for _, i := range ddata {
 		sheet := i.Sheet
 		cellref := i.Cellref
+		cr := CellReport{Key: i.Key, Sheet: sheet, Cellref: cellref, lineID: i.ID, lineType: i.Type}
+
+		if _, ok := xdata[sheet]; !ok {
+			cr.Error = errSheetNotFound
+			report.Missing = append(report.Missing, cr)
+			continue
+		}
+		if !validCellref(cellref) {
+			cr.Error = errNoSuchCell
+			report.Missing = append(report.Missing, cr)
+			continue
+		}
 
 		if val, ok := xdata[sheet][cellref]; ok {
 			outer[sheet][cellref] = *val.Cell
+			cr.Value = val.Value
+			report.Mapped = append(report.Mapped, cr)
+			continue
 		}
+		cr.Error = errCellEmpty
+		report.Missing = append(report.Missing, cr)
 	}
 
-	return outer, nil
+	return outer, report, nil
+}
+
+// cellrefPattern matches cell references such as "C9".
+var cellrefPattern = regexp.MustCompile(`^[A-Z]{1,3}[1-9][0-9]{0,6}$`)
+
+// validCellref reports whether cellref refers to a cell which can exist
+// in a spreadsheet, the last of which is XFD1048576.
+func validCellref(cellref string) bool {
+	if !cellrefPattern.MatchString(cellref) {
+		return false
+	}
+	x, y, err := xlsx.GetCoordsFromCellIDString(cellref)
+	return err == nil && x < 16384 && y < 1048576
 }
 
 // extract returns the file at path's data as a map,
 // using the datamap as a filter, keyed on sheet name. All values
 // are returned as strings. (Currently deprecated in favour of
 // ExtractDBDatamap.
-func extract(dm string, path string) ExtractedData {
-	xdata := ReadXLSX(path)
+func extract(dm string, path string, logger *slog.Logger) (ExtractedData, error) {
+	xdata := ReadXLSX(path, logger)
 	ddata, err := ReadDML(dm)
-
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	names := getSheetNames(ddata)
@@ -266,25 +353,5 @@ func extract(dm string, path string) ExtractedData {
 		}
 	}
 
-	return outer
-}
-
-// getTargetFiles finds all xlsx and xlsm files in directory.
-func getTargetFiles(path string) ([]string, error) {
-	if lastchar := path[len(path)-1:]; lastchar != string(filepath.Separator) {
-		return nil, fmt.Errorf("path must end in a %s character", string(filepath.Separator))
-	}
-
-	fullpath := strings.Join([]string{path, "*.xls[xm]"}, "")
-	output, err := filepath.Glob(fullpath)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if output == nil {
-		return nil, fmt.Errorf("cannot find any xlsx files in %s", path)
-	}
-
-	return output, nil
+	return outer, nil
 }
@@ -1,8 +1,13 @@
 package datamaps
 
 import (
+	"bytes"
+	"log/slog"
 	"os"
+	"strings"
 	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
 )
 
 func TestReadDML(t *testing.T) {
@@ -52,7 +57,7 @@ func TestGetSheetsFromDM(t *testing.T) {
 }
 
 func TestReadXLSX(t *testing.T) {
-	d := ReadXLSX("testdata/test_template.xlsx")
+	d := ReadXLSX("testdata/test_template.xlsx", discardLogger)
 	cases := []struct {
 		sheet, cellref, val string
 	}{
@@ -132,7 +137,7 @@ func TestDMLSliceFromDatabase(t *testing.T) {
 		{7, "Parrots Name"},
 	}
 
-	data, _ := DatamapFromDB("First Datamap", db)
+	data, _ := DatamapFromDB("First Datamap", models.NewSQLiteStore(db))
 
 	for _, c := range cases {
 		got := data[c.index].Key
@@ -168,7 +173,20 @@ func TestExtractUsingDBDM(t *testing.T) {
 		t.Errorf("Unable to write datamap to database file because %v.", err)
 	}
 
-	d, _ := ExtractDBDatamap("First Datamap", "testdata/test_template.xlsx", db)
+	f, err := os.Open("testdata/test_template.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ExtractDBDatamap("First Datamap", f, info.Size(), models.NewSQLiteStore(db))
+	if err != nil {
+		t.Fatal(err)
+	}
 	cases := []struct {
 		sheet, cellref, val string
 	}{
@@ -188,8 +206,22 @@ func TestExtractUsingDBDM(t *testing.T) {
 	}
 }
 
+func TestReadXLSXLogsErrors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	d := ReadXLSX("testdata/missing.xlsx", slog.New(slog.NewTextHandler(buf, nil)))
+	if len(d) != 0 {
+		t.Errorf("expected no data from a missing file, got %v", d)
+	}
+	if !strings.Contains(buf.String(), "cannot open file") {
+		t.Errorf("expected the missing file to be logged, got %q", buf.String())
+	}
+}
+
 func TestExtract(t *testing.T) {
-	d := extract("testdata/datamap.csv", "testdata/test_template.xlsx")
+	d, err := extract("testdata/datamap.csv", "testdata/test_template.xlsx", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
 	cases := []struct {
 		sheet, cellref, val string
 	}{
@@ -212,40 +244,3 @@ func TestExtract(t *testing.T) {
 		t.Errorf("Expected E26 in Another Sheet sheet to be Integer: - instead it is %s", d["Another Sheet"]["E26"].Value)
 	}
 }
-
-// func TestGetTargetFiles(t *testing.T) {
-// 	// This is not a suitable test for parameterisation, but doing it this way anyway.
-// 	type args struct {
-// 		path string
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		args    args
-// 		want    []string
-// 		wantErr bool
-// 	}{
-// 		{"Get files in testdata",
-// 			args{"./testdata/"},
-// 			[]string{
-// 				"testdata/test_template.xlsm",
-// 				"testdata/test_template.xlsx",
-// 				"testdata/test_template2.xlsx",
-// 				"testdata/test_template3.xlsx",
-// 			},
-// 			false,
-// 		},
-// 	}
-// 	for _, tt := range tests {
-// 		t.Log("Running the test")
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			got, err := getTargetFiles(tt.args.path)
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("getTargetFiles() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if !reflect.DeepEqual(got, tt.want) {
-// 				t.Errorf("getTargetFiles() = %v, want %v", got, tt.want)
-// 			}
-// 		})
-// 	}
-// }
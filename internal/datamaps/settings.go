@@ -0,0 +1,407 @@
+package datamaps
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is the name of the configuration file in the user config
+// directory, unless $DATAMAPS_CONFIG gives another path.
+const configFileName = "config.yaml"
+
+// Sources of a setting's value, from lowest to highest precedence.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceProfile = "profile"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// setting is an option which can be given in the configuration file, in an
+// environment variable or, for some commands, with a flag.
+type setting struct {
+	// key names the setting in the configuration file.
+	key string
+
+	// env is the environment variable which sets it.
+	env string
+
+	// flag is the name of the flag which sets it, if there is one.
+	flag string
+
+	// path is true for paths, in which a leading ~ is the home directory.
+	path bool
+
+	// field returns a pointer to the setting in opts, which is a *string,
+	// *int or *time.Duration.
+	field func(opts *Options) any
+}
+
+// settings are every setting, in the order "config show" lists them.
+var settings = []setting{
+	{key: "db_path", env: "DATAMAPS_DB_PATH", path: true, field: func(o *Options) any { return &o.DBPath }},
+	{key: "dsn", env: "DATAMAPS_DSN", flag: "dsn", field: func(o *Options) any { return &o.DSN }},
+	{key: "datamap_name", env: "DATAMAPS_DATAMAP_NAME", flag: "datamapname", field: func(o *Options) any { return &o.DMName }},
+	{key: "datamap_path", env: "DATAMAPS_DATAMAP_PATH", flag: "import", path: true, field: func(o *Options) any { return &o.DMPath }},
+	{key: "return_name", env: "DATAMAPS_RETURN_NAME", flag: "returnname", field: func(o *Options) any { return &o.ReturnName }},
+	{key: "xlsx_path", env: "DATAMAPS_XLSX_PATH", flag: "xlsxpath", path: true, field: func(o *Options) any { return &o.XLSXPath }},
+	{key: "master_output_dir", env: "DATAMAPS_MASTER_OUTPUT_DIR", flag: "masteroutputdir", path: true, field: func(o *Options) any { return &o.MasterOutPutPath }},
+	{key: "addr", env: "DATAMAPS_ADDR", flag: "addr", field: func(o *Options) any { return &o.ServerAddr }},
+	{key: "public_url", env: "DATAMAPS_PUBLIC_URL", flag: "public-url", field: func(o *Options) any { return &o.PublicURL }},
+	{key: "workers", env: "DATAMAPS_WORKERS", flag: "workers", field: func(o *Options) any { return &o.Workers }},
+	{key: "read_header_timeout", env: "DATAMAPS_READ_HEADER_TIMEOUT", flag: "read-header-timeout", field: func(o *Options) any { return &o.ReadHeaderTimeout }},
+	{key: "read_timeout", env: "DATAMAPS_READ_TIMEOUT", flag: "read-timeout", field: func(o *Options) any { return &o.ReadTimeout }},
+	{key: "write_timeout", env: "DATAMAPS_WRITE_TIMEOUT", flag: "write-timeout", field: func(o *Options) any { return &o.WriteTimeout }},
+	{key: "idle_timeout", env: "DATAMAPS_IDLE_TIMEOUT", flag: "idle-timeout", field: func(o *Options) any { return &o.IdleTimeout }},
+	{key: "log_level", env: "DATAMAPS_LOG_LEVEL", flag: "log-level", field: func(o *Options) any { return &o.LogLevel }},
+	{key: "log_format", env: "DATAMAPS_LOG_FORMAT", flag: "log-format", field: func(o *Options) any { return &o.LogFormat }},
+}
+
+// set parses value and stores it as the setting in opts.
+func (s setting) set(opts *Options, value string) error {
+	switch p := s.field(opts).(type) {
+	case *string:
+		if s.path {
+			value = expandHome(value)
+		}
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a whole number, not %q", s.key, value)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration such as 30s, not %q", s.key, value)
+		}
+		*p = d
+	}
+	return nil
+}
+
+// get returns the setting's value in opts as text.
+func (s setting) get(opts *Options) string {
+	switch p := s.field(opts).(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+// expandHome replaces a leading ~ in path with the user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// configFile is the contents of the configuration file.
+type configFile struct {
+	Settings map[string]string `yaml:",inline"`
+
+	// Profiles hold settings, by profile name, which override Settings
+	// when the profile is chosen.
+	Profiles map[string]map[string]string `yaml:"profiles"`
+}
+
+// configFilePath returns the path of the configuration file.
+func configFilePath() (string, error) {
+	if path := os.Getenv("DATAMAPS_CONFIG"); path != "" {
+		return expandHome(path), nil
+	}
+	dir, err := userConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configFileName), nil
+}
+
+// readConfigFile reads the configuration file at path. A missing file is
+// the same as an empty one.
+func readConfigFile(path string) (configFile, error) {
+	var cf configFile
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cf, nil
+	}
+	if err != nil {
+		return cf, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&cf); err != nil && !errors.Is(err, io.EOF) {
+		return cf, fmt.Errorf("cannot read %s - %v", path, err)
+	}
+	return cf, nil
+}
+
+// lookupSetting returns the setting with key.
+func lookupSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// applyConfig overrides the defaults in opts with the configuration file
+// and then the environment, recording where each value came from.
+func applyConfig(opts *Options) error {
+	path, err := configFilePath()
+	if err != nil {
+		return err
+	}
+	opts.ConfigPath = path
+
+	cf, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := applySettings(opts, cf.Settings, sourceFile+" "+path); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	if opts.Profile == "" {
+		opts.Profile = os.Getenv("DATAMAPS_PROFILE")
+	}
+	if opts.Profile != "" {
+		profile, ok := cf.Profiles[opts.Profile]
+		if !ok {
+			return fmt.Errorf("there is no profile %q in %s", opts.Profile, path)
+		}
+		src := fmt.Sprintf("%s %s in %s", sourceProfile, opts.Profile, path)
+		if err := applySettings(opts, profile, src); err != nil {
+			return fmt.Errorf("%s: profile %s: %v", path, opts.Profile, err)
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := s.set(opts, value); err != nil {
+			return fmt.Errorf("$%s: %v", s.env, err)
+		}
+		opts.sources[s.key] = sourceEnv + " " + s.env
+	}
+	return nil
+}
+
+// applySettings stores values, by setting key, in opts, recording that
+// they came from source.
+func applySettings(opts *Options, values map[string]string, source string) error {
+	for key, value := range values {
+		s, ok := lookupSetting(key)
+		if !ok {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if err := s.set(opts, value); err != nil {
+			return err
+		}
+		opts.sources[s.key] = source
+	}
+	return nil
+}
+
+// setByFlag records that the flag called name was given on the command
+// line, if it sets a setting.
+func (o *Options) setByFlag(name string) {
+	for _, s := range settings {
+		if s.flag == name {
+			o.sources[s.key] = sourceFlag + " --" + name
+		}
+	}
+}
+
+// Source returns where the setting with key got its value: "default",
+// "file PATH", "profile NAME in PATH", "env VARIABLE" or "flag --NAME".
+func (o *Options) Source(key string) string {
+	if src, ok := o.sources[key]; ok {
+		return src
+	}
+	return sourceDefault
+}
+
+// settingFlags defines a flag on fs for each setting which has one, so
+// that "config show" accepts the same flags as the other commands.
+func settingFlags(fs *flag.FlagSet, opts *Options) {
+	for _, s := range settings {
+		// Settings such as log_level have flags on every command.
+		if s.flag == "" || fs.Lookup(s.flag) != nil {
+			continue
+		}
+		usage := "override " + s.key
+		switch p := s.field(opts).(type) {
+		case *string:
+			fs.StringVar(p, s.flag, *p, usage)
+		case *int:
+			fs.IntVar(p, s.flag, *p, usage)
+		case *time.Duration:
+			fs.DurationVar(p, s.flag, *p, usage)
+		}
+	}
+}
+
+// redactDSN hides the password in a postgres:// DSN.
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil {
+		return dsn
+	}
+	return u.Redacted()
+}
+
+// settingJSON is a setting, as written by ShowConfig with --output json.
+type settingJSON struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// ShowConfig writes every setting in opts to w, with where its value came
+// from, as JSON if opts.Output is OutputJSON. The password in a DSN is
+// hidden.
+func ShowConfig(w io.Writer, opts *Options) error {
+	_, err := os.Stat(opts.ConfigPath)
+	if opts.wantJSON() {
+		values := make([]settingJSON, 0, len(settings))
+		for _, s := range settings {
+			values = append(values, settingJSON{s.key, s.displayValue(opts), opts.Source(s.key)})
+		}
+		return writeJSON(w, struct {
+			ConfigFile string        `json:"config_file"`
+			Found      bool          `json:"found"`
+			Profile    string        `json:"profile,omitempty"`
+			Settings   []settingJSON `json:"settings"`
+		}{opts.ConfigPath, err == nil, opts.Profile, values})
+	}
+
+	found := "not found"
+	if err == nil {
+		found = "found"
+	}
+	fmt.Fprintf(w, "Configuration file: %s (%s)\n", opts.ConfigPath, found)
+	if opts.Profile != "" {
+		fmt.Fprintf(w, "Profile: %s\n", opts.Profile)
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	for _, s := range settings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.key, s.displayValue(opts), opts.Source(s.key))
+	}
+	return tw.Flush()
+}
+
+// displayValue returns the setting's value in opts as text, with the
+// password in a DSN hidden.
+func (s setting) displayValue(opts *Options) string {
+	if s.key == "dsn" {
+		return redactDSN(s.get(opts))
+	}
+	return s.get(opts)
+}
+
+// ListProfiles writes the names of the profiles in the configuration file
+// used by opts to w, marking the one in use, or as JSON if opts.Output is
+// OutputJSON.
+func ListProfiles(w io.Writer, opts *Options) error {
+	cf, err := readConfigFile(opts.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(cf.Profiles))
+	for name := range cf.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if opts.wantJSON() {
+		return writeJSON(w, struct {
+			ConfigFile string   `json:"config_file"`
+			Profiles   []string `json:"profiles"`
+			Current    string   `json:"current,omitempty"`
+		}{opts.ConfigPath, names, opts.Profile})
+	}
+
+	if len(names) == 0 {
+		_, err := fmt.Fprintf(w, "There are no profiles in %s.\n", opts.ConfigPath)
+		return err
+	}
+	for _, name := range names {
+		mark := " "
+		if name == opts.Profile {
+			mark = "*"
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", mark, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeConfigTemplate creates the configuration file at path, listing
+// every setting, commented out, with its value in defaults.
+func writeConfigTemplate(path string, defaults *Options) error {
+	var b strings.Builder
+	b.WriteString(`# datamaps configuration.
+#
+# Uncomment a setting to change it. Environment variables, named beside each
+# setting, override this file, and command line flags override both. Run
+# "datamaps config show" to see the settings in use and where they came from.
+
+`)
+	for _, s := range settings {
+		fmt.Fprintf(&b, "# %s: %s  # $%s\n", s.key, strconv.Quote(s.get(defaults)), s.env)
+	}
+	b.WriteString(`
+# Profiles hold the settings of one portfolio, overriding those above when
+# chosen with --profile NAME or $DATAMAPS_PROFILE. Create a profile's database
+# with "datamaps setup --profile NAME".
+#
+# profiles:
+#   defence:
+#     db_path: "~/portfolios/defence/datamaps.db"
+#     datamap_name: "Defence Datamap"
+#     xlsx_path: "~/portfolios/defence/returns"
+#     master_output_dir: "~/portfolios/defence/masters"
+`)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
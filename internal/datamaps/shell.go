@@ -0,0 +1,694 @@
+package datamaps
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"golang.org/x/term"
+)
+
+// shellPrompt is the prompt of the interactive shell.
+const shellPrompt = "datamaps> "
+
+var (
+	// errQuit is returned by the shell's quit command to end the session.
+	errQuit = errors.New("quit")
+
+	// errUsage is returned by a shell command given the wrong arguments,
+	// and reported with the command's usage.
+	errUsage = errors.New("usage")
+)
+
+// shellCommand is a command of the interactive shell.
+type shellCommand struct {
+	name    string
+	args    string
+	summary string
+
+	// run runs the command with its arguments.
+	run func(sh *shell, args []string) error
+
+	// complete, if set, returns the candidates for the argument which
+	// follows args.
+	complete func(sh *shell, args []string) []string
+}
+
+// shellCommands are the commands of the shell, in the order "help" lists
+// them. The help command itself is handled by the shell.
+var shellCommands = []shellCommand{
+	{
+		name:    "datamaps",
+		summary: "list the datamaps",
+		run:     (*shell).listDatamaps,
+	},
+	{
+		name:    "returns",
+		summary: "list the returns",
+		run:     (*shell).listReturns,
+	},
+	{
+		name:    "use",
+		args:    "datamap|return NAME",
+		summary: "choose the datamap or return the other commands use",
+		run:     (*shell).use,
+		complete: func(sh *shell, args []string) []string {
+			switch {
+			case len(args) == 0:
+				return []string{"datamap", "return"}
+			case len(args) == 1 && args[0] == "datamap":
+				return datamapNames(sh.store)
+			case len(args) == 1 && args[0] == "return":
+				return returnNames(sh.store)
+			}
+			return nil
+		},
+	},
+	{
+		name:    "keys",
+		args:    "[[LIKE] PATTERN]",
+		summary: "list the datamap's keys, those containing PATTERN, or matching a LIKE pattern with % and _",
+		run:     (*shell).keys,
+		complete: func(sh *shell, args []string) []string {
+			if len(args) == 0 {
+				return []string{"LIKE"}
+			}
+			return nil
+		},
+	},
+	{
+		name:    "files",
+		summary: "list the files in the return",
+		run:     (*shell).files,
+	},
+	{
+		name:     "value",
+		args:     "KEY [FILE]",
+		summary:  "show the value of KEY in FILE, or in every file, of the return",
+		run:      (*shell).value,
+		complete: (*shell).completeKeyFile,
+	},
+	{
+		name:     "history",
+		args:     "KEY [FILE]",
+		summary:  "show the value of KEY in every return, oldest first",
+		run:      (*shell).history,
+		complete: (*shell).completeKeyFile,
+	},
+	{
+		name:    "master",
+		args:    "[RETURN]",
+		summary: "show the master of the return, or of RETURN",
+		run:     (*shell).master,
+		complete: func(sh *shell, args []string) []string {
+			if len(args) == 0 {
+				return returnNames(sh.store)
+			}
+			return nil
+		},
+	},
+	{
+		name:    "diff",
+		args:    "RETURN [RETURN]",
+		summary: "show the values which differ between the return and RETURN, or between two returns",
+		run:     (*shell).diff,
+		complete: func(sh *shell, args []string) []string {
+			if len(args) < 2 {
+				return returnNames(sh.store)
+			}
+			return nil
+		},
+	},
+	{
+		name:    "quit",
+		summary: "leave the shell (or press Ctrl-D)",
+		run:     func(*shell, []string) error { return errQuit },
+	},
+}
+
+// lookupShellCommand returns the shell command called name. "exit" is
+// another name for "quit".
+func lookupShellCommand(name string) (shellCommand, bool) {
+	if name == "exit" {
+		name = "quit"
+	}
+	i := slices.IndexFunc(shellCommands, func(c shellCommand) bool { return c.name == name })
+	if i < 0 {
+		return shellCommand{}, false
+	}
+	return shellCommands[i], true
+}
+
+// shell is a session of the interactive shell.
+type shell struct {
+	w     io.Writer
+	store models.Store
+
+	// datamap and ret are the names of the datamap and return used by
+	// the commands which need them.
+	datamap string
+	ret     string
+}
+
+// Shell runs the interactive shell on the database given by opts, starting
+// with the datamap and return it names. Commands are read from r and their
+// output written to w. If r is a terminal, lines are read with a prompt and
+// can be edited, recalled with the arrow keys and completed with Tab.
+// Otherwise a command is read from each line without a prompt, as from a
+// script, and the error reports the number of commands which failed.
+func Shell(r io.Reader, w io.Writer, opts *Options) error {
+	s, err := openStore(opts)
+	if err != nil {
+		return fmt.Errorf("cannot open database - %v", err)
+	}
+	defer s.Close()
+
+	sh := &shell{w: w, store: s, datamap: opts.DMName, ret: opts.ReturnName}
+	if f, ok := r.(interface{ Fd() uintptr }); ok && term.IsTerminal(int(f.Fd())) {
+		return sh.interactive(int(f.Fd()), r, w)
+	}
+	return sh.script(r)
+}
+
+// interactive runs the shell on the terminal with file descriptor fd.
+func (sh *shell) interactive(fd int, r io.Reader, w io.Writer) error {
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{r, w}, shellPrompt)
+	if width, height, err := term.GetSize(fd); err == nil && width > 0 {
+		t.SetSize(width, height)
+	}
+	t.AutoCompleteCallback = sh.autoComplete
+	sh.w = t
+
+	fmt.Fprintf(t, "Using datamap %q and return %q. Type \"help\" for the commands.\n", sh.datamap, sh.ret)
+	for {
+		line, err := t.ReadLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sh.exec(line); errors.Is(err, errQuit) {
+			return nil
+		} else if err != nil {
+			fmt.Fprintf(t, "error: %v\n", err)
+		}
+	}
+}
+
+// script runs the commands read from r, one to a line.
+func (sh *shell) script(r io.Reader) error {
+	failed := 0
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		err := sh.exec(sc.Text())
+		if errors.Is(err, errQuit) {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(sh.w, "error: %v\n", err)
+			failed++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d command(s) failed", failed)
+	}
+	return nil
+}
+
+// exec runs the command on line. Blank lines and lines beginning with #
+// are ignored.
+func (sh *shell) exec(line string) error {
+	words, open := splitLine(line)
+	if open {
+		return errors.New("unterminated quote")
+	}
+	if len(words) == 0 || strings.HasPrefix(words[0].text, "#") {
+		return nil
+	}
+	args := make([]string, 0, len(words)-1)
+	for _, w := range words[1:] {
+		args = append(args, w.text)
+	}
+
+	name := words[0].text
+	if name == "help" {
+		return sh.help(args)
+	}
+	c, ok := lookupShellCommand(name)
+	if !ok {
+		return fmt.Errorf("unknown command %q - type \"help\" for the commands", name)
+	}
+	err := c.run(sh, args)
+	if errors.Is(err, errUsage) {
+		return fmt.Errorf("usage: %s %s", c.name, c.args)
+	}
+	return err
+}
+
+// help lists the shell's commands.
+func (sh *shell) help(args []string) error {
+	if len(args) > 0 {
+		c, ok := lookupShellCommand(args[0])
+		if !ok {
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		_, err := fmt.Fprintf(sh.w, "%s %s\n  %s\n", c.name, c.args, c.summary)
+		return err
+	}
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	for _, c := range shellCommands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	fmt.Fprintf(tw, "  help [COMMAND]\tdescribe the commands\n")
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(sh.w, "\nNames containing spaces are written in quotes, such as use return \"Q1 2026\".\nThe datamap is %q and the return %q.\n", sh.datamap, sh.ret)
+	return err
+}
+
+func (sh *shell) listDatamaps(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	dms, _, err := sh.store.Datamaps(models.ListOptions{})
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tNAME\tVISIBILITY\tCREATED")
+	for _, dm := range dms {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", sh.mark(dm.Name == sh.datamap), dm.Name, dm.Visibility, dm.Created.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func (sh *shell) listReturns(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	returns, _, err := sh.store.Returns(models.ListOptions{})
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tNAME\tCREATED")
+	for _, r := range returns {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", sh.mark(r.Name == sh.ret), r.Name, r.Created.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+// mark returns the mark of the datamap or return in use in a list.
+func (sh *shell) mark(current bool) string {
+	if current {
+		return "*"
+	}
+	return ""
+}
+
+func (sh *shell) use(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	name := args[1]
+	switch args[0] {
+	case "datamap":
+		if _, err := sh.store.GetDatamap(name); errors.Is(err, models.ErrNoRecord) {
+			return fmt.Errorf("%w: %s", ErrNoDatamap, name)
+		} else if err != nil {
+			return err
+		}
+		sh.datamap = name
+	case "return":
+		if _, err := sh.store.GetReturn(name); errors.Is(err, models.ErrNoRecord) {
+			return fmt.Errorf("%w: %s", ErrNoReturn, name)
+		} else if err != nil {
+			return err
+		}
+		sh.ret = name
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func (sh *shell) keys(args []string) error {
+	var opts models.ListOptions
+	switch {
+	case len(args) == 2 && strings.EqualFold(args[0], "like"):
+		opts.Like = args[1]
+	case len(args) == 1:
+		opts.Query = args[0]
+	case len(args) > 0:
+		return errUsage
+	}
+
+	if _, err := sh.store.GetDatamap(sh.datamap); errors.Is(err, models.ErrNoRecord) {
+		return fmt.Errorf("%w: %s", ErrNoDatamap, sh.datamap)
+	} else if err != nil {
+		return err
+	}
+	lines, _, err := sh.store.ListLines(sh.datamap, opts)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSHEET\tCELL\tTYPE")
+	for _, l := range lines {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.Key, l.Sheet, l.Cellref, l.Type)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(sh.w, "%d key(s)\n", len(lines))
+	return err
+}
+
+// checkReturn returns ErrNoReturn if the return in use does not exist.
+func (sh *shell) checkReturn() error {
+	if _, err := sh.store.GetReturn(sh.ret); errors.Is(err, models.ErrNoRecord) {
+		return fmt.Errorf("%w: %s", ErrNoReturn, sh.ret)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sh *shell) files(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	names, err := sh.fileNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintln(sh.w, name)
+	}
+	_, err = fmt.Fprintf(sh.w, "%d file(s)\n", len(names))
+	return err
+}
+
+// fileNames returns the names of the files in the return in use.
+func (sh *shell) fileNames() ([]string, error) {
+	if err := sh.checkReturn(); err != nil {
+		return nil, err
+	}
+	return sh.store.ReturnFiles(sh.datamap, sh.ret)
+}
+
+func (sh *shell) value(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	if err := sh.checkReturn(); err != nil {
+		return err
+	}
+	opts := models.ListOptions{Key: args[0], Sort: "filename"}
+	if len(args) == 2 {
+		opts.Filename = args[1]
+	}
+	values, _, err := sh.store.ListReturnValues(sh.datamap, sh.ret, opts)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("no value for %s in return %s", args[0], sh.ret)
+	}
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tCELL\tVALUE")
+	for _, v := range values {
+		fmt.Fprintf(tw, "%s\t%s!%s\t%s\n", v.Filename, v.Sheet, v.Cellref, v.Formatted)
+	}
+	return tw.Flush()
+}
+
+func (sh *shell) history(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	var file string
+	if len(args) == 2 {
+		file = args[1]
+	}
+	values, _, err := sh.store.KeyHistory(args[0], file, models.ListOptions{})
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("no value for %s in any return", args[0])
+	}
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RETURN\tFILE\tVALUE")
+	for _, kv := range values {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", kv.Return.Name, kv.Filename, kv.Formatted)
+	}
+	return tw.Flush()
+}
+
+// completeKeyFile completes the KEY and FILE arguments of value and
+// history.
+func (sh *shell) completeKeyFile(args []string) []string {
+	switch len(args) {
+	case 0:
+		lines, err := sh.store.DatamapLines(sh.datamap)
+		if err != nil {
+			return nil
+		}
+		keys := make([]string, 0, len(lines))
+		for _, l := range lines {
+			keys = append(keys, l.Key)
+		}
+		return keys
+	case 1:
+		names, _ := sh.fileNames()
+		return names
+	}
+	return nil
+}
+
+func (sh *shell) master(args []string) error {
+	ret := sh.ret
+	switch len(args) {
+	case 0:
+	case 1:
+		ret = args[0]
+	default:
+		return errUsage
+	}
+	m, err := AssembleMaster(sh.datamap, ret, sh.store)
+	if err != nil {
+		return err
+	}
+	rows := m.Rows()
+	rows[0][0] = "KEY"
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (sh *shell) diff(args []string) error {
+	var from, to string
+	switch len(args) {
+	case 1:
+		from, to = sh.ret, args[0]
+	case 2:
+		from, to = args[0], args[1]
+	default:
+		return errUsage
+	}
+	a, err := AssembleMaster(sh.datamap, from, sh.store)
+	if err != nil {
+		return err
+	}
+	b, err := AssembleMaster(sh.datamap, to, sh.store)
+	if err != nil {
+		return err
+	}
+
+	files := slices.Clone(a.Files)
+	for _, f := range b.Files {
+		if !slices.Contains(files, f) {
+			files = append(files, f)
+		}
+	}
+	tw := tabwriter.NewWriter(sh.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "KEY\tFILE\t%s\t%s\n", from, to)
+	n := 0
+	for _, k := range a.Keys {
+		for _, f := range files {
+			if va, vb := a.Value(k, f), b.Value(k, f); va != vb {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", k, f, va, vb)
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		_, err := fmt.Fprintf(sh.w, "No differences between %s and %s.\n", from, to)
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(sh.w, "%d difference(s)\n", n)
+	return err
+}
+
+// shellWord is a word of a shell command line.
+type shellWord struct {
+	text string
+
+	// start is the offset in the line at which the word starts.
+	start int
+}
+
+// splitLine splits line into words separated by spaces. Text in double or
+// single quotes is part of a word, spaces and all. It reports whether the
+// line ends inside quotes.
+func splitLine(line string) (words []shellWord, open bool) {
+	var (
+		quote  rune
+		inWord bool
+		text   strings.Builder
+		start  int
+	)
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+			continue
+		case quote != 0:
+		case r == '"' || r == '\'':
+			quote = r
+			if !inWord {
+				inWord, start = true, i
+			}
+			continue
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, shellWord{text.String(), start})
+				text.Reset()
+				inWord = false
+			}
+			continue
+		}
+		if !inWord {
+			inWord, start = true, i
+		}
+		text.WriteRune(r)
+	}
+	if inWord {
+		words = append(words, shellWord{text.String(), start})
+	}
+	return words, quote != 0
+}
+
+// quoteWord returns s quoted so that splitLine reads it as a single word.
+// If partial is set the closing quote is left off, so that more can be
+// typed.
+func quoteWord(s string, partial bool) string {
+	if !strings.ContainsAny(s, " \t\"'") {
+		return s
+	}
+	q := `"`
+	if strings.Contains(s, `"`) {
+		q = "'"
+	}
+	if partial {
+		return q + s
+	}
+	return q + s + q
+}
+
+// autoComplete is the terminal's callback for each key press. Tab
+// completes the word before the cursor: to the candidate if there is only
+// one, to the longest prefix shared by the candidates if that is longer,
+// or else by listing them.
+func (sh *shell) autoComplete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head, tail := line[:pos], line[pos:]
+	words, open := splitLine(head)
+	cur, start := "", len(head)
+	if len(words) > 0 && (open || !strings.HasSuffix(head, " ")) {
+		last := words[len(words)-1]
+		cur, start = last.text, last.start
+		words = words[:len(words)-1]
+	}
+
+	args := make([]string, 0, len(words))
+	for _, w := range words {
+		args = append(args, w.text)
+	}
+	candidates := matching(sh.candidates(args), cur, "")
+	var replacement string
+	switch {
+	case len(candidates) == 0:
+		return "", 0, false
+	case len(candidates) == 1:
+		replacement = quoteWord(candidates[0], false) + " "
+	default:
+		common := []rune(candidates[0])
+		for _, c := range candidates[1:] {
+			for !strings.HasPrefix(c, string(common)) {
+				common = common[:len(common)-1]
+			}
+		}
+		if len(string(common)) <= len(cur) {
+			fmt.Fprintln(sh.w, strings.Join(candidates, "  "))
+			return "", 0, false
+		}
+		replacement = quoteWord(string(common), true)
+	}
+	head = head[:start] + replacement
+	return head + tail, len(head), true
+}
+
+// candidates returns the candidates for the word which follows args.
+func (sh *shell) candidates(args []string) []string {
+	if len(args) == 0 {
+		names := []string{"help", "exit"}
+		for _, c := range shellCommands {
+			names = append(names, c.name)
+		}
+		return names
+	}
+	if args[0] == "help" {
+		if len(args) > 1 {
+			return nil
+		}
+		names := make([]string, 0, len(shellCommands))
+		for _, c := range shellCommands {
+			names = append(names, c.name)
+		}
+		return names
+	}
+	c, ok := lookupShellCommand(args[0])
+	if !ok || c.complete == nil {
+		return nil
+	}
+	return c.complete(sh, args[1:])
+}
@@ -0,0 +1,152 @@
+package datamaps
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// shellOptions returns options for a database holding the test templates
+// imported into the returns "Q1" and "Q1 2026" with the datamap "DM".
+func shellOptions(t *testing.T) *Options {
+	t.Helper()
+	o := newTestDB(t, "DM", `cell_key,template_sheet,cell_reference
+A String,Summary,B3
+A Float,Summary,B4
+`)
+	o.Quiet = true
+	for ret, file := range map[string]string{"Q1": "./testdata/test_template.xlsx", "Q1 2026": "./testdata/test_template2.xlsx"} {
+		o.ReturnName, o.Files = ret, []string{file}
+		if err := ImportToDB(context.Background(), io.Discard, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.ReturnName, o.Files = "Q1", nil
+	return o
+}
+
+func TestShellScript(t *testing.T) {
+	o := shellOptions(t)
+
+	tests := []struct {
+		name    string
+		script  string
+		want    []string
+		wantErr string
+	}{
+		{"help", "help\n", []string{"use datamap|return NAME", "help [COMMAND]", `The datamap is "DM" and the return "Q1".`}, ""},
+		{"returns", "# the returns\n\nreturns\n", []string{"* Q1", "Q1 2026"}, ""},
+		{"keys", "keys float\nkeys LIKE a_s%\nkeys like a.s%\n", []string{"A Float Summary B4", "A String Summary B3", "1 key(s)", "0 key(s)"}, ""},
+		{"files", "files\n", []string{"test_template.xlsx", "1 file(s)"}, ""},
+		{"value", `value "A String" test_template.xlsx` + "\n", []string{"test_template.xlsx Summary!B3"}, ""},
+		{"no value", `value "A String" other.xlsx` + "\n", []string{"error: no value for A String in return Q1"}, "1 command(s) failed"},
+		{"history", "history 'A String'\n", []string{"RETURN FILE VALUE", "Q1 test_template.xlsx", "Q1 2026 test_template2.xlsx"}, ""},
+		{"use", "use return \"Q1 2026\"\nfiles\n", []string{"test_template2.xlsx"}, ""},
+		{"master", "master\n", []string{"KEY test_template.xlsx", "A Float"}, ""},
+		{"quit", "quit\nreturns\n", nil, ""},
+		{"errors", "values\nuse return Q9\nvalue\nkeys \"A\nreturns\n", []string{
+			`error: unknown command "values"`,
+			"error: no matching return found: Q9",
+			"error: usage: value KEY [FILE]",
+			"error: unterminated quote",
+			"* Q1",
+		}, "4 command(s) failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			err := Shell(strings.NewReader(tt.script), buf, o)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+
+			var lines []string
+			for _, line := range strings.Split(buf.String(), "\n") {
+				lines = append(lines, strings.Join(strings.Fields(line), " "))
+			}
+			out := strings.Join(lines, "\n")
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("expected %q in\n%s", want, out)
+				}
+			}
+			if tt.name == "quit" && out != "" {
+				t.Errorf("expected nothing after quit, got\n%s", out)
+			}
+		})
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		want     []string
+		wantOpen bool
+	}{
+		{"", nil, false},
+		{"  keys  ", []string{"keys"}, false},
+		{`use return "Q1 2026"`, []string{"use", "return", "Q1 2026"}, false},
+		{`value 'Total "RDEL"' a.xlsx`, []string{"value", `Total "RDEL"`, "a.xlsx"}, false},
+		{`value "A S`, []string{"value", "A S"}, true},
+	}
+	for _, tt := range tests {
+		words, open := splitLine(tt.line)
+		var got []string
+		for _, w := range words {
+			got = append(got, w.text)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || open != tt.wantOpen {
+			t.Errorf("splitLine(%q) = %q, %v, expected %q, %v", tt.line, got, open, tt.want, tt.wantOpen)
+		}
+	}
+}
+
+func TestShellAutoComplete(t *testing.T) {
+	o := shellOptions(t)
+	s, err := openStore(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := new(bytes.Buffer)
+	sh := &shell{w: buf, store: s, datamap: "DM", ret: "Q1"}
+
+	tests := []struct {
+		line    string
+		want    string
+		wantPos int
+		wantOK  bool
+	}{
+		{"his", "history ", 8, true},
+		{"use r", "use return ", 11, true},
+		{"use return Q", "use return Q1", 13, true},
+		{"use return Q1 ", "", 0, false},
+		{"value A", `value "A `, 9, true},
+		{`value "A S`, `value "A String" `, 17, true},
+		{"master Q1 2", "", 0, false},
+		{"nonsense ", "", 0, false},
+	}
+	for _, tt := range tests {
+		got, pos, ok := sh.autoComplete(tt.line, len(tt.line), '\t')
+		if got != tt.want || pos != tt.wantPos || ok != tt.wantOK {
+			t.Errorf("completing %q = %q, %d, %v, expected %q, %d, %v", tt.line, got, pos, ok, tt.want, tt.wantPos, tt.wantOK)
+		}
+	}
+
+	// Where the candidates share nothing more, they are listed.
+	buf.Reset()
+	if _, _, ok := sh.autoComplete(`value "A `, 9, '\t'); ok || !strings.Contains(buf.String(), "A String  A Float") {
+		t.Errorf("expected the keys to be listed, got %q", buf.String())
+	}
+
+	// Other keys are left to the terminal.
+	if _, _, ok := sh.autoComplete("his", 3, 'x'); ok {
+		t.Error("expected keys other than Tab to be ignored")
+	}
+}
@@ -0,0 +1,164 @@
+package datamaps
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ImportSummary is the outcome of ImportToDB.
+type ImportSummary struct {
+	Return  string `json:"return"`
+	Datamap string `json:"datamap"`
+
+	// Total is the number of files found to import. Fewer are in Files
+	// if the import was stopped.
+	Total int            `json:"total"`
+	Files []ImportedFile `json:"files"`
+
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	Values   int `json:"values"`
+	Warnings int `json:"warnings"`
+
+	// Stopped is true if the import was stopped before every file had
+	// been imported.
+	Stopped bool `json:"stopped"`
+
+	Elapsed time.Duration `json:"-"`
+}
+
+// ImportedFile is the outcome of importing a single file.
+type ImportedFile struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+
+	// Values is the number of values stored.
+	Values int `json:"values"`
+
+	// Warnings describe the datamap lines whose values could not be
+	// stored, or stored as they were found.
+	Warnings []string `json:"warnings"`
+
+	// warnings are Warnings, with the sheet, cell and key of each.
+	warnings []importWarning
+
+	// Error is why the file could not be imported, if it could not.
+	Error string `json:"error,omitempty"`
+}
+
+// Kinds of import warning, which are the messages with which they are
+// logged.
+const (
+	warnNoSuchCell  = "no such cell"
+	warnNoSuchSheet = "sheet not found"
+	warnUnparseable = "cannot parse value"
+)
+
+// importWarning is a warning about a file being imported, giving the sheet,
+// cell and key it concerns.
+type importWarning struct {
+	kind    string
+	sheet   string
+	cellref string
+	key     string
+
+	// keys is the number of keys on a sheet which is not found.
+	keys int
+
+	// err is why a value could not be parsed.
+	err string
+}
+
+// String describes w, as listed in the summary of an import.
+func (w importWarning) String() string {
+	switch w.kind {
+	case warnNoSuchSheet:
+		return fmt.Sprintf("sheet %s not found, so its %d key(s) are missing", w.sheet, w.keys)
+	case warnNoSuchCell:
+		return fmt.Sprintf("%s (%s) is not a cell", w.cellref, w.key)
+	}
+	return fmt.Sprintf("cannot parse %s!%s (%s) - %s", w.sheet, w.cellref, w.key, w.err)
+}
+
+// attrs returns the attributes with which w is logged.
+func (w importWarning) attrs() []any {
+	switch w.kind {
+	case warnNoSuchSheet:
+		return []any{"sheet", w.sheet, "keys", w.keys}
+	case warnNoSuchCell:
+		return []any{"sheet", w.sheet, "cellref", w.cellref, "key", w.key}
+	}
+	return []any{"sheet", w.sheet, "cellref", w.cellref, "key", w.key, "error", w.err}
+}
+
+// importWarnings returns the warnings for the lines of report which could
+// not be read as the datamap expects. Blank cells are not warned about.
+func importWarnings(report *ExtractionReport) []importWarning {
+	warnings := []importWarning{}
+	missingSheets := make(map[string]int)
+	var sheets []string
+	for _, c := range report.Missing {
+		switch c.Error {
+		case errSheetNotFound:
+			if missingSheets[c.Sheet] == 0 {
+				sheets = append(sheets, c.Sheet)
+			}
+			missingSheets[c.Sheet]++
+		case errNoSuchCell:
+			warnings = append(warnings, importWarning{kind: warnNoSuchCell, sheet: c.Sheet, cellref: c.Cellref, key: c.Key})
+		}
+	}
+	for _, sheet := range sheets {
+		warnings = append(warnings, importWarning{kind: warnNoSuchSheet, sheet: sheet, keys: missingSheets[sheet]})
+	}
+	for _, c := range report.Unparseable {
+		warnings = append(warnings, importWarning{kind: warnUnparseable, sheet: c.Sheet, cellref: c.Cellref, key: c.Key, err: c.Error})
+	}
+	return warnings
+}
+
+// writeImportSummary writes a table of the files in summary to w, followed
+// by their warnings and the totals.
+func writeImportSummary(w io.Writer, summary *ImportSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tVALUES\tWARNINGS\tSTATUS")
+	for _, f := range summary.Files {
+		status := "imported"
+		if f.Error != "" {
+			status = "failed: " + f.Error
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", f.Name, f.Values, len(f.Warnings), status)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if summary.Warnings > 0 {
+		fmt.Fprint(w, "\nWarnings:\n")
+		for _, f := range summary.Files {
+			for _, warning := range f.Warnings {
+				fmt.Fprintf(w, "  %s: %s\n", f.Name, warning)
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nImported %d of %d file(s) into return %s in %s: %d value(s) stored, %d warning(s), %d failure(s).\n",
+		summary.Imported, summary.Total, summary.Return, formatClock(summary.Elapsed), summary.Values, summary.Warnings, summary.Failed)
+	if summary.Stopped {
+		b.WriteString("The import was stopped before every file had been imported.\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeImportJSON writes summary to w as JSON.
+func writeImportJSON(w io.Writer, summary *ImportSummary) error {
+	return writeJSON(w, struct {
+		*ImportSummary
+		ElapsedSeconds float64 `json:"elapsed_seconds"`
+	}{summary, summary.Elapsed.Seconds()})
+}
@@ -0,0 +1,133 @@
+package datamaps
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importSummaryOptions returns options importing the test templates, and a
+// file which is not a spreadsheet, with a datamap naming a missing sheet.
+func importSummaryOptions(t *testing.T) *Options {
+	t.Helper()
+	o := newTestDB(t, "Summary Datamap", `cell_key,template_sheet,cell_reference
+A String,Summary,B3
+A Float,Summary,B4
+Nothing Here,Summary,Z99
+Ghost One,Nowhere,A1
+Ghost Two,Nowhere,A2
+`)
+	broken := filepath.Join(t.TempDir(), "broken.xlsx")
+	if err := os.WriteFile(broken, []byte("not a spreadsheet"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o.ReturnName = "Summary Return"
+	o.Files = []string{"./testdata/test_template.xlsx", broken, "./testdata/test_template2.xlsx"}
+	return o
+}
+
+func TestImportSummary(t *testing.T) {
+	o := importSummaryOptions(t)
+
+	buf := new(bytes.Buffer)
+	err := ImportToDB(context.Background(), buf, o)
+	if err == nil || err.Error() != "1 of 3 file(s) could not be imported" {
+		t.Errorf("expected the broken file to be reported, got %v", err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	out := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"FILE VALUES WARNINGS STATUS",
+		"test_template.xlsx 2 1 imported",
+		"broken.xlsx 0 0 failed:",
+		"test_template2.xlsx 2 1 imported",
+		"test_template.xlsx: sheet Nowhere not found, so its 2 key(s) are missing",
+		"Imported 2 of 3 file(s) into return Summary Return in 00:00: 4 value(s) stored, 2 warning(s), 1 failure(s).",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+
+	// The files which could be imported were stored.
+	db, err := sql.Open("sqlite3", o.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM return_data").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 values stored, got %d", count)
+	}
+}
+
+func TestImportSummaryJSON(t *testing.T) {
+	o := importSummaryOptions(t)
+	o.Output = OutputJSON
+
+	buf := new(bytes.Buffer)
+	if err := ImportToDB(context.Background(), buf, o); err == nil {
+		t.Error("expected an error for the broken file")
+	}
+
+	var got struct {
+		ImportSummary
+		ElapsedSeconds *float64 `json:"elapsed_seconds"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("cannot decode %s: %v", buf, err)
+	}
+	if got.Total != 3 || got.Imported != 2 || got.Failed != 1 || got.Values != 4 || got.Warnings != 2 {
+		t.Errorf("unexpected totals in %s", buf)
+	}
+	if got.ElapsedSeconds == nil {
+		t.Errorf("expected elapsed_seconds in %s", buf)
+	}
+	if len(got.Files) != 3 || got.Files[1].Error == "" {
+		t.Errorf("expected the second of three files to have failed in %s", buf)
+	}
+}
+
+func TestImportQuiet(t *testing.T) {
+	o := importSummaryOptions(t)
+	o.Files = o.Files[:1]
+	o.Quiet = true
+
+	buf := new(bytes.Buffer)
+	if err := ImportToDB(context.Background(), buf, o); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing written, got %q", buf)
+	}
+}
+
+func TestFormatClock(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "00:00"},
+		{1499 * time.Millisecond, "00:01"},
+		{2*time.Minute + 5*time.Second, "02:05"},
+		{time.Hour + 2*time.Minute + 3*time.Second, "1:02:03"},
+	}
+	for _, tt := range tests {
+		if got := formatClock(tt.d); got != tt.want {
+			t.Errorf("formatClock(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package datamaps
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// discardLogger is given to the functions whose logs a test does not check.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// setupDB creates the SQLite database at path, if it does not already exist,
+// and brings its schema up to date. Existing data is kept.
+func setupDB(path string) (*sql.DB, error) {
+	s, err := models.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database file %s - %v", path, err)
+	}
+	store := s.(*models.SQLiteStore)
+	if _, err := store.MigrateUp(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store.DB, nil
+}
+
+// newTestDB returns options for a new database in a temporary directory,
+// holding the datamap dmName loaded from the CSV text dm.
+func newTestDB(t *testing.T, dmName, dm string) *Options {
+	t.Helper()
+	dir := t.TempDir()
+	dmPath := filepath.Join(dir, "datamap.csv")
+	if err := os.WriteFile(dmPath, []byte(dm), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Options{
+		DBPath: filepath.Join(dir, "test.db"),
+		DMName: dmName,
+		DMPath: dmPath,
+	}
+	db, err := setupDB(o.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := DatamapToDB(o); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
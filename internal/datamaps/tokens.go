@@ -0,0 +1,83 @@
+package datamaps
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// Tokens manages the API tokens of the user named by --username. The
+// "create" subcommand creates a token named by --tokenname with the scope
+// given by --scope and prints its secret, "list" lists the user's tokens
+// and "revoke" deletes the token with the id given by --id. The output is
+// written to w, as JSON if opts.Output is OutputJSON.
+func Tokens(w io.Writer, opts *Options) error {
+	if opts.UserName == "" {
+		return fmt.Errorf("a user name must be given with --username")
+	}
+
+	s, err := openStore(opts)
+	if err != nil {
+		return fmt.Errorf("cannot open database - %v", err)
+	}
+	defer s.Close()
+
+	user, err := s.GetUserByName(opts.UserName)
+	if err != nil {
+		return fmt.Errorf("cannot find user %s - %v", opts.UserName, err)
+	}
+
+	switch opts.Subcommand {
+	case "create":
+		if opts.TokenName == "" {
+			return fmt.Errorf("a token name must be given with --tokenname")
+		}
+		token, secret, err := s.CreateToken(user.ID, opts.TokenName, opts.Scope)
+		if err != nil {
+			return err
+		}
+		if opts.wantJSON() {
+			return writeJSON(w, struct {
+				Token  models.APIToken `json:"token"`
+				Secret string          `json:"secret"`
+			}{token, secret})
+		}
+		fmt.Fprintln(w, "Keep this token safe - it cannot be shown again.")
+		fmt.Fprintln(w, secret)
+	case "list", "":
+		tokens, _, err := s.Tokens(user.ID, models.ListOptions{})
+		if err != nil {
+			return err
+		}
+		if opts.wantJSON() {
+			return writeJSON(w, struct {
+				Tokens []models.APIToken `json:"tokens"`
+			}{tokens})
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPE\tCREATED\tLAST USED")
+		for _, t := range tokens {
+			lastUsed := "never"
+			if !t.LastUsed.IsZero() {
+				lastUsed = t.LastUsed.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Scope, t.Created.Local().Format(time.DateTime), lastUsed)
+		}
+		return tw.Flush()
+	case "revoke":
+		if err := s.DeleteToken(user.ID, opts.TokenID); err != nil {
+			return fmt.Errorf("cannot revoke token %d - %v", opts.TokenID, err)
+		}
+		if opts.wantJSON() {
+			return writeJSON(w, struct {
+				Revoked int64 `json:"revoked"`
+			}{opts.TokenID})
+		}
+	default:
+		return fmt.Errorf("unknown token command %q - use \"create\", \"list\" or \"revoke\"", opts.Subcommand)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package datamaps
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+	"golang.org/x/term"
+)
+
+// Users manages the users who can log in to the server. The "add"
+// subcommand creates the user named by --username, reading a password from
+// --password-file or else standard input, and "list" lists them on w. Both
+// write JSON to w if opts.Output is OutputJSON.
+func Users(w io.Writer, opts *Options) error {
+	s, err := openStore(opts)
+	if err != nil {
+		return fmt.Errorf("cannot open database - %v", err)
+	}
+	defer s.Close()
+
+	switch opts.Subcommand {
+	case "add":
+		if opts.UserName == "" {
+			return fmt.Errorf("a user name must be given with --username")
+		}
+		password, err := newPassword(opts.PasswordFile)
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return fmt.Errorf("password must not be empty")
+		}
+		id, err := s.InsertUser(opts.UserName, password)
+		if err != nil {
+			return err
+		}
+		if opts.wantJSON() {
+			return writeJSON(w, struct {
+				ID   int64  `json:"id"`
+				Name string `json:"name"`
+			}{id, opts.UserName})
+		}
+		opts.logger().Info("created user", "user", opts.UserName)
+	case "list", "":
+		users, err := s.Users()
+		if err != nil {
+			return err
+		}
+		if opts.wantJSON() {
+			return writeJSON(w, struct {
+				Users []models.User `json:"users"`
+			}{users})
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tCREATED")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", u.ID, u.Name, u.Created.Local().Format(time.DateTime))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown user command %q - use \"add\" or \"list\"", opts.Subcommand)
+	}
+	return nil
+}
+
+// newPassword reads the password for a new user from the file at path, or
+// from standard input if path is empty.
+func newPassword(path string) (string, error) {
+	if path == "" {
+		return readPassword(os.Stdin, os.Stderr)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read password - %v", err)
+	}
+	defer f.Close()
+	return readPassword(f, io.Discard)
+}
+
+// readPassword reads a line from r. If r is a terminal it prompts on w and
+// does not echo what is typed.
+func readPassword(r io.Reader, w io.Writer) (string, error) {
+	if f, ok := r.(interface{ Fd() uintptr }); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(w, "Password: ")
+		b, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(w)
+		return string(b), err
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
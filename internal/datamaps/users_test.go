@@ -0,0 +1,135 @@
+package datamaps
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+func TestReadPassword(t *testing.T) {
+	prompt := new(bytes.Buffer)
+	got, err := readPassword(strings.NewReader("s3cret\r\nignored\n"), prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "s3cret" {
+		t.Errorf("expected s3cret, got %q", got)
+	}
+	if prompt.Len() != 0 {
+		t.Errorf("expected no prompt when not reading a terminal, got %q", prompt.String())
+	}
+}
+
+func TestDatamapOwner(t *testing.T) {
+	db, err := dbSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbTeardown(db)
+	db.Close()
+
+	o := opts
+	o.Subcommand = "add"
+	o.UserName = "alice"
+	o.PasswordFile = filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(o.PasswordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Users(io.Discard, &o); err != nil {
+		t.Fatal(err)
+	}
+
+	o.Owner = "alice"
+	o.Visibility = models.Private
+	if err := DatamapToDB(&o); err != nil {
+		t.Fatal(err)
+	}
+
+	o.Owner = "bob"
+	if err := DatamapToDB(&o); err == nil {
+		t.Error("expected an error importing a datamap for an unknown owner")
+	}
+
+	o.Owner = ""
+	o.Visibility = "secret"
+	if err := DatamapToDB(&o); err == nil {
+		t.Error("expected an error importing a datamap with an invalid visibility")
+	}
+
+	s, err := models.Open(o.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dm, err := s.GetDatamap(o.DMName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := s.GetUserByName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.OwnerID != alice.ID || dm.Visibility != models.Private {
+		t.Errorf("expected a private datamap owned by alice, got %+v", dm)
+	}
+}
+
+func TestDatamapsJSON(t *testing.T) {
+	db, err := dbSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbTeardown(db)
+	db.Close()
+
+	o := opts
+	o.Output = OutputJSON
+	o.Subcommand = "import"
+	buf := new(bytes.Buffer)
+	if err := Datamaps(buf, &o); err != nil {
+		t.Fatal(err)
+	}
+	var imported struct {
+		ID    int64  `json:"id"`
+		Name  string `json:"name"`
+		Path  string `json:"path"`
+		Lines int    `json:"lines"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &imported); err != nil {
+		t.Fatalf("cannot decode %s: %v", buf, err)
+	}
+	if imported.ID == 0 || imported.Name != o.DMName || imported.Path != o.DMPath || imported.Lines == 0 {
+		t.Errorf("unexpected import %s", buf)
+	}
+
+	o.Subcommand = "list"
+	buf.Reset()
+	if err := Datamaps(buf, &o); err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Datamaps []models.Datamap `json:"datamaps"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &list); err != nil {
+		t.Fatalf("cannot decode %s: %v", buf, err)
+	}
+	if len(list.Datamaps) != 1 || list.Datamaps[0].ID != imported.ID {
+		t.Errorf("expected the imported datamap to be listed, got %s", buf)
+	}
+
+	o.Output = OutputText
+	buf.Reset()
+	if err := Datamaps(buf, &o); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "ID") || !strings.Contains(buf.String(), o.DMName) {
+		t.Errorf("expected a table of datamaps, got\n%s", buf)
+	}
+}
@@ -1,153 +1,240 @@
 package datamaps
 
 import (
-	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"os"
 	"path/filepath"
 
+	"git.yulqen.org/go/datamaps-go/internal/models"
 	"github.com/tealeg/xlsx/v3"
 
 	// Needed for the sqlite3 driver
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// CreateMaster creates a master spreadsheet for a specific return given,
-// based on a datamap name - both of which already need to be in the database,
-// along with the data associated with the return. The datamap and return data
-// must already have been imported.
-func CreateMaster(opts *Options) error {
-	wb := xlsx.NewFile()
-	sh, err := wb.AddSheet("Master Data")
-	if err != nil {
-		return fmt.Errorf("cannot add 'Master Data' sheet to new XLSX file: %v", err)
-	}
+// Formats in which a master can be written by WriteMaster.
+const (
+	MasterXLSX = "xlsx"
+	MasterCSV  = "csv"
+	MasterJSON = "json"
+)
 
-	db, err := sql.Open("sqlite3", opts.DBPath)
-	if err != nil {
-		return fmt.Errorf("cannot open database %v", err)
-	}
+var (
+	// ErrNoDatamap is returned when a named datamap is not in the database.
+	ErrNoDatamap = errors.New("no matching datamap found")
 
-	// Get number amount of datamap keys in target datamap
-	keyCountRows := db.QueryRow("SELECT count(key) FROM datamap_line, datamap WHERE datamap.name=?;", opts.DMName)
+	// ErrNoReturn is returned when a named return is not in the database.
+	ErrNoReturn = errors.New("no matching return found")
+)
 
-	var datamapKeysNumber int64
-	if err := keyCountRows.Scan(&datamapKeysNumber); err != nil {
-		return err
-	}
+// Master is the data required to write a master spreadsheet: every key in
+// a datamap against the value for that key in each file of a return.
+type Master struct {
+	// Datamap is the name of the datamap used to create the master.
+	Datamap string
 
-	datamapKeysRows, err := db.Query("SELECT key FROM datamap_line, datamap WHERE datamap.name=?;", opts.DMName)
-	if err != nil {
-		return fmt.Errorf("cannot query for keys in database - %v", err)
-	}
+	// Return is the name of the return whose data is in the master.
+	Return string
+
+	// Files are the names of the files in the return, in the order
+	// they appear as columns in the master.
+	Files []string
 
-	var datamapKeys []string
+	// Keys are the datamap keys, in the order they appear as rows
+	// in the master.
+	Keys []string
 
-	var i int64
-	for i = 0; i < datamapKeysNumber; i++ {
-		if k := datamapKeysRows.Next(); k {
-			var key string
-			if err := datamapKeysRows.Scan(&key); err != nil {
-				return fmt.Errorf("cannot Scan for key %s - %v", key, err)
-			}
-			datamapKeys = append(datamapKeys, key)
+	// values maps each key to a map of filename to formatted value.
+	values map[string]map[string]string
+}
+
+// Value returns the formatted value for key in file, or an empty
+// string if the file has no value for that key.
+func (m *Master) Value(key, file string) string {
+	return m.values[key][file]
+}
+
+// Rows returns the master as a grid of strings. The first row is a header
+// containing the filenames and the first column contains the keys.
+func (m *Master) Rows() [][]string {
+	out := make([][]string, 0, len(m.Keys)+1)
+	out = append(out, append([]string{""}, m.Files...))
+
+	for _, k := range m.Keys {
+		row := make([]string, 0, len(m.Files)+1)
+		row = append(row, k)
+		for _, f := range m.Files {
+			row = append(row, m.Value(k, f))
 		}
+		out = append(out, row)
 	}
+	return out
+}
 
-	sqlCount := `SELECT count(return_data.id)
-                                          FROM (((return_data
-                                          INNER JOIN datamap_line ON return_data.dml_id=datamap_line.id)
-                                          INNER JOIN datamap ON datamap_line.dm_id=datamap.id)
-                                          INNER JOIN return on return_data.ret_id=return.id)
-                                          WHERE datamap.name=? AND return.name=?;`
+// AssembleMaster gathers the data for a master for the return named returnName,
+// based on the datamap named dmName - both of which already need to be in s,
+// along with the data associated with the return.
+func AssembleMaster(dmName, returnName string, s models.Store) (*Master, error) {
+	m := &Master{
+		Datamap: dmName,
+		Return:  returnName,
+		Files:   []string{},
+		Keys:    []string{},
+		values:  make(map[string]map[string]string),
+	}
 
-	var rowCount int64
-	rowCountRes := db.QueryRow(sqlCount, opts.DMName, opts.ReturnName)
+	lines, err := s.DatamapLines(dmName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query for keys in database - %v", err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoDatamap, dmName)
+	}
+	for _, l := range lines {
+		m.Keys = append(m.Keys, l.Key)
+	}
 
-	if err := rowCountRes.Scan(&rowCount); err != nil {
-		return err
+	if _, err := s.GetReturn(returnName); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return nil, fmt.Errorf("%w: %s", ErrNoReturn, returnName)
+		}
+		return nil, err
 	}
 
-	getDataSQL := `SELECT datamap_line.key, return_data.vFormatted, return_data.filename
-                                          FROM (((return_data
-                                          INNER JOIN datamap_line ON return_data.dml_id=datamap_line.id) 
-                                          INNER JOIN datamap ON datamap_line.dm_id=datamap.id) 
-                                          INNER JOIN return on return_data.ret_id=return.id) 
-                                          WHERE datamap.name=? AND return.name=? AND datamap_line.key=?
-										  ORDER BY return_data.filename;`
+	values, err := s.ReturnValues(dmName, returnName)
+	if err != nil {
+		return nil, err
+	}
 
 	seen := make(map[string]struct{}) // homemade Set https://emersion.fr/blog/2017/sets-in-go/
 
-	var values = make(map[string][]string)
-	headerSlice := make([]string, 0)
-	for _, k := range datamapKeys {
-		masterData, err := db.Query(getDataSQL, opts.DMName, opts.ReturnName, k)
-		if err != nil {
-			return err
+	for _, v := range values {
+		if _, ok := m.values[v.Key]; !ok {
+			m.values[v.Key] = make(map[string]string)
+		}
+		m.values[v.Key][v.Filename] = v.Formatted
+		if _, ok := seen[v.Filename]; !ok {
+			m.Files = append(m.Files, v.Filename)
+			seen[v.Filename] = struct{}{}
 		}
-		for masterData.Next() {
-			var key, filename, fmttedValue string
-			if err := masterData.Scan(&key, &fmttedValue, &filename); err != nil {
-				fmt.Errorf("Problem scanning data from database for master: %v", err)
-			}
-			values, err = appendValueMap(key, fmttedValue, values)
-			if _, ok := seen[filename]; !ok {
-				headerSlice = append(headerSlice, filename)
-				seen[filename] = struct{}{}
-			}
-			if err != nil {
-				return err
-			}
+	}
+
+	return m, nil
+}
+
+// WriteMaster writes the master m to w in format, which must be
+// one of MasterXLSX, MasterCSV or MasterJSON.
+func WriteMaster(w io.Writer, m *Master, format string) error {
+	switch format {
+	case MasterXLSX:
+		return writeMasterXLSX(w, m)
+	case MasterCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.WriteAll(m.Rows()); err != nil {
+			return fmt.Errorf("cannot write master as CSV: %v", err)
 		}
+		return nil
+	case MasterJSON:
+		return writeMasterJSON(w, m)
+	default:
+		return fmt.Errorf("%q is not a supported master format", format)
+	}
+}
+
+func writeMasterXLSX(w io.Writer, m *Master) error {
+	wb := xlsx.NewFile()
+	sh, err := wb.AddSheet("Master Data")
+	if err != nil {
+		return fmt.Errorf("cannot add 'Master Data' sheet to new XLSX file: %v", err)
 	}
+	defer sh.Close()
 
-	for masterRow := 0; masterRow <= len(datamapKeys); masterRow++ {
+	for masterRow, row := range m.Rows() {
 		r, err := sh.AddRowAtIndex(masterRow)
 		if err != nil {
 			return fmt.Errorf("cannot create row %d in output spreadsheet: %v", masterRow, err)
 		}
-		if masterRow == 0 {
-			if hdr := r.WriteSlice(append([]string{""}, headerSlice...), -1); hdr == -1 {
-				return fmt.Errorf("cannot write header values into header row: %v", err)
-			}
-			continue
-		}
-		dmlKey := datamapKeys[masterRow-1]
 
 		// TODO - we need to format the cells here too, e.g. dates
-		if sl := r.WriteSlice(append([]string{dmlKey}, values[dmlKey]...), -1); sl == -1 {
-			log.Printf("not a slice type")
+		if sl := r.WriteSlice(row, -1); sl == -1 {
+			return fmt.Errorf("cannot write values into row %d", masterRow)
 		}
 	}
 
-	log.Printf("saving master at %s", opts.MasterOutPutPath)
-	if err := wb.Save(filepath.Join(opts.MasterOutPutPath, "master.xlsx")); err != nil {
-		log.Fatalf("cannot save file to %s", opts.MasterOutPutPath)
-	}
-	sh.Close()
-	return nil
+	return wb.Write(w)
 }
 
-func appendValueMap(k, v string, values map[string][]string) (map[string][]string, error) {
+// masterJSONRow is a single key in a master, as written by writeMasterJSON.
+type masterJSONRow struct {
+	Key    string            `json:"key"`
+	Values map[string]string `json:"values"`
+}
 
-	var keyIn bool
-	for kv := range values {
-		if kv == k {
-			keyIn = true
-			break
+func writeMasterJSON(w io.Writer, m *Master) error {
+	rows := make([]masterJSONRow, 0, len(m.Keys))
+	for _, k := range m.Keys {
+		values := make(map[string]string, len(m.Files))
+		for _, f := range m.Files {
+			values[f] = m.Value(k, f)
 		}
+		rows = append(rows, masterJSONRow{Key: k, Values: values})
 	}
 
-	if keyIn {
-		slice, ok := values[k]
-		if !ok {
-			return nil, fmt.Errorf("%s is not a key in this map", k)
-		}
-		slice = append(slice, v)
-		values[k] = slice
-		return values, nil
-	} else {
-		values[k] = []string{v}
-		return values, nil
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(struct {
+		Datamap string          `json:"datamap"`
+		Return  string          `json:"return"`
+		Files   []string        `json:"files"`
+		Rows    []masterJSONRow `json:"rows"`
+	}{m.Datamap, m.Return, m.Files, rows})
+}
+
+// CreateMaster creates a master spreadsheet for a specific return given,
+// based on a datamap name - both of which already need to be in the database,
+// along with the data associated with the return. The datamap and return data
+// must already have been imported. The master is saved as master.xlsx in
+// opts.MasterOutPutPath. If opts.Output is OutputJSON, where it was saved and
+// what it holds are written to w.
+func CreateMaster(w io.Writer, opts *Options) error {
+	s, err := openStore(opts)
+	if err != nil {
+		return fmt.Errorf("cannot open database %v", err)
+	}
+	defer s.Close()
+
+	m, err := AssembleMaster(opts.DMName, opts.ReturnName, s)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(opts.MasterOutPutPath, "master.xlsx")
+	opts.logger().Info("saving master", "path", path)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot save file to %s - %v", opts.MasterOutPutPath, err)
 	}
+
+	if err := WriteMaster(f, m, MasterXLSX); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if opts.wantJSON() {
+		return writeJSON(w, struct {
+			Path    string   `json:"path"`
+			Datamap string   `json:"datamap"`
+			Return  string   `json:"return"`
+			Files   []string `json:"files"`
+			Keys    int      `json:"keys"`
+		}{path, m.Datamap, m.Return, m.Files, len(m.Keys)})
+	}
+	return nil
 }
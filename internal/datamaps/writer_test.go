@@ -1,13 +1,20 @@
 package datamaps
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"git.yulqen.org/go/datamaps-go/internal/models"
 	"github.com/tealeg/xlsx/v3"
 )
 
@@ -22,7 +29,7 @@ func testSetup() (*Options, error) {
 	_, err := setupDB("./testdata/test.db")
 
 	if err != nil {
-		fmt.Errorf("expected to be able to set up the database")
+		return nil, fmt.Errorf("expected to be able to set up the database - %v", err)
 	}
 
 	opts := Options{
@@ -35,11 +42,11 @@ func testSetup() (*Options, error) {
 	}
 
 	if err := DatamapToDB(&opts); err != nil {
-		fmt.Errorf("unable to write datamap to database file because %v", err)
+		return nil, fmt.Errorf("unable to write datamap to database file because %v", err)
 	}
 
-	if err := ImportToDB(&opts); err != nil {
-		fmt.Errorf("cannot read test XLSX files needed before exporting to master - %v", err)
+	if err := ImportToDB(context.Background(), io.Discard, &opts); err != nil {
+		return nil, fmt.Errorf("cannot read test XLSX files needed before exporting to master - %v", err)
 	}
 	return &opts, nil
 }
@@ -59,7 +66,7 @@ func TestWriteMaster(t *testing.T) {
 		os.Remove("./testdata/test.db")
 	}()
 
-	if err := CreateMaster(opts); err != nil {
+	if err := CreateMaster(io.Discard, opts); err != nil {
 		t.Fatal(err)
 	}
 
@@ -193,3 +200,73 @@ func rowVisitorTest(r *xlsx.Row) error {
 	}
 	return nil
 }
+
+func TestWriteMasterFormats(t *testing.T) {
+	opts, err := testSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./testdata/test.db")
+
+	db, err := models.Open(opts.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := AssembleMaster(opts.DMName, opts.ReturnName, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.Value("A Vunt String", "test_template.xlsx"); got != "VUNT" {
+		t.Errorf("expected VUNT for A Vunt String in test_template.xlsx, got %q", got)
+	}
+
+	var csvOut bytes.Buffer
+	if err := WriteMaster(&csvOut, m, MasterCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&csvOut).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(m.Keys)+1 {
+		t.Errorf("expected %d rows in CSV master, got %d", len(m.Keys)+1, len(rows))
+	}
+	if len(rows[0]) != len(m.Files)+1 {
+		t.Errorf("expected %d columns in CSV master, got %d", len(m.Files)+1, len(rows[0]))
+	}
+
+	var jsonOut bytes.Buffer
+	if err := WriteMaster(&jsonOut, m, MasterJSON); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Return string
+		Rows   []struct {
+			Key    string
+			Values map[string]string
+		}
+	}
+	if err := json.Unmarshal(jsonOut.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Return != opts.ReturnName {
+		t.Errorf("expected return %s in JSON master, got %s", opts.ReturnName, doc.Return)
+	}
+	if len(doc.Rows) != len(m.Keys) {
+		t.Errorf("expected %d rows in JSON master, got %d", len(m.Keys), len(doc.Rows))
+	}
+
+	if err := WriteMaster(io.Discard, m, "pdf"); err == nil {
+		t.Error("expected an error writing a master in an unsupported format")
+	}
+
+	if _, err := AssembleMaster(opts.DMName, "No Such Return", db); !errors.Is(err, ErrNoReturn) {
+		t.Errorf("expected ErrNoReturn, got %v", err)
+	}
+	if _, err := AssembleMaster("No Such Datamap", opts.ReturnName, db); !errors.Is(err, ErrNoDatamap) {
+		t.Errorf("expected ErrNoDatamap, got %v", err)
+	}
+}
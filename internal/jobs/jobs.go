@@ -0,0 +1,297 @@
+// Package jobs runs long pieces of work, such as imports, in the background.
+// Jobs are queued in the database, through a models.JobStore, and run by a
+// pool of workers in the server process. A running job is stopped by
+// cancelling the context passed to its Func. Workers keep a heartbeat for the
+// jobs they run, so that a job whose worker has gone, and only such a job,
+// is queued again, even when several processes share the queue.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// ErrUnknownKind is returned when queueing a job of a kind which has no Func.
+var ErrUnknownKind = errors.New("jobs: unknown kind of job")
+
+// defaultPollInterval is how often idle workers look for jobs queued by
+// other processes.
+const defaultPollInterval = 5 * time.Second
+
+// defaultLease is how long a running job may go without a heartbeat from
+// its worker before it is queued again.
+const defaultLease = time.Minute
+
+// Func runs a job. It reports how far it has got through progress and
+// should stop, returning ctx.Err(), once ctx is cancelled.
+type Func func(ctx context.Context, job models.Job, progress Progress) (Result, error)
+
+// Progress records that done of total steps of a job have been completed.
+type Progress func(done, total int)
+
+// Result is the output of a job which has succeeded.
+type Result struct {
+	// Type is the media type of Data.
+	Type string
+	Data []byte
+}
+
+// Runner queues jobs and runs them in a pool of workers.
+type Runner struct {
+	store   models.JobStore
+	logger  *slog.Logger
+	workers int
+
+	// PollInterval is how often idle workers look for jobs queued by
+	// other processes. Jobs queued through the Runner wake a worker at
+	// once.
+	PollInterval time.Duration
+
+	// Lease is how long a running job may go without a heartbeat before
+	// its worker is taken to have gone and the job is queued again. The
+	// jobs run by the Runner are given a heartbeat every third of Lease.
+	Lease time.Duration
+
+	// OnFinish, if set, is called with each job which succeeds, fails or
+	// is cancelled once its status has been recorded. It is not called for
+	// jobs interrupted by Run stopping.
+	OnFinish func(models.Job)
+
+	funcs map[string]Func
+	wake  chan struct{}
+
+	mu      sync.Mutex
+	running map[int64]context.CancelFunc
+}
+
+// NewRunner returns a Runner which runs jobs from store, workers at a time.
+func NewRunner(store models.JobStore, logger *slog.Logger, workers int) *Runner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Runner{
+		store:        store,
+		logger:       logger,
+		workers:      workers,
+		PollInterval: defaultPollInterval,
+		Lease:        defaultLease,
+		funcs:        make(map[string]Func),
+		wake:         make(chan struct{}, 1),
+		running:      make(map[int64]context.CancelFunc),
+	}
+}
+
+// Register sets the Func which runs jobs of kind. It must be called before
+// Run.
+func (r *Runner) Register(kind string, fn Func) {
+	r.funcs[kind] = fn
+}
+
+// Enqueue queues j, along with the files it works on, and returns it with
+// its ID set.
+func (r *Runner) Enqueue(j models.Job, files []models.JobFile) (models.Job, error) {
+	if _, ok := r.funcs[j.Kind]; !ok {
+		return models.Job{}, fmt.Errorf("%w: %s", ErrUnknownKind, j.Kind)
+	}
+	j, err := r.store.InsertJob(j, files)
+	if err != nil {
+		return models.Job{}, err
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return j, nil
+}
+
+// Cancel asks the job with id to stop, cancelling its context if it is
+// running in this process, and returns the job. models.ErrJobFinished is
+// returned if it has already finished.
+func (r *Runner) Cancel(id int64) (models.Job, error) {
+	j, err := r.store.CancelJob(id)
+	if err != nil {
+		return j, err
+	}
+
+	r.mu.Lock()
+	cancel, ok := r.running[id]
+	r.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return j, nil
+}
+
+// Run runs queued jobs until ctx is cancelled, queueing again any whose
+// worker has gone. It returns once every worker has stopped. Jobs
+// interrupted by ctx being cancelled are left running, to be queued again
+// once their lease has expired.
+func (r *Runner) Run(ctx context.Context) error {
+	if err := r.requeue(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for range r.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.keepLeases(ctx)
+	}()
+	wg.Wait()
+	return nil
+}
+
+// requeue queues again the running jobs whose lease has expired.
+func (r *Runner) requeue() error {
+	n, err := r.store.RequeueJobs(time.Now().Add(-r.Lease))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		r.logger.Info("requeued abandoned jobs", "count", n)
+	}
+	return nil
+}
+
+// keepLeases gives the jobs running in this process a heartbeat, and queues
+// again those whose lease has expired, every third of r.Lease until ctx is
+// cancelled.
+func (r *Runner) keepLeases(ctx context.Context) {
+	t := time.NewTicker(r.Lease / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		r.mu.Lock()
+		ids := make([]int64, 0, len(r.running))
+		for id := range r.running {
+			ids = append(ids, id)
+		}
+		r.mu.Unlock()
+		for _, id := range ids {
+			if err := r.store.HeartbeatJob(id); err != nil {
+				r.logger.Error("cannot record job heartbeat", "id", id, "error", err)
+			}
+		}
+		if err := r.requeue(); err != nil {
+			r.logger.Error("cannot requeue abandoned jobs", "error", err)
+		}
+	}
+}
+
+// work runs queued jobs one at a time until ctx is cancelled.
+func (r *Runner) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		j, err := r.store.ClaimJob()
+		if err == nil {
+			r.run(ctx, j)
+			continue
+		}
+		if !errors.Is(err, models.ErrNoRecord) {
+			r.logger.Error("cannot claim job", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-r.wake:
+		case <-time.After(r.PollInterval):
+		}
+	}
+}
+
+// run runs the claimed job j and records how it finished.
+func (r *Runner) run(ctx context.Context, j models.Job) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r.mu.Lock()
+	r.running[j.ID] = cancel
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.running, j.ID)
+		r.mu.Unlock()
+	}()
+
+	// The job may have been cancelled while it was being claimed, or by
+	// another process since, so check on it whenever it makes progress.
+	cancelIfRequested := func() {
+		if current, err := r.store.GetJob(j.ID); err == nil && current.CancelRequested {
+			cancel()
+		}
+	}
+	cancelIfRequested()
+
+	progress := func(done, total int) {
+		if err := r.store.UpdateJobProgress(j.ID, done, total); err != nil {
+			r.logger.Error("cannot record job progress", "id", j.ID, "error", err)
+		}
+		cancelIfRequested()
+	}
+
+	logger := r.logger.With("id", j.ID, "kind", j.Kind)
+	logger.Info("starting job")
+	result, err := r.call(jobCtx, j, progress)
+
+	var finishErr error
+	switch {
+	case ctx.Err() != nil:
+		logger.Info("interrupted job")
+		return
+	case jobCtx.Err() != nil:
+		logger.Info("cancelled job")
+		finishErr = r.store.FinishJob(j.ID, models.JobCancelled, "", "", nil)
+	case err != nil:
+		logger.Info("failed job", "error", err)
+		finishErr = r.store.FinishJob(j.ID, models.JobFailed, err.Error(), "", nil)
+	default:
+		logger.Info("finished job")
+		finishErr = r.store.FinishJob(j.ID, models.JobSucceeded, "", result.Type, result.Data)
+	}
+	if finishErr != nil {
+		logger.Error("cannot record job status", "error", finishErr)
+		return
+	}
+
+	if r.OnFinish != nil {
+		finished, err := r.store.GetJob(j.ID)
+		if err != nil {
+			logger.Error("cannot read finished job", "error", err)
+			return
+		}
+		r.OnFinish(finished)
+	}
+}
+
+// call runs the Func for j, turning a panic into an error so that one bad
+// job does not stop the worker.
+func (r *Runner) call(ctx context.Context, j models.Job, progress Progress) (result Result, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	fn, ok := r.funcs[j.Kind]
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %s", ErrUnknownKind, j.Kind)
+	}
+	return fn(ctx, j, progress)
+}
@@ -0,0 +1,226 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// newTestRunner returns a Runner using a migrated SQLite database in a
+// temporary directory, with a Func registered for each kind in funcs.
+func newTestRunner(t *testing.T, funcs map[string]Func) (*Runner, models.Store) {
+	t.Helper()
+
+	store, err := models.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(store, slog.New(slog.NewTextHandler(io.Discard, nil)), 2)
+	r.PollInterval = 10 * time.Millisecond
+	for kind, fn := range funcs {
+		r.Register(kind, fn)
+	}
+	return r, store
+}
+
+// start runs r until the test ends.
+func start(t *testing.T, r *Runner) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// waitFor waits for the job with id to reach status, failing the test if it
+// takes too long.
+func waitFor(t *testing.T, store models.Store, id int64, status string) models.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, err := store.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == status {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected job %d to be %s, it is %s", id, status, j.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	started := make(chan struct{})
+	r, store := newTestRunner(t, map[string]Func{
+		"echo": func(ctx context.Context, j models.Job, progress Progress) (Result, error) {
+			progress(1, 1)
+			return Result{Type: "application/json", Data: j.Params}, nil
+		},
+		"fail": func(ctx context.Context, j models.Job, progress Progress) (Result, error) {
+			return Result{}, errors.New("bobbins")
+		},
+		"panic": func(ctx context.Context, j models.Job, progress Progress) (Result, error) {
+			panic("oh no")
+		},
+		"block": func(ctx context.Context, j models.Job, progress Progress) (Result, error) {
+			close(started)
+			<-ctx.Done()
+			return Result{}, ctx.Err()
+		},
+	})
+
+	if _, err := r.Enqueue(models.Job{Kind: "bobbins"}, nil); !errors.Is(err, ErrUnknownKind) {
+		t.Errorf("expected ErrUnknownKind, got %v", err)
+	}
+
+	start(t, r)
+
+	j, err := r.Enqueue(models.Job{Kind: "echo", Params: []byte(`{"a":1}`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j = waitFor(t, store, j.ID, models.JobSucceeded)
+	if j.Done != 1 || j.Total != 1 || j.Finished.IsZero() {
+		t.Errorf("unexpected finished job %+v", j)
+	}
+	if typ, data, err := store.JobResult(j.ID); err != nil || typ != "application/json" || string(data) != `{"a":1}` {
+		t.Errorf("unexpected result %q %q, %v", typ, data, err)
+	}
+
+	j, err = r.Enqueue(models.Job{Kind: "fail"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j = waitFor(t, store, j.ID, models.JobFailed); j.Error != "bobbins" {
+		t.Errorf("expected error bobbins, got %q", j.Error)
+	}
+
+	j, err = r.Enqueue(models.Job{Kind: "panic"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j = waitFor(t, store, j.ID, models.JobFailed); j.Error != "job panicked: oh no" {
+		t.Errorf("unexpected error %q", j.Error)
+	}
+
+	j, err = r.Enqueue(models.Job{Kind: "block"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if _, err := r.Cancel(j.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, store, j.ID, models.JobCancelled)
+	if _, err := r.Cancel(j.ID); !errors.Is(err, models.ErrJobFinished) {
+		t.Errorf("expected ErrJobFinished cancelling a cancelled job, got %v", err)
+	}
+}
+
+func TestRunnerOnFinish(t *testing.T) {
+	r, store := newTestRunner(t, map[string]Func{
+		"fail": func(ctx context.Context, j models.Job, progress Progress) (Result, error) {
+			return Result{}, errors.New("bobbins")
+		},
+	})
+	finished := make(chan models.Job, 1)
+	r.OnFinish = func(j models.Job) { finished <- j }
+	start(t, r)
+
+	j, err := r.Enqueue(models.Job{Kind: "fail"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-finished:
+		if got.ID != j.ID || got.Status != models.JobFailed || got.Error != "bobbins" {
+			t.Errorf("unexpected finished job %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected OnFinish to be called")
+	}
+	waitFor(t, store, j.ID, models.JobFailed)
+}
+
+func TestRunnerRequeues(t *testing.T) {
+	r, store := newTestRunner(t, map[string]Func{
+		"echo": func(ctx context.Context, j models.Job, progress Progress) (Result, error) {
+			return Result{Type: "text/plain", Data: []byte("ok")}, nil
+		},
+	})
+	r.Lease = 50 * time.Millisecond
+
+	// A job claimed by a worker which then stopped is left running, and
+	// queued again once its lease expires.
+	j, err := store.InsertJob(models.Job{Kind: "echo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ClaimJob(); err != nil {
+		t.Fatal(err)
+	}
+
+	start(t, r)
+	waitFor(t, store, j.ID, models.JobSucceeded)
+}
+
+func TestRunnersShareQueue(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	started := make(chan struct{}, 1)
+	block := func(ctx context.Context, j models.Job, progress Progress) (Result, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		started <- struct{}{}
+		<-ctx.Done()
+		return Result{}, ctx.Err()
+	}
+	first, store := newTestRunner(t, map[string]Func{"block": block})
+	first.Lease = 50 * time.Millisecond
+	start(t, first)
+
+	j, err := first.Enqueue(models.Job{Kind: "block"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// A second process starting must leave the job running in the first
+	// alone, however long it runs.
+	second := NewRunner(store, slog.New(slog.NewTextHandler(io.Discard, nil)), 1)
+	second.PollInterval, second.Lease = 10*time.Millisecond, 50*time.Millisecond
+	second.Register("block", block)
+	start(t, second)
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, err := store.GetJob(j.ID); err != nil || got.Status != models.JobRunning || calls != 1 {
+		t.Errorf("expected the job to be running once, got %+v, %v, run %d times", got, err, calls)
+	}
+}
@@ -0,0 +1,71 @@
+package models
+
+import "fmt"
+
+// ForeignKeyViolation is a row which refers to a row that does not exist.
+type ForeignKeyViolation struct {
+	// Table is the table holding the row.
+	Table string
+
+	// RowID is the id of the row.
+	RowID int64
+
+	// Parent is the table holding the missing row.
+	Parent string
+}
+
+func (v ForeignKeyViolation) String() string {
+	return fmt.Sprintf("%s row %d refers to a missing %s row", v.Table, v.RowID, v.Parent)
+}
+
+// orphanedReturnData selects the return_data rows whose datamap line or
+// return does not exist.
+const orphanedReturnData = `
+	NOT EXISTS (SELECT 1 FROM datamap_line WHERE datamap_line.id = return_data.dml_id)
+	OR NOT EXISTS (SELECT 1 FROM return WHERE return.id = return_data.ret_id)`
+
+// OrphanedReturnData returns the number of return_data rows whose datamap
+// line or return does not exist.
+func (s *sqlStore) OrphanedReturnData() (int, error) {
+	var n int
+	err := s.DB.QueryRow("SELECT COUNT(*) FROM return_data WHERE" + orphanedReturnData).Scan(&n)
+	return n, err
+}
+
+// DeleteOrphanedReturnData deletes the return_data rows counted by
+// OrphanedReturnData and returns how many were deleted.
+func (s *sqlStore) DeleteOrphanedReturnData() (int64, error) {
+	res, err := s.DB.Exec("DELETE FROM return_data WHERE" + orphanedReturnData)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ForeignKeyViolations returns the rows found by SQLite's foreign key
+// check. Databases written before foreign keys were turned on can have
+// them.
+func (s *SQLiteStore) ForeignKeyViolations() ([]ForeignKeyViolation, error) {
+	rows, err := s.DB.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var violations []ForeignKeyViolation
+	for rows.Next() {
+		var v ForeignKeyViolation
+		var fkid int
+		if err := rows.Scan(&v.Table, &v.RowID, &v.Parent, &fkid); err != nil {
+			return nil, err
+		}
+		violations = append(violations, v)
+	}
+	return violations, rows.Err()
+}
+
+// ForeignKeyViolations returns no rows, as PostgreSQL checks foreign keys
+// whenever rows are written.
+func (s *PostgresStore) ForeignKeyViolations() ([]ForeignKeyViolation, error) {
+	return nil, nil
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckOrphans(t *testing.T) {
+	// Without _foreign_keys=on, as databases written by older versions
+	// of datamaps were.
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSQLiteStore(db)
+	defer s.Close()
+	if _, err := s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, testLines); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := s.DatamapLines("Tonk 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GetOrCreateReturn("Q1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []ReturnData{
+		{DatamapLineID: lines[0].ID, ReturnID: r.ID, Filename: "a.xlsx", Value: "Bobbins"},
+		{DatamapLineID: lines[1].ID, ReturnID: r.ID + 1, Filename: "a.xlsx", Value: "Tonk"},
+		{DatamapLineID: lines[2].ID + 10, ReturnID: r.ID, Filename: "a.xlsx", Value: "2.2"},
+	}
+	if err := s.InsertReturnData(data); err != nil {
+		t.Fatal(err)
+	}
+
+	violations, err := s.ForeignKeyViolations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 2 {
+		t.Fatalf("expected 2 foreign key violations, got %v", violations)
+	}
+	if violations[0].Table != "return_data" {
+		t.Errorf("expected a violation in return_data, got %v", violations[0])
+	}
+
+	n, err := s.OrphanedReturnData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 orphaned rows, got %d", n)
+	}
+
+	deleted, err := s.DeleteOrphanedReturnData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 rows to be deleted, got %d", deleted)
+	}
+	if violations, err := s.ForeignKeyViolations(); err != nil || len(violations) != 0 {
+		t.Errorf("expected no violations once orphans are deleted, got %v, %v", violations, err)
+	}
+	values, err := s.ReturnValues("Tonk 1", "Q1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0].Value != "Bobbins" {
+		t.Errorf("expected the valid row to be kept, got %v", values)
+	}
+}
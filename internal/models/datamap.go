@@ -1,24 +1,51 @@
 package models
 
-import (
-	"database/sql"
-	"time"
-)
+import "time"
+
+// DatamapLine - a line from the datamap.
+type DatamapLine struct {
+	ID      int64  `json:"id"`
+	Key     string `json:"key"`
+	Sheet   string `json:"sheet"`
+	Cellref string `json:"cellref"`
 
-// datamapLine - a line from the datamap.
-type datamapLine struct {
-	Key     string
-	Sheet   string
-	Cellref string
+	// Type is the type of value expected in the cell, one of LineTypes,
+	// or empty if it is not checked.
+	Type string `json:"type,omitempty"`
 }
 
+// Types of value expected in a datamap line's cell.
+const (
+	TypeText   = "TEXT"
+	TypeNumber = "NUMBER"
+	TypeDate   = "DATE"
+)
+
+// LineTypes are the types a datamap line can have.
+var LineTypes = []string{TypeText, TypeNumber, TypeDate}
+
+// Datamap is a named set of datamap lines.
 type Datamap struct {
-	ID          int
-	Name        string
-	Description string
-	Created     time.Time
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// OwnerID is the id of the user who owns the datamap, or 0 if it
+	// has no owner and can be seen by everyone.
+	OwnerID int64 `json:"owner_id,omitempty"`
+
+	// Visibility is Public or Private.
+	Visibility string `json:"visibility"`
+}
+
+// VisibleTo reports whether the user with id userID can see dm.
+func (dm Datamap) VisibleTo(userID int64) bool {
+	return visibleTo(dm.OwnerID, dm.Visibility, userID)
 }
 
-type DatamapModel struct {
-	DB *sql.DB
+// LineMatch is a datamap line found by a search, along with the name of
+// the datamap it belongs to.
+type LineMatch struct {
+	DatamapLine
+	Datamap string `json:"datamap"`
 }
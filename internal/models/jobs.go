@@ -0,0 +1,280 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Statuses of jobs.
+const (
+	// JobQueued jobs are waiting for a worker.
+	JobQueued = "queued"
+
+	// JobRunning jobs are being run by a worker.
+	JobRunning = "running"
+
+	// JobSucceeded jobs finished without an error and have a result.
+	JobSucceeded = "succeeded"
+
+	// JobFailed jobs finished with the error in Job.Error.
+	JobFailed = "failed"
+
+	// JobCancelled jobs were cancelled before they finished.
+	JobCancelled = "cancelled"
+)
+
+// ErrJobFinished is returned when cancelling a job which has already
+// finished.
+var ErrJobFinished = errors.New("models: job has finished")
+
+// Job is a long-running piece of work, such as an import, queued to be run
+// in the background.
+type Job struct {
+	ID int64 `json:"id"`
+
+	// UserID is the id of the user who queued the job.
+	UserID int64 `json:"user_id"`
+
+	// Kind names the function which runs the job.
+	Kind string `json:"kind"`
+
+	// Params are the JSON encoded parameters of the job, which depend on
+	// its Kind.
+	Params json.RawMessage `json:"params"`
+
+	Status string `json:"status"`
+
+	// Done is the number of Total steps of the job which have been
+	// completed.
+	Done  int `json:"done"`
+	Total int `json:"total"`
+
+	// Error is why the job failed.
+	Error string `json:"error"`
+
+	// CancelRequested is set when the job has been asked to stop.
+	CancelRequested bool `json:"cancel_requested"`
+
+	// ResultType is the media type of the result of a job which has
+	// succeeded.
+	ResultType string `json:"result_type"`
+
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// IsFinished reports whether j will not be run any further.
+func (j Job) IsFinished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+// JobFile is a file uploaded for a job to work on.
+type JobFile struct {
+	Filename string
+	Data     []byte
+
+	// Open, if set, opens the file's data, which is read in place of Data
+	// when the job is stored, so that only one file at a time is held in
+	// memory.
+	Open func() (io.ReadCloser, error)
+}
+
+// data returns the data of f.
+func (f JobFile) data() ([]byte, error) {
+	if f.Open == nil {
+		return f.Data, nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *sqlStore) InsertJob(j Job, files []JobFile) (Job, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return Job{}, err
+	}
+	defer tx.Rollback()
+
+	if j.Params == nil {
+		j.Params = json.RawMessage("{}")
+	}
+	j.Status = JobQueued
+	j.Created = time.Now().UTC()
+	err = tx.QueryRow(s.bind("INSERT INTO jobs (user_id, kind, params, status, created) VALUES(?,?,?,?,?) RETURNING id"),
+		nullID(j.UserID), j.Kind, string(j.Params), j.Status, j.Created).Scan(&j.ID)
+	if err != nil {
+		return Job{}, err
+	}
+
+	for _, f := range files {
+		data, err := f.data()
+		if err != nil {
+			return Job{}, fmt.Errorf("cannot read %s - %v", f.Filename, err)
+		}
+		if _, err := tx.Exec(s.bind("INSERT INTO job_files (job_id, filename, data) VALUES(?,?,?)"), j.ID, f.Filename, data); err != nil {
+			return Job{}, err
+		}
+	}
+	return j, tx.Commit()
+}
+
+// jobColumns are the columns read by scanJob.
+const jobColumns = "jobs.id, jobs.user_id, jobs.kind, jobs.params, jobs.status, jobs.done, jobs.total, jobs.error, " +
+	"jobs.cancel_requested, jobs.result_type, jobs.created, jobs.started, jobs.finished"
+
+// scanJob scans a row of jobColumns into a Job.
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var (
+		j      Job
+		userID sql.NullInt64
+		params string
+	)
+	err := row.Scan(&j.ID, &userID, &j.Kind, &params, &j.Status, &j.Done, &j.Total, &j.Error,
+		&j.CancelRequested, &j.ResultType, (*timeValue)(&j.Created), (*timeValue)(&j.Started), (*timeValue)(&j.Finished))
+	j.UserID = userID.Int64
+	j.Params = json.RawMessage(params)
+	return j, err
+}
+
+func (s *sqlStore) GetJob(id int64) (Job, error) {
+	j, err := scanJob(s.DB.QueryRow(s.bind("SELECT "+jobColumns+" FROM jobs WHERE id=?"), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return j, ErrNoRecord
+	}
+	return j, err
+}
+
+func (s *sqlStore) Jobs(userID int64, opts ListOptions) ([]Job, string, error) {
+	q := listQuery[Job]{
+		query:    "SELECT " + jobColumns + " FROM jobs WHERE user_id = ?",
+		args:     []any{userID},
+		idColumn: "jobs.id",
+		id:       func(j Job) int64 { return j.ID },
+		sorts: map[string]sortKey[Job]{
+			"":        {},
+			"created": {},
+		},
+		scan: func(rows *sql.Rows) (Job, error) { return scanJob(rows) },
+	}
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) ClaimJob() (Job, error) {
+	// Workers in other processes must not claim the same job.
+	lock := ""
+	if s.dialect == "postgres" {
+		lock = " FOR UPDATE SKIP LOCKED"
+	}
+	now := time.Now().UTC()
+	j, err := scanJob(s.DB.QueryRow(s.bind(`UPDATE jobs SET status=?, started=?, heartbeat=?
+		WHERE id = (SELECT id FROM jobs WHERE status=? ORDER BY id LIMIT 1`+lock+`) AND status=?
+		RETURNING `+jobColumns), JobRunning, now, now, JobQueued, JobQueued))
+	if errors.Is(err, sql.ErrNoRows) {
+		return j, ErrNoRecord
+	}
+	return j, err
+}
+
+func (s *sqlStore) HeartbeatJob(id int64) error {
+	_, err := s.DB.Exec(s.bind("UPDATE jobs SET heartbeat=? WHERE id=? AND status=?"), time.Now().UTC(), id, JobRunning)
+	return err
+}
+
+func (s *sqlStore) RequeueJobs(before time.Time) (int64, error) {
+	res, err := s.DB.Exec(s.bind(`UPDATE jobs SET status=?, done=0, total=0
+		WHERE status=? AND (heartbeat IS NULL OR heartbeat < ?)`), JobQueued, JobRunning, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) JobFiles(id int64) ([]JobFile, error) {
+	rows, err := s.DB.Query(s.bind("SELECT filename, data FROM job_files WHERE job_id=? ORDER BY id"), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []JobFile
+	for rows.Next() {
+		var f JobFile
+		if err := rows.Scan(&f.Filename, &f.Data); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) UpdateJobProgress(id int64, done, total int) error {
+	_, err := s.DB.Exec(s.bind("UPDATE jobs SET done=?, total=? WHERE id=?"), done, total, id)
+	return err
+}
+
+func (s *sqlStore) FinishJob(id int64, status, errMsg, resultType string, result []byte) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.bind("UPDATE jobs SET status=?, error=?, result_type=?, result=?, finished=? WHERE id=?"),
+		status, errMsg, resultType, result, time.Now().UTC(), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.bind("DELETE FROM job_files WHERE job_id=?"), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) CancelJob(id int64) (Job, error) {
+	j, err := s.GetJob(id)
+	if err != nil {
+		return j, err
+	}
+	if j.IsFinished() {
+		return j, ErrJobFinished
+	}
+
+	// A queued job is cancelled straight away; a running one is left for
+	// its worker to stop.
+	if _, err := s.DB.Exec(s.bind("UPDATE jobs SET cancel_requested=? WHERE id=?"), true, id); err != nil {
+		return j, err
+	}
+	res, err := s.DB.Exec(s.bind("UPDATE jobs SET status=?, finished=? WHERE id=? AND status=?"),
+		JobCancelled, time.Now().UTC(), id, JobQueued)
+	if err != nil {
+		return j, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return j, err
+	} else if n > 0 {
+		if _, err := s.DB.Exec(s.bind("DELETE FROM job_files WHERE job_id=?"), id); err != nil {
+			return j, err
+		}
+	}
+	return s.GetJob(id)
+}
+
+func (s *sqlStore) JobResult(id int64) (string, []byte, error) {
+	var (
+		resultType string
+		result     []byte
+	)
+	err := s.DB.QueryRow(s.bind("SELECT result_type, result FROM jobs WHERE id=? AND status=?"), id, JobSucceeded).Scan(&resultType, &result)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, ErrNoRecord
+	}
+	return resultType, result, err
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreJobs(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		uid, err := s.InsertUser("alice", "correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.ClaimJob(); !errors.Is(err, ErrNoRecord) {
+			t.Fatalf("expected ErrNoRecord with no jobs queued, got %v", err)
+		}
+
+		openB := func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("b")), nil }
+		files := []JobFile{{Filename: "a.xlsx", Data: []byte("a")}, {Filename: "b.xlsx", Open: openB}}
+		first, err := s.InsertJob(Job{UserID: uid, Kind: "import", Params: json.RawMessage(`{"return":"Q1"}`)}, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := s.InsertJob(Job{UserID: uid, Kind: "master"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Status != JobQueued || first.ID == 0 || first.Created.IsZero() {
+			t.Errorf("unexpected queued job %+v", first)
+		}
+
+		job, err := s.ClaimJob()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.ID != first.ID || job.Status != JobRunning || job.Started.IsZero() || string(job.Params) != `{"return":"Q1"}` {
+			t.Errorf("expected to claim the oldest job, got %+v", job)
+		}
+
+		got, err := s.JobFiles(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got[1].Filename != "b.xlsx" || string(got[1].Data) != "b" {
+			t.Errorf("unexpected job files %+v", got)
+		}
+
+		if err := s.UpdateJobProgress(job.ID, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+		if job, err = s.GetJob(job.ID); err != nil || job.Done != 1 || job.Total != 2 {
+			t.Errorf("expected progress 1 of 2, got %+v, %v", job, err)
+		}
+
+		if _, _, err := s.JobResult(job.ID); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for the result of a running job, got %v", err)
+		}
+		if err := s.FinishJob(job.ID, JobSucceeded, "", "application/json", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		resultType, result, err := s.JobResult(job.ID)
+		if err != nil || resultType != "application/json" || string(result) != "{}" {
+			t.Errorf("unexpected result %q %q, %v", resultType, result, err)
+		}
+		if got, _ := s.JobFiles(job.ID); len(got) != 0 {
+			t.Errorf("expected the files of a finished job to be deleted, got %d", len(got))
+		}
+		if _, err := s.CancelJob(job.ID); !errors.Is(err, ErrJobFinished) {
+			t.Errorf("expected ErrJobFinished cancelling a finished job, got %v", err)
+		}
+
+		cancelled, err := s.CancelJob(second.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cancelled.Status != JobCancelled || !cancelled.CancelRequested || cancelled.Finished.IsZero() {
+			t.Errorf("expected a queued job to be cancelled at once, got %+v", cancelled)
+		}
+		if _, err := s.ClaimJob(); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected a cancelled job not to be claimed, got %v", err)
+		}
+
+		third, err := s.InsertJob(Job{UserID: uid, Kind: "master"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ClaimJob(); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.RequeueJobs(time.Now().Add(-time.Minute)); err != nil || n != 0 {
+			t.Errorf("expected a job with a recent heartbeat not to be requeued, got %d, %v", n, err)
+		}
+		if err := s.HeartbeatJob(third.ID); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.RequeueJobs(time.Now().Add(time.Minute)); err != nil || n != 1 {
+			t.Errorf("expected to requeue 1 job, got %d, %v", n, err)
+		}
+		if job, err := s.ClaimJob(); err != nil || job.ID != third.ID {
+			t.Errorf("expected to claim the requeued job, got %+v, %v", job, err)
+		}
+
+		jobs, _, err := s.Jobs(uid, ListOptions{Sort: "-created"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 3 || jobs[0].ID != third.ID {
+			t.Errorf("unexpected jobs %+v", jobs)
+		}
+	})
+}
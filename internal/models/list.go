@@ -0,0 +1,253 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidCursor is returned when ListOptions.Cursor was not returned
+	// by the same kind of list with the same sort.
+	ErrInvalidCursor = errors.New("models: invalid cursor")
+
+	// ErrInvalidSort is returned when ListOptions.Sort names a field the
+	// list cannot be sorted by.
+	ErrInvalidSort = errors.New("models: invalid sort")
+)
+
+// ListOptions select a page of the records in a list. Lists return the
+// cursor of the next page along with each page, or an empty cursor with
+// the last page.
+type ListOptions struct {
+	// Limit is the most records returned. If it is zero every record is
+	// returned.
+	Limit int
+
+	// Cursor is the cursor returned with the previous page, or empty for
+	// the first page.
+	Cursor string
+
+	// Query restricts the list to records whose name (or key, for lists of
+	// datamap lines and values) contains Query, ignoring case.
+	Query string
+
+	// Sheet restricts lists of datamap lines and values to those on the
+	// named sheet.
+	Sheet string
+
+	// Like restricts lists of datamap lines to those whose key matches the
+	// SQL LIKE pattern Like, ignoring case, in which % matches any text, _
+	// any single character and \ makes the next character literal.
+	Like string
+
+	// Key restricts lists of values to those of the named datamap key.
+	Key string
+
+	// Filename restricts lists of values to those from the named file.
+	Filename string
+
+	// Sort is the field the list is sorted by, which defaults to the order
+	// in which the records were created. Prefixing it with "-" reverses
+	// the order.
+	Sort string
+
+	// UserID, if not zero, restricts the list to records which can be seen
+	// by the user with that id.
+	UserID int64
+}
+
+// sortKey is a column by which a list can be sorted.
+type sortKey[T any] struct {
+	// column is the column sorted on before the id column, or empty to
+	// sort only by the id column.
+	column string
+
+	// value returns the value of column for an item.
+	value func(T) any
+}
+
+// listQuery is a SELECT returning pages of T in a stable order, using the
+// values of the last item in a page to find the next (keyset pagination),
+// so that pages are cheap to fetch however deep into a list they are.
+type listQuery[T any] struct {
+	// query is the SELECT statement up to and including its WHERE clause.
+	query string
+	args  []any
+
+	// idColumn is a unique column used to order items with equal sort keys.
+	idColumn string
+	id       func(T) int64
+
+	// then, if its column is set, is sorted on between the sort key and
+	// the id column.
+	then sortKey[T]
+
+	// sorts are the keys by which the list can be sorted, by field name.
+	// The key for the empty field name is the default.
+	sorts map[string]sortKey[T]
+
+	scan func(*sql.Rows) (T, error)
+}
+
+// where adds cond, with args for its placeholders, to the WHERE clause.
+func (q *listQuery[T]) where(cond string, args ...any) {
+	q.query += " AND " + cond
+	q.args = append(q.args, args...)
+}
+
+// contains restricts the list to rows where column contains s, ignoring
+// case, if s is not empty.
+func (q *listQuery[T]) contains(column, s string) {
+	if s != "" {
+		q.where("lower("+column+") LIKE ? ESCAPE '\\'", "%"+escapeLike(strings.ToLower(s))+"%")
+	}
+}
+
+// like restricts the list to rows where column matches one of patterns,
+// SQL LIKE patterns matched ignoring case, if there are any.
+func (q *listQuery[T]) like(column string, patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+	conds := make([]string, 0, len(patterns))
+	args := make([]any, 0, len(patterns))
+	for _, p := range patterns {
+		conds = append(conds, "lower("+column+") LIKE ? ESCAPE '\\'")
+		args = append(args, strings.ToLower(p))
+	}
+	q.where("("+strings.Join(conds, " OR ")+")", args...)
+}
+
+// visibleTo restricts the list to rows of table which can be seen by the
+// user with id userID, if it is not zero.
+func (q *listQuery[T]) visibleTo(table string, userID int64) {
+	if userID != 0 {
+		q.where(fmt.Sprintf("(%[1]s.owner_id IS NULL OR %[1]s.owner_id = ? OR %[1]s.visibility <> ?)", table), userID, Private)
+	}
+}
+
+// cursor marks the position of the last item in a page.
+type cursor struct {
+	Sort  string `json:"s,omitempty"`
+	Value any    `json:"v"`
+	Then  any    `json:"t,omitempty"`
+	ID    int64  `json:"id"`
+
+	// Time reports that Value is a time, so that it is read back as a
+	// time.Time and compares as the column's own type.
+	Time bool `json:"tm,omitempty"`
+}
+
+func (c cursor) encode() string {
+	_, c.Time = c.Value.(time.Time)
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	// JSON has no integers, so integer columns come back as float64.
+	if f, ok := c.Value.(float64); ok {
+		c.Value = int64(f)
+	}
+	if f, ok := c.Then.(float64); ok {
+		c.Then = int64(f)
+	}
+	if c.Time {
+		v, _ := c.Value.(string)
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return c, ErrInvalidCursor
+		}
+		c.Value = t
+	}
+	return c, nil
+}
+
+// list runs q to fetch the page selected by opts, returning it along with
+// the cursor for the next page.
+func list[T any](s *sqlStore, q listQuery[T], opts ListOptions) ([]T, string, error) {
+	field, desc := strings.CutPrefix(opts.Sort, "-")
+	key, ok := q.sorts[field]
+	if !ok {
+		return nil, "", ErrInvalidSort
+	}
+	cmp, dir := ">", "ASC"
+	if desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil || c.Sort != opts.Sort {
+			return nil, "", ErrInvalidCursor
+		}
+		switch {
+		case key.column == "":
+			q.where(fmt.Sprintf("%s %s ?", q.idColumn, cmp), c.ID)
+		case q.then.column == "":
+			q.where(fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND %[3]s %[2]s ?))", key.column, cmp, q.idColumn),
+				c.Value, c.Value, c.ID)
+		default:
+			q.where(fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND (%[3]s %[2]s ? OR (%[3]s = ? AND %[4]s %[2]s ?))))",
+				key.column, cmp, q.then.column, q.idColumn), c.Value, c.Value, c.Then, c.Then, c.ID)
+		}
+	}
+
+	query := q.query + " ORDER BY "
+	if key.column != "" {
+		query += key.column + " " + dir + ", "
+		if q.then.column != "" {
+			query += q.then.column + " " + dir + ", "
+		}
+	}
+	query += q.idColumn + " " + dir
+	if opts.Limit > 0 {
+		// Fetch one more than needed to know whether there is another page.
+		query += fmt.Sprintf(" LIMIT %d", opts.Limit+1)
+	}
+
+	rows, err := s.DB.Query(s.bind(query), q.args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	out := []T{}
+	for rows.Next() {
+		item, err := q.scan(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		out = append(out, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if opts.Limit <= 0 || len(out) <= opts.Limit {
+		return out, "", nil
+	}
+	out = out[:opts.Limit]
+	last := out[len(out)-1]
+	c := cursor{Sort: opts.Sort, ID: q.id(last)}
+	if key.column != "" {
+		c.Value = key.value(last)
+		if q.then.column != "" {
+			c.Then = q.then.value(last)
+		}
+	}
+	return out, c.encode(), nil
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// collect fetches every page of a list, limit items at a time, returning
+// the concatenated items and the number of pages fetched.
+func collect[T any](t *testing.T, limit int, fetch func(cursor string) ([]T, string, error)) ([]T, int) {
+	t.Helper()
+
+	var (
+		all    []T
+		cursor string
+		pages  int
+	)
+	for {
+		page, next, err := fetch(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > limit {
+			t.Fatalf("expected at most %d items in a page, got %d", limit, len(page))
+		}
+		all = append(all, page...)
+		pages++
+		if next == "" {
+			return all, pages
+		}
+		cursor = next
+	}
+}
+
+func TestListDatamaps(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		alice, err := s.InsertUser("alice", "pa55word")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := []string{"Echo", "Alpha", "Delta", "Bravo", "Charlie"}
+		for _, name := range names {
+			if _, err := s.InsertDatamap(Datamap{Name: name}, testLines); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.InsertDatamap(Datamap{Name: "Secret", OwnerID: alice, Visibility: Private}, testLines); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name string
+			opts ListOptions
+			want []string
+		}{
+			{"Created", ListOptions{Limit: 2}, append(names, "Secret")},
+			{"Name", ListOptions{Limit: 2, Sort: "name"}, []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo", "Secret"}},
+			{"Name descending", ListOptions{Limit: 4, Sort: "-name"}, []string{"Secret", "Echo", "Delta", "Charlie", "Bravo", "Alpha"}},
+			{"Query", ListOptions{Limit: 1, Query: "HA"}, []string{"Alpha", "Charlie"}},
+			{"Not visible", ListOptions{Limit: 10, UserID: alice + 1}, names},
+			{"Visible to owner", ListOptions{Limit: 10, UserID: alice, Query: "secret"}, []string{"Secret"}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				dms, _ := collect(t, tt.opts.Limit, func(cursor string) ([]Datamap, string, error) {
+					opts := tt.opts
+					opts.Cursor = cursor
+					return s.Datamaps(opts)
+				})
+				var got []string
+				for _, dm := range dms {
+					got = append(got, dm.Name)
+				}
+				if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("expected %v, got %v", tt.want, got)
+				}
+			})
+		}
+
+		if _, _, err := s.Datamaps(ListOptions{Sort: "size"}); !errors.Is(err, ErrInvalidSort) {
+			t.Errorf("expected ErrInvalidSort, got %v", err)
+		}
+		if _, _, err := s.Datamaps(ListOptions{Cursor: "bobbins"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("expected ErrInvalidCursor, got %v", err)
+		}
+		_, next, err := s.Datamaps(ListOptions{Limit: 1, Sort: "name"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Datamaps(ListOptions{Limit: 1, Cursor: next}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("expected ErrInvalidCursor using a cursor with a different sort, got %v", err)
+		}
+	})
+}
+
+func TestListLinesAndValues(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		var lines []DatamapLine
+		for i := 0; i < 25; i++ {
+			sheet := "Introduction"
+			if i%5 == 0 {
+				sheet = "Finance"
+			}
+			lines = append(lines, DatamapLine{Key: fmt.Sprintf("Key %02d", 24-i), Sheet: sheet, Cellref: fmt.Sprintf("A%d", i+1)})
+		}
+		if _, err := s.InsertDatamap(Datamap{Name: "Big"}, lines); err != nil {
+			t.Fatal(err)
+		}
+
+		got, pages := collect(t, 10, func(cursor string) ([]DatamapLine, string, error) {
+			return s.ListLines("Big", ListOptions{Limit: 10, Cursor: cursor, Sort: "key"})
+		})
+		if len(got) != 25 || pages != 3 {
+			t.Fatalf("expected 25 lines in 3 pages, got %d in %d", len(got), pages)
+		}
+		for i, l := range got {
+			if want := fmt.Sprintf("Key %02d", i); l.Key != want {
+				t.Errorf("expected line %d to be %s, got %s", i, want, l.Key)
+			}
+		}
+
+		finance, _, err := s.ListLines("Big", ListOptions{Sheet: "Finance"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(finance) != 5 || finance[0].Cellref != "A1" {
+			t.Errorf("expected 5 Finance lines in import order, got %v", finance)
+		}
+
+		for _, tt := range []struct {
+			like string
+			want int
+		}{
+			{"key 1%", 10},
+			{"%_3", 3},
+			{"KEY 0_", 10},
+			{"key 1", 0},
+			{"key\\_%", 0},
+		} {
+			matched, _, err := s.ListLines("Big", ListOptions{Like: tt.like})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matched) != tt.want {
+				t.Errorf("expected %d lines LIKE %q, got %d", tt.want, tt.like, len(matched))
+			}
+		}
+
+		stored, err := s.DatamapLines("Big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := s.InsertReturn(Return{Name: "Q1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []ReturnData
+		for _, file := range []string{"a.xlsx", "b.xlsx"} {
+			for _, l := range stored {
+				data = append(data, ReturnData{DatamapLineID: l.ID, ReturnID: r.ID, Filename: file, Value: l.Key})
+			}
+		}
+		if err := s.InsertReturnData(data); err != nil {
+			t.Fatal(err)
+		}
+
+		values, pages := collect(t, 7, func(cursor string) ([]ReturnValue, string, error) {
+			return s.ListReturnValues("Big", "Q1", ListOptions{Limit: 7, Cursor: cursor, Query: "key 1", Sort: "-filename"})
+		})
+		if len(values) != 20 || pages != 3 {
+			t.Fatalf("expected 20 values in 3 pages, got %d in %d", len(values), pages)
+		}
+		if values[0].Filename != "b.xlsx" || values[19].Filename != "a.xlsx" {
+			t.Errorf("expected values sorted by descending filename, got %s first and %s last", values[0].Filename, values[19].Filename)
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package models
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFS holds the numbered SQL migrations for each backend, in
+// migrations/sqlite and migrations/postgres. Files are named
+// NNNN_description.sql and are applied in order of NNNN.
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+var (
+	// ErrSchemaOutdated is returned by CheckSchema when there are
+	// migrations which have not been applied to the database.
+	ErrSchemaOutdated = errors.New("models: database schema is out of date")
+
+	// ErrSchemaTooNew is returned by CheckSchema when the database has
+	// migrations applied which this version of datamaps does not know about.
+	ErrSchemaTooNew = errors.New("models: database schema is newer than this version of datamaps")
+
+	// ErrDuplicateNames is returned by MigrateUp when datamaps or returns
+	// share a name, which must be changed before names are made unique.
+	ErrDuplicateNames = errors.New("models: datamaps or returns share a name")
+)
+
+// migrationChecks are run before the migration with the same version is
+// applied, so that a migration which cannot succeed on the data in the
+// database fails with an explanation rather than a constraint violation.
+var migrationChecks = map[int]func(s *sqlStore) error{
+	2: (*sqlStore).checkUniqueNames,
+}
+
+// Migration is a single numbered change to the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus reports whether a Migration has been applied, and when.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// loadMigrations reads the migrations in dir of migrationFS, ordered by version.
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFS, path.Join("migrations", dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Migration
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		num, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s must be named NNNN_description.sql", e.Name())
+		}
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s must be named NNNN_description.sql", e.Name())
+		}
+		sql, err := fs.ReadFile(migrationFS, path.Join("migrations", dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Migration{Version: version, Name: name, SQL: string(sql)})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	for i := 1; i < len(out); i++ {
+		if out[i].Version == out[i-1].Version {
+			return nil, fmt.Errorf("there are two migrations numbered %d", out[i].Version)
+		}
+	}
+	return out, nil
+}
+
+// createVersionTable creates the schema_version table, which records
+// each migration applied to the database.
+func (s *sqlStore) createVersionTable() error {
+	_, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_version(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied TIMESTAMP NOT NULL)`)
+	return err
+}
+
+// appliedMigrations returns the time each applied migration was applied,
+// keyed on version.
+func (s *sqlStore) appliedMigrations() (map[int]time.Time, error) {
+	if err := s.createVersionTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.Query("SELECT version, applied FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			applied time.Time
+		)
+		if err := rows.Scan(&version, (*timeValue)(&applied)); err != nil {
+			return nil, err
+		}
+		out[version] = applied
+	}
+	return out, rows.Err()
+}
+
+// MigrationStatus returns every known migration and whether it has
+// been applied to the database.
+func (s *sqlStore) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		at, ok := applied[m.Version]
+		out = append(out, MigrationStatus{Migration: m, Applied: ok, AppliedAt: at})
+	}
+	return out, nil
+}
+
+// SchemaVersion returns the version of the latest migration applied
+// to the database, or 0 if there are none.
+func (s *sqlStore) SchemaVersion() (int, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	var v int
+	for version := range applied {
+		v = max(v, version)
+	}
+	return v, nil
+}
+
+// MigrateUp applies, in order, each migration not yet applied to the
+// database and returns those it applied. Each migration is applied in
+// its own transaction.
+func (s *sqlStore) MigrateUp() ([]Migration, error) {
+	status, err := s.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range status {
+		if m.Applied {
+			continue
+		}
+		if check, ok := migrationChecks[m.Version]; ok {
+			if err := check(s); err != nil {
+				return done, err
+			}
+		}
+		if err := s.applyMigration(m.Migration); err != nil {
+			return done, err
+		}
+		done = append(done, m.Migration)
+	}
+	return done, nil
+}
+
+func (s *sqlStore) applyMigration(m Migration) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return fmt.Errorf("cannot apply migration %04d_%s - %v", m.Version, m.Name, err)
+	}
+	if _, err := tx.Exec(s.bind("INSERT INTO schema_version (version, name, applied) VALUES(?,?,?)"),
+		m.Version, m.Name, time.Now().UTC()); err != nil {
+		return fmt.Errorf("cannot record migration %04d_%s - %v", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
+
+// checkUniqueNames returns ErrDuplicateNames, listing the names, if any
+// datamaps or returns share a name.
+func (s *sqlStore) checkUniqueNames() error {
+	rows, err := s.DB.Query(`SELECT 'datamap', name, COUNT(*) FROM datamap WHERE name IS NOT NULL GROUP BY name HAVING COUNT(*) > 1
+		UNION ALL
+		SELECT 'return', name, COUNT(*) FROM return WHERE name IS NOT NULL GROUP BY name HAVING COUNT(*) > 1`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var dups []string
+	for rows.Next() {
+		var (
+			table, name string
+			n           int
+		)
+		if err := rows.Scan(&table, &name, &n); err != nil {
+			return err
+		}
+		dups = append(dups, fmt.Sprintf("%d %ss named %q", n, table, name))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(dups) > 0 {
+		return fmt.Errorf("%w: there are %s - rename all but one of each, then migrate again", ErrDuplicateNames, strings.Join(dups, ", "))
+	}
+	return nil
+}
+
+// CheckSchema returns ErrSchemaOutdated if s has migrations waiting to be
+// applied, or ErrSchemaTooNew if s has been migrated by a newer datamaps.
+func CheckSchema(s Store) error {
+	status, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	var latest, pending int
+	for _, m := range status {
+		latest = m.Version
+		if !m.Applied {
+			pending++
+		}
+	}
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > latest {
+		return fmt.Errorf("%w: database is at version %d, the latest known is %d", ErrSchemaTooNew, version, latest)
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: %d migration(s) to apply", ErrSchemaOutdated, pending)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	for _, dialect := range []string{"sqlite", "postgres"} {
+		migrations, err := loadMigrations(dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("expected %s migrations, found none", dialect)
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("expected %s migration %d to be version %d, got %d", dialect, i, i+1, m.Version)
+			}
+		}
+	}
+
+	sqlite, _ := loadMigrations("sqlite")
+	postgres, _ := loadMigrations("postgres")
+	if len(sqlite) != len(postgres) {
+		t.Errorf("expected the same number of sqlite and postgres migrations, got %d and %d", len(sqlite), len(postgres))
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+
+			if err := CheckSchema(s); err != nil {
+				t.Errorf("expected a migrated schema to pass CheckSchema, got %v", err)
+			}
+
+			status, err := s.MigrationStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range status {
+				if !m.Applied || m.AppliedAt.IsZero() {
+					t.Errorf("expected migration %d to have been applied", m.Version)
+				}
+			}
+
+			version, err := s.SchemaVersion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := status[len(status)-1].Version; version != want {
+				t.Errorf("expected schema version %d, got %d", want, version)
+			}
+
+			done, err := s.MigrateUp()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(done) != 0 {
+				t.Errorf("expected no migrations to apply a second time, applied %d", len(done))
+			}
+		})
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	s, err := Open(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := CheckSchema(s); !errors.Is(err, ErrSchemaOutdated) {
+		t.Errorf("expected ErrSchemaOutdated for an empty database, got %v", err)
+	}
+
+	if _, err := s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.(*SQLiteStore).DB.Exec("INSERT INTO schema_version (version, name, applied) VALUES(9999, 'future', '2030-01-01 00:00:00')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(s); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestMigrateUniqueNames(t *testing.T) {
+	s, err := Open(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store := s.(*SQLiteStore)
+
+	// Make a database as versions before names were unique left it,
+	// holding two datamaps and two returns of the same name.
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.createVersionTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.applyMigration(migrations[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"INSERT INTO datamap (id, name) VALUES (1, 'Tonk 1'), (2, 'Tonk 1')",
+		"INSERT INTO return (id, name) VALUES (1, 'Q1'), (2, 'Q1'), (3, 'Q2')",
+	} {
+		if _, err := store.DB.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = s.MigrateUp()
+	if !errors.Is(err, ErrDuplicateNames) {
+		t.Fatalf("expected ErrDuplicateNames, got %v", err)
+	}
+	for _, want := range []string{`2 datamaps named "Tonk 1"`, `2 returns named "Q1"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+	if version, err := s.SchemaVersion(); err != nil || version != 1 {
+		t.Errorf("expected the schema to be left at version 1, got %d, %v", version, err)
+	}
+
+	for _, q := range []string{
+		"UPDATE datamap SET name = 'Tonk 2' WHERE id = 2",
+		"DELETE FROM return WHERE id = 2",
+	} {
+		if _, err := store.DB.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("expected ErrDuplicateName once migrated, got %v", err)
+	}
+}
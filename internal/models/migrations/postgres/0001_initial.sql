@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS datamap(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name TEXT,
+	date_created TIMESTAMPTZ);
+
+CREATE TABLE IF NOT EXISTS datamap_line(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	dm_id BIGINT REFERENCES datamap(id) ON DELETE CASCADE,
+	key TEXT NOT NULL,
+	sheet TEXT NOT NULL,
+	cellref TEXT
+);
+
+CREATE TABLE IF NOT EXISTS return(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name TEXT,
+	date_created TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS return_data(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	dml_id BIGINT REFERENCES datamap_line(id) ON DELETE CASCADE,
+	ret_id BIGINT REFERENCES return(id) ON DELETE CASCADE,
+	filename TEXT,
+	value TEXT,
+	numfmt TEXT,
+	vFormatted TEXT
+);
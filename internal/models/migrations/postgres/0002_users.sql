@@ -0,0 +1,25 @@
+CREATE TABLE users(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	hashed_password TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE sessions(
+	token_hash TEXT PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expiry TIMESTAMPTZ NOT NULL
+);
+
+-- Datamaps and returns without an owner can be seen by everyone.
+ALTER TABLE datamap ADD COLUMN owner_id BIGINT REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE datamap ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public';
+ALTER TABLE return ADD COLUMN owner_id BIGINT REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE return ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public';
+
+-- Datamaps and returns are found by name, so names must be unique or the
+-- lines and values of those of the same name, which may belong to different
+-- users, are merged. MigrateUp refuses to apply this migration to a database
+-- holding duplicates, which must be renamed first.
+CREATE UNIQUE INDEX datamap_name ON datamap(name);
+CREATE UNIQUE INDEX return_name ON return(name);
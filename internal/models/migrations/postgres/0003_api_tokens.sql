@@ -0,0 +1,9 @@
+CREATE TABLE api_tokens(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	scope TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL,
+	last_used TIMESTAMPTZ
+);
@@ -0,0 +1,26 @@
+CREATE TABLE jobs(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+	kind TEXT NOT NULL,
+	params TEXT NOT NULL,
+	status TEXT NOT NULL,
+	done INTEGER NOT NULL DEFAULT 0,
+	total INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+	result_type TEXT NOT NULL DEFAULT '',
+	result BYTEA,
+	created TIMESTAMPTZ NOT NULL,
+	started TIMESTAMPTZ,
+	finished TIMESTAMPTZ
+);
+
+CREATE INDEX jobs_status ON jobs(status, id);
+
+-- Files uploaded for a job, deleted once it has finished.
+CREATE TABLE job_files(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	job_id BIGINT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+	filename TEXT NOT NULL,
+	data BYTEA NOT NULL
+);
@@ -0,0 +1,22 @@
+CREATE TABLE webhooks(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	url TEXT NOT NULL,
+	-- The secret signs deliveries, so unlike API tokens it is kept.
+	secret TEXT NOT NULL,
+	events TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL
+);
+
+-- Every attempt to deliver an event, including retries.
+CREATE TABLE webhook_deliveries(
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	webhook_id BIGINT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	delivery TEXT NOT NULL,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL
+);
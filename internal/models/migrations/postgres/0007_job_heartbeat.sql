@@ -0,0 +1,4 @@
+-- When the worker running a job last showed it was still alive. A running
+-- job whose heartbeat has stopped is queued again, without disturbing jobs
+-- being run by other processes.
+ALTER TABLE jobs ADD COLUMN heartbeat TIMESTAMPTZ;
@@ -0,0 +1,40 @@
+-- The tables created by earlier versions of datamaps, which dropped and
+-- recreated them on every setup. IF NOT EXISTS lets existing databases
+-- adopt migrations without losing their data.
+CREATE TABLE IF NOT EXISTS datamap(
+	id INTEGER PRIMARY KEY,
+	name TEXT,
+	date_created TIMESTAMP);
+
+CREATE TABLE IF NOT EXISTS datamap_line(
+	id INTEGER PRIMARY KEY,
+	dm_id INTEGER,
+	key TEXT NOT NULL,
+	sheet TEXT NOT NULL,
+	cellref TEXT,
+	FOREIGN KEY (dm_id)
+	REFERENCES datamap(id)
+	ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS return(
+	id INTEGER PRIMARY KEY,
+	name TEXT,
+	date_created TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS return_data(
+	id INTEGER PRIMARY KEY,
+	dml_id INTEGER,
+	ret_id INTEGER,
+	filename TEXT,
+	value TEXT,
+	numfmt TEXT,
+	vFormatted TEXT,
+	FOREIGN KEY (dml_id)
+	REFERENCES datamap_line(id)
+	ON DELETE CASCADE
+	FOREIGN KEY (ret_id)
+	REFERENCES return(id)
+	ON DELETE CASCADE
+);
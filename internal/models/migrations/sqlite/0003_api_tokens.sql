@@ -0,0 +1,9 @@
+CREATE TABLE api_tokens(
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	scope TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	last_used TIMESTAMP
+);
@@ -0,0 +1,26 @@
+CREATE TABLE jobs(
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	kind TEXT NOT NULL,
+	params TEXT NOT NULL,
+	status TEXT NOT NULL,
+	done INTEGER NOT NULL DEFAULT 0,
+	total INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	cancel_requested INTEGER NOT NULL DEFAULT 0,
+	result_type TEXT NOT NULL DEFAULT '',
+	result BLOB,
+	created TIMESTAMP NOT NULL,
+	started TIMESTAMP,
+	finished TIMESTAMP
+);
+
+CREATE INDEX jobs_status ON jobs(status, id);
+
+-- Files uploaded for a job, deleted once it has finished.
+CREATE TABLE job_files(
+	id INTEGER PRIMARY KEY,
+	job_id INTEGER NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+	filename TEXT NOT NULL,
+	data BLOB NOT NULL
+);
@@ -0,0 +1,4 @@
+-- The type of value expected in a datamap line's cell, such as TEXT, NUMBER
+-- or DATE, from the fourth column of the datamap CSV file. Empty for lines
+-- imported before types were kept, whose values are not checked.
+ALTER TABLE datamap_line ADD COLUMN type TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,386 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNoRecord is returned when a query matches no rows.
+	ErrNoRecord = errors.New("models: no matching record found")
+
+	// ErrInvalidCredentials is returned when a user name and password
+	// do not match a user.
+	ErrInvalidCredentials = errors.New("models: invalid credentials")
+
+	// ErrDuplicateName is returned when creating a user, datamap or
+	// return with a name which is already taken.
+	ErrDuplicateName = errors.New("models: duplicate name")
+)
+
+// Visibility of datamaps and returns which have an owner.
+const (
+	// Public datamaps and returns can be seen by every user.
+	Public = "public"
+
+	// Private datamaps and returns can only be seen by their owner.
+	Private = "private"
+)
+
+// Store is the storage used by datamaps. It is implemented by SQLiteStore
+// and PostgresStore so that the CLI and the server can use either backend.
+type Store interface {
+	Migrator
+	DatamapStore
+	ReturnStore
+	UserStore
+	TokenStore
+	JobStore
+	WebhookStore
+	Checker
+
+	// Close closes the underlying database.
+	Close() error
+}
+
+// Migrator manages the database schema.
+type Migrator interface {
+	// MigrateUp applies any outstanding schema migrations.
+	MigrateUp() ([]Migration, error)
+
+	// MigrationStatus reports which schema migrations have been applied.
+	MigrationStatus() ([]MigrationStatus, error)
+
+	// SchemaVersion returns the version of the latest applied migration.
+	SchemaVersion() (int, error)
+}
+
+// DatamapStore stores datamaps and their lines.
+type DatamapStore interface {
+	// InsertDatamap stores dm, made up of lines, and returns its id, or
+	// ErrDuplicateName if there is already a datamap named dm.Name.
+	InsertDatamap(dm Datamap, lines []DatamapLine) (int64, error)
+
+	// Datamaps returns the page of datamaps selected by opts, which can
+	// be sorted by "created" or "name", and the cursor of the next page.
+	Datamaps(opts ListOptions) ([]Datamap, string, error)
+
+	// GetDatamap returns the datamap named name, or ErrNoRecord.
+	GetDatamap(name string) (Datamap, error)
+
+	// DatamapLines returns the lines of the datamap named name in the
+	// order in which they were imported.
+	DatamapLines(name string) ([]DatamapLine, error)
+
+	// ListLines returns the page of lines of the datamap named name
+	// selected by opts, which can be sorted by "key" or "sheet", and the
+	// cursor of the next page.
+	ListLines(name string, opts ListOptions) ([]DatamapLine, string, error)
+
+	// SearchLines returns the datamap lines, in any datamap, whose key
+	// contains q, ignoring case.
+	SearchLines(q string) ([]LineMatch, error)
+}
+
+// ReturnStore stores returns and the data imported into them.
+type ReturnStore interface {
+	// GetReturn returns the return named name, or ErrNoRecord.
+	GetReturn(name string) (Return, error)
+
+	// InsertReturn stores r and returns it with its ID and Created set,
+	// or ErrDuplicateName if there is already a return named r.Name.
+	InsertReturn(r Return) (Return, error)
+
+	// GetOrCreateReturn returns the return named name, creating it
+	// if it does not exist.
+	GetOrCreateReturn(name string) (Return, error)
+
+	// Returns returns the page of returns selected by opts, which can be
+	// sorted by "created" or "name", and the cursor of the next page.
+	Returns(opts ListOptions) ([]Return, string, error)
+
+	// InsertReturnData stores data in a single transaction.
+	InsertReturnData(data []ReturnData) error
+
+	// ReplaceReturnData stores data, imported from the file named filename
+	// into the return with id retID using the datamap with id dmID, in
+	// place of any data imported from a file of that name before, in a
+	// single transaction. Importing a file again therefore does not
+	// duplicate its data.
+	ReplaceReturnData(dmID, retID int64, filename string, data []ReturnData) error
+
+	// ReturnDatamaps returns the datamaps which have been used to import
+	// data into the return named name.
+	ReturnDatamaps(name string) ([]Datamap, error)
+
+	// ReturnValues returns the data stored for the return named returnName
+	// against the datamap named dmName, ordered by filename.
+	ReturnValues(dmName, returnName string) ([]ReturnValue, error)
+
+	// ReturnFiles returns the names of the files whose data is stored for
+	// the return named returnName against the datamap named dmName, in
+	// order.
+	ReturnFiles(dmName, returnName string) ([]string, error)
+
+	// ListReturnValues returns the page of the values stored for the return
+	// named returnName against the datamap named dmName selected by opts,
+	// which can be sorted by "key" or "filename", and the cursor of the
+	// next page.
+	ListReturnValues(dmName, returnName string, opts ListOptions) ([]ReturnValue, string, error)
+
+	// KeyHistory returns the page selected by opts of the values stored for
+	// the datamap key named key, in any return, ordered by the date the
+	// return was created, and the cursor of the next page. If filename is
+	// not empty only values from files with that name are returned.
+	KeyHistory(key, filename string, opts ListOptions) ([]KeyValue, string, error)
+
+	// QueryValues returns the page selected by opts of the values, in any
+	// return, matching f, which can be sorted by "key", "sheet", "filename",
+	// "return" or "datamap", and the cursor of the next page.
+	QueryValues(f ValueFilter, opts ListOptions) ([]QueryValue, string, error)
+}
+
+// UserStore stores users and their login sessions.
+type UserStore interface {
+	// InsertUser creates a user with a hash of password, returning
+	// ErrDuplicateName if name is taken.
+	InsertUser(name, password string) (int64, error)
+
+	// Authenticate returns the id of the user matching name and password,
+	// or ErrInvalidCredentials.
+	Authenticate(name, password string) (int64, error)
+
+	// GetUser returns the user with id, or ErrNoRecord.
+	GetUser(id int64) (User, error)
+
+	// GetUserByName returns the user named name, or ErrNoRecord.
+	GetUserByName(name string) (User, error)
+
+	// Users returns every user in order of name.
+	Users() ([]User, error)
+
+	// CreateSession starts a session for the user with id userID which
+	// lasts for ttl, returning the token which identifies it.
+	CreateSession(userID int64, ttl time.Duration) (string, error)
+
+	// SessionUser returns the user whose unexpired session is identified
+	// by token, or ErrNoRecord.
+	SessionUser(token string) (User, error)
+
+	// DeleteSession ends the session identified by token.
+	DeleteSession(token string) error
+}
+
+// TokenStore stores users' API tokens.
+type TokenStore interface {
+	// CreateToken creates an API token for the user with id userID,
+	// returning it along with the secret token which identifies it.
+	// Only a hash of the secret is stored. ErrInvalidScope is returned
+	// unless scope is ScopeRead or ScopeReadWrite.
+	CreateToken(userID int64, name, scope string) (APIToken, string, error)
+
+	// Tokens returns the page of the API tokens of the user with id userID
+	// selected by opts, which can be sorted by "created" or "name", and
+	// the cursor of the next page.
+	Tokens(userID int64, opts ListOptions) ([]APIToken, string, error)
+
+	// DeleteToken revokes the API token with id belonging to the user
+	// with id userID, or returns ErrNoRecord if there is no such token.
+	DeleteToken(userID, id int64) error
+
+	// TokenUser returns the API token identified by the secret token, and
+	// its user, recording that it has been used. ErrNoRecord is returned
+	// if there is no such token.
+	TokenUser(token string) (User, APIToken, error)
+}
+
+// JobStore stores the queue of background jobs.
+type JobStore interface {
+	// InsertJob queues j, along with the files it works on, and returns it
+	// with its ID, Status and Created set.
+	InsertJob(j Job, files []JobFile) (Job, error)
+
+	// GetJob returns the job with id, or ErrNoRecord.
+	GetJob(id int64) (Job, error)
+
+	// Jobs returns the page of the jobs of the user with id userID selected
+	// by opts, which can be sorted by "created", and the cursor of the next
+	// page.
+	Jobs(userID int64, opts ListOptions) ([]Job, string, error)
+
+	// ClaimJob marks the oldest queued job as running, with a heartbeat,
+	// and returns it, or returns ErrNoRecord if no job is queued.
+	ClaimJob() (Job, error)
+
+	// HeartbeatJob records that the worker running the job with id is
+	// still alive.
+	HeartbeatJob(id int64) error
+
+	// RequeueJobs queues again every running job whose last heartbeat was
+	// before before, returning how many there were. It recovers jobs whose
+	// worker stopped before they finished, without disturbing those being
+	// run by other processes.
+	RequeueJobs(before time.Time) (int64, error)
+
+	// JobFiles returns the files uploaded for the job with id.
+	JobFiles(id int64) ([]JobFile, error)
+
+	// UpdateJobProgress records that done of total steps of the job with
+	// id have been completed.
+	UpdateJobProgress(id int64, done, total int) error
+
+	// FinishJob sets the status of the job with id, along with its error
+	// or result, and deletes its files.
+	FinishJob(id int64, status, errMsg, resultType string, result []byte) error
+
+	// CancelJob asks the job with id to stop. A queued job is cancelled
+	// at once. ErrJobFinished is returned if the job has already finished.
+	CancelJob(id int64) (Job, error)
+
+	// JobResult returns the media type and the result of the job with id,
+	// or ErrNoRecord if it has not succeeded.
+	JobResult(id int64) (string, []byte, error)
+}
+
+// WebhookStore stores users' webhooks and the log of their deliveries.
+type WebhookStore interface {
+	// CreateWebhook subscribes url to events, or to every event in Events
+	// if events is empty, for the user with id userID. The webhook is
+	// returned with a new secret with which its deliveries are signed.
+	// ErrInvalidEvent is returned for an event not in Events.
+	CreateWebhook(userID int64, url string, events []string) (Webhook, error)
+
+	// GetWebhook returns the webhook with id belonging to the user with id
+	// userID, or ErrNoRecord.
+	GetWebhook(userID, id int64) (Webhook, error)
+
+	// Webhooks returns the page of the webhooks of the user with id userID
+	// selected by opts, which can be sorted by "created" or "url", and the
+	// cursor of the next page.
+	Webhooks(userID int64, opts ListOptions) ([]Webhook, string, error)
+
+	// EventWebhooks returns every webhook of the user with id userID which
+	// is subscribed to event.
+	EventWebhooks(userID int64, event string) ([]Webhook, error)
+
+	// DeleteWebhook deletes the webhook with id belonging to the user with
+	// id userID, and its deliveries, or returns ErrNoRecord.
+	DeleteWebhook(userID, id int64) error
+
+	// InsertDelivery records an attempt to deliver an event and returns it
+	// with its ID and Created set.
+	InsertDelivery(d WebhookDelivery) (WebhookDelivery, error)
+
+	// Deliveries returns the page of the attempts to deliver events to the
+	// webhook with id webhookID selected by opts, which can be sorted by
+	// "created", and the cursor of the next page.
+	Deliveries(webhookID int64, opts ListOptions) ([]WebhookDelivery, string, error)
+}
+
+// Checker finds rows which break the schema's rules, left behind by
+// versions of datamaps which did not enforce them.
+type Checker interface {
+	// ForeignKeyViolations returns the rows which refer to a row that does
+	// not exist.
+	ForeignKeyViolations() ([]ForeignKeyViolation, error)
+
+	// OrphanedReturnData returns the number of return_data rows whose
+	// datamap line or return does not exist.
+	OrphanedReturnData() (int, error)
+
+	// DeleteOrphanedReturnData deletes the rows counted by
+	// OrphanedReturnData and returns how many were deleted.
+	DeleteOrphanedReturnData() (int64, error)
+}
+
+// Return is a named collection of data imported from populated spreadsheets.
+type Return struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// OwnerID is the id of the user who owns the return, or 0 if it
+	// has no owner and can be seen by everyone.
+	OwnerID int64 `json:"owner_id,omitempty"`
+
+	// Visibility is Public or Private.
+	Visibility string `json:"visibility"`
+}
+
+// VisibleTo reports whether the user with id userID can see r.
+func (r Return) VisibleTo(userID int64) bool {
+	return visibleTo(r.OwnerID, r.Visibility, userID)
+}
+
+// WritableBy reports whether the user with id userID can add data to r.
+func (r Return) WritableBy(userID int64) bool {
+	return r.OwnerID == 0 || r.OwnerID == userID
+}
+
+// visibleTo reports whether something owned by ownerID with visibility
+// can be seen by the user with id userID.
+func visibleTo(ownerID int64, visibility string, userID int64) bool {
+	return ownerID == 0 || ownerID == userID || visibility != Private
+}
+
+// ReturnData is a single value extracted from a populated spreadsheet using
+// a datamap line, stored as part of a return.
+type ReturnData struct {
+	ID            int64
+	DatamapLineID int64
+	ReturnID      int64
+	Filename      string
+	Value         string
+	NumFmt        string
+	Formatted     string
+}
+
+// ReturnValue is a value stored in a return, joined with the datamap line
+// used to extract it.
+type ReturnValue struct {
+	ID        int64  `json:"id"`
+	Key       string `json:"key"`
+	Sheet     string `json:"sheet"`
+	Cellref   string `json:"cellref"`
+	Filename  string `json:"filename"`
+	Value     string `json:"value"`
+	NumFmt    string `json:"numfmt"`
+	Formatted string `json:"formatted"`
+}
+
+// KeyValue is a value stored for a key in one file of a return, as returned
+// by KeyHistory.
+type KeyValue struct {
+	ID        int64   `json:"id"`
+	Return    Return  `json:"return"`
+	Datamap   Datamap `json:"datamap"`
+	Filename  string  `json:"filename"`
+	Value     string  `json:"value"`
+	Formatted string  `json:"formatted"`
+}
+
+// ValueFilter selects the values returned by QueryValues. Each field holds
+// SQL LIKE patterns, matched ignoring case, in which % matches any text, _
+// any single character and \ makes the next character literal. A value
+// matches if it matches one of the patterns of every field which has any.
+type ValueFilter struct {
+	Keys     []string
+	Sheets   []string
+	Files    []string
+	Returns  []string
+	Datamaps []string
+}
+
+// QueryValue is a value stored in a return, along with where it came from,
+// as returned by QueryValues.
+type QueryValue struct {
+	ID        int64  `json:"id"`
+	Datamap   string `json:"datamap"`
+	Return    string `json:"return"`
+	Key       string `json:"key"`
+	Sheet     string `json:"sheet"`
+	Cellref   string `json:"cellref"`
+	Filename  string `json:"filename"`
+	Value     string `json:"value"`
+	Formatted string `json:"formatted"`
+}
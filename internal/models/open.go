@@ -0,0 +1,46 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Open opens the Store described by dsn. A dsn beginning postgres:// or
+// postgresql:// opens a PostgresStore; anything else is taken to be the path
+// to a SQLite database file, optionally prefixed with sqlite://.
+func Open(dsn string) (Store, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		db, err := openDB("pgx", dsn)
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgresStore(db), nil
+	}
+
+	path := strings.TrimPrefix(dsn, "sqlite://")
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := openDB("sqlite3", path+sep+"_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLiteStore(db), nil
+}
+
+// openDB wraps sql.Open() and returns a sql.DB connection pool
+// which has been checked with Ping().
+func openDB(driver, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
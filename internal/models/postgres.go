@@ -0,0 +1,28 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	// Needed for the pgx driver
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgresStore is a Store backed by a PostgreSQL database.
+type PostgresStore struct {
+	sqlStore
+}
+
+// NewPostgresStore returns a PostgresStore using db, which must have been
+// opened with the pgx driver.
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{sqlStore{DB: db, bind: bindDollar, dialect: "postgres", isDuplicate: isPostgresDuplicate}}
+}
+
+// isPostgresDuplicate reports whether err is a PostgreSQL unique_violation.
+func isPostgresDuplicate(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore is a Store backed by a SQLite database file.
+type SQLiteStore struct {
+	sqlStore
+}
+
+// NewSQLiteStore returns a SQLiteStore using db, which must have been
+// opened with the sqlite3 driver.
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{sqlStore{DB: db, bind: bindQuestion, dialect: "sqlite", isDuplicate: isSQLiteDuplicate}}
+}
+
+// isSQLiteDuplicate reports whether err is a SQLite unique constraint violation.
+func isSQLiteDuplicate(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
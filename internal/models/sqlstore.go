@@ -0,0 +1,567 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlStore holds the queries shared by SQLiteStore and PostgresStore. Queries
+// are written with ? placeholders and rebound for the backend by bind.
+type sqlStore struct {
+	DB   *sql.DB
+	bind func(query string) string
+
+	// dialect names the directory in migrations holding the
+	// migrations for the backend.
+	dialect string
+
+	// isDuplicate reports whether err is a unique constraint violation.
+	isDuplicate func(err error) bool
+}
+
+// bindQuestion leaves a query using ? placeholders untouched.
+func bindQuestion(query string) string {
+	return query
+}
+
+// bindDollar rewrites the ? placeholders in query as $1, $2 and so on.
+func bindDollar(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) Close() error {
+	return s.DB.Close()
+}
+
+func (s *sqlStore) InsertDatamap(dm Datamap, lines []DatamapLine) (int64, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(s.bind("INSERT INTO datamap (name, date_created, owner_id, visibility) VALUES(?,?,?,?) RETURNING id"),
+		dm.Name, time.Now().UTC(), nullID(dm.OwnerID), visibilityOrDefault(dm.Visibility)).Scan(&id)
+	if err != nil {
+		if s.isDuplicate(err) {
+			return 0, ErrDuplicateName
+		}
+		return 0, fmt.Errorf("cannot insert datamap %s - %v", dm.Name, err)
+	}
+
+	stmt, err := tx.Prepare(s.bind("INSERT INTO datamap_line (dm_id, key, sheet, cellref, type) VALUES(?,?,?,?,?)"))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, dml := range lines {
+		if _, err := stmt.Exec(id, dml.Key, dml.Sheet, dml.Cellref, dml.Type); err != nil {
+			return 0, fmt.Errorf("cannot insert datamap line %s - %v", dml.Key, err)
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// datamapColumns are the columns read by scanDatamap.
+const datamapColumns = "datamap.id, datamap.name, datamap.date_created, datamap.owner_id, datamap.visibility"
+
+// scanDatamap scans a row of datamapColumns into a Datamap.
+func scanDatamap(row interface{ Scan(...any) error }) (Datamap, error) {
+	var (
+		dm    Datamap
+		owner sql.NullInt64
+	)
+	err := row.Scan(&dm.ID, &dm.Name, (*timeValue)(&dm.Created), &owner, &dm.Visibility)
+	dm.OwnerID = owner.Int64
+	return dm, err
+}
+
+func (s *sqlStore) Datamaps(opts ListOptions) ([]Datamap, string, error) {
+	q := listQuery[Datamap]{
+		query:    "SELECT " + datamapColumns + " FROM datamap WHERE 1=1",
+		idColumn: "datamap.id",
+		id:       func(dm Datamap) int64 { return dm.ID },
+		sorts: map[string]sortKey[Datamap]{
+			"":        {},
+			"created": {},
+			"name":    {"datamap.name", func(dm Datamap) any { return dm.Name }},
+		},
+		scan: func(rows *sql.Rows) (Datamap, error) { return scanDatamap(rows) },
+	}
+	q.contains("datamap.name", opts.Query)
+	q.visibleTo("datamap", opts.UserID)
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) GetDatamap(name string) (Datamap, error) {
+	dm, err := scanDatamap(s.DB.QueryRow(s.bind("SELECT "+datamapColumns+" FROM datamap WHERE name=?"), name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return dm, ErrNoRecord
+	}
+	return dm, err
+}
+
+func (s *sqlStore) DatamapLines(name string) ([]DatamapLine, error) {
+	rows, err := s.DB.Query(s.bind(`SELECT datamap_line.id, key, sheet, cellref, type FROM datamap_line
+		JOIN datamap ON datamap_line.dm_id = datamap.id
+		WHERE datamap.name = ? ORDER BY datamap_line.id`), name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query for datamap key, sheet and cellref - %v", err)
+	}
+	defer rows.Close()
+
+	out := []DatamapLine{}
+	for rows.Next() {
+		var (
+			dml     DatamapLine
+			cellref sql.NullString
+		)
+		if err := rows.Scan(&dml.ID, &dml.Key, &dml.Sheet, &cellref, &dml.Type); err != nil {
+			return nil, err
+		}
+		dml.Cellref = cellref.String
+		out = append(out, dml)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) ListLines(name string, opts ListOptions) ([]DatamapLine, string, error) {
+	q := listQuery[DatamapLine]{
+		query: `SELECT datamap_line.id, key, sheet, cellref, type FROM datamap_line
+			JOIN datamap ON datamap_line.dm_id = datamap.id
+			WHERE datamap.name = ?`,
+		args:     []any{name},
+		idColumn: "datamap_line.id",
+		id:       func(l DatamapLine) int64 { return l.ID },
+		sorts: map[string]sortKey[DatamapLine]{
+			"":      {},
+			"key":   {"datamap_line.key", func(l DatamapLine) any { return l.Key }},
+			"sheet": {"datamap_line.sheet", func(l DatamapLine) any { return l.Sheet }},
+		},
+		scan: func(rows *sql.Rows) (DatamapLine, error) {
+			var (
+				dml     DatamapLine
+				cellref sql.NullString
+			)
+			err := rows.Scan(&dml.ID, &dml.Key, &dml.Sheet, &cellref, &dml.Type)
+			dml.Cellref = cellref.String
+			return dml, err
+		},
+	}
+	q.contains("datamap_line.key", opts.Query)
+	if opts.Like != "" {
+		q.like("datamap_line.key", []string{opts.Like})
+	}
+	if opts.Sheet != "" {
+		q.where("datamap_line.sheet = ?", opts.Sheet)
+	}
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) SearchLines(q string) ([]LineMatch, error) {
+	rows, err := s.DB.Query(s.bind(`SELECT datamap_line.id, key, sheet, cellref, datamap.name FROM datamap_line
+		JOIN datamap ON datamap_line.dm_id = datamap.id
+		WHERE lower(key) LIKE ? ESCAPE '\' ORDER BY datamap.id, datamap_line.id`), "%"+escapeLike(strings.ToLower(q))+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []LineMatch{}
+	for rows.Next() {
+		var (
+			m       LineMatch
+			cellref sql.NullString
+		)
+		if err := rows.Scan(&m.ID, &m.Key, &m.Sheet, &cellref, &m.Datamap); err != nil {
+			return nil, err
+		}
+		m.Cellref = cellref.String
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// escapeLike escapes the wildcard characters in s so that it can be
+// matched literally by LIKE ... ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// returnColumns are the columns read by scanReturn.
+const returnColumns = "return.id, return.name, return.date_created, return.owner_id, return.visibility"
+
+// scanReturn scans a row of returnColumns into a Return.
+func scanReturn(row interface{ Scan(...any) error }) (Return, error) {
+	var (
+		r     Return
+		owner sql.NullInt64
+	)
+	err := row.Scan(&r.ID, &r.Name, (*timeValue)(&r.Created), &owner, &r.Visibility)
+	r.OwnerID = owner.Int64
+	return r, err
+}
+
+func (s *sqlStore) GetReturn(name string) (Return, error) {
+	r, err := scanReturn(s.DB.QueryRow(s.bind("SELECT "+returnColumns+" FROM return WHERE name=?"), name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, ErrNoRecord
+	}
+	return r, err
+}
+
+func (s *sqlStore) InsertReturn(r Return) (Return, error) {
+	r.Created = time.Now().UTC()
+	r.Visibility = visibilityOrDefault(r.Visibility)
+	err := s.DB.QueryRow(s.bind("INSERT INTO return (name, date_created, owner_id, visibility) VALUES(?,?,?,?) RETURNING id"),
+		r.Name, r.Created, nullID(r.OwnerID), r.Visibility).Scan(&r.ID)
+	if err != nil {
+		if s.isDuplicate(err) {
+			return r, ErrDuplicateName
+		}
+		return r, fmt.Errorf("cannot create return %s - %v", r.Name, err)
+	}
+	return r, nil
+}
+
+func (s *sqlStore) GetOrCreateReturn(name string) (Return, error) {
+	r, err := s.GetReturn(name)
+	if !errors.Is(err, ErrNoRecord) {
+		return r, err
+	}
+	r, err = s.InsertReturn(Return{Name: name})
+	if errors.Is(err, ErrDuplicateName) {
+		// Another import created it first.
+		return s.GetReturn(name)
+	}
+	return r, err
+}
+
+func (s *sqlStore) Returns(opts ListOptions) ([]Return, string, error) {
+	q := listQuery[Return]{
+		query:    "SELECT " + returnColumns + " FROM return WHERE 1=1",
+		idColumn: "return.id",
+		id:       func(r Return) int64 { return r.ID },
+		sorts: map[string]sortKey[Return]{
+			"":        {},
+			"created": {},
+			"name":    {"return.name", func(r Return) any { return r.Name }},
+		},
+		scan: func(rows *sql.Rows) (Return, error) { return scanReturn(rows) },
+	}
+	q.contains("return.name", opts.Query)
+	q.visibleTo("return", opts.UserID)
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) InsertReturnData(data []ReturnData) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start a database transaction - %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.insertReturnData(tx, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ReplaceReturnData(dmID, retID int64, filename string, data []ReturnData) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start a database transaction - %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.bind(`DELETE FROM return_data WHERE ret_id = ? AND filename = ?
+		AND dml_id IN (SELECT id FROM datamap_line WHERE dm_id = ?)`), retID, filename, dmID); err != nil {
+		return fmt.Errorf("cannot delete return data previously imported from %s - %v", filename, err)
+	}
+	if err := s.insertReturnData(tx, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertReturnData stores data as part of tx.
+func (s *sqlStore) insertReturnData(tx *sql.Tx, data []ReturnData) error {
+	stmt, err := tx.Prepare(s.bind(`INSERT INTO return_data (dml_id, ret_id, filename, value, numfmt, vFormatted)
+		VALUES(?,?,?,?,?,?)`))
+	if err != nil {
+		return fmt.Errorf("cannot prepare a statement to insert return data - %v", err)
+	}
+	defer stmt.Close()
+
+	for _, d := range data {
+		if _, err := stmt.Exec(d.DatamapLineID, d.ReturnID, d.Filename, d.Value, d.NumFmt, d.Formatted); err != nil {
+			return fmt.Errorf("cannot execute statement to insert return data - %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) ReturnDatamaps(name string) ([]Datamap, error) {
+	rows, err := s.DB.Query(s.bind(`SELECT DISTINCT `+datamapColumns+`
+		FROM return_data
+		INNER JOIN datamap_line ON return_data.dml_id = datamap_line.id
+		INNER JOIN datamap ON datamap_line.dm_id = datamap.id
+		INNER JOIN return ON return_data.ret_id = return.id
+		WHERE return.name = ?
+		ORDER BY datamap.id`), name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Datamap{}
+	for rows.Next() {
+		dm, err := scanDatamap(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, dm)
+	}
+	return out, rows.Err()
+}
+
+// returnValueQuery selects the ReturnValues in return_data, joined to
+// datamap, datamap_line and return.
+const returnValueQuery = `SELECT return_data.id, datamap_line.key, datamap_line.sheet, datamap_line.cellref,
+		return_data.filename, return_data.value, return_data.numfmt, return_data.vFormatted
+	FROM return_data
+	INNER JOIN datamap_line ON return_data.dml_id = datamap_line.id
+	INNER JOIN datamap ON datamap_line.dm_id = datamap.id
+	INNER JOIN return ON return_data.ret_id = return.id
+	WHERE datamap.name = ? AND return.name = ?`
+
+// scanReturnValue scans a row of returnValueQuery into a ReturnValue.
+func scanReturnValue(row interface{ Scan(...any) error }) (ReturnValue, error) {
+	var (
+		rv                                ReturnValue
+		cellref, value, numfmt, formatted sql.NullString
+	)
+	err := row.Scan(&rv.ID, &rv.Key, &rv.Sheet, &cellref, &rv.Filename, &value, &numfmt, &formatted)
+	rv.Cellref, rv.Value, rv.NumFmt, rv.Formatted = cellref.String, value.String, numfmt.String, formatted.String
+	return rv, err
+}
+
+func (s *sqlStore) ReturnValues(dmName, returnName string) ([]ReturnValue, error) {
+	rows, err := s.DB.Query(s.bind(returnValueQuery+" ORDER BY return_data.filename, datamap_line.id"), dmName, returnName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []ReturnValue{}
+	for rows.Next() {
+		rv, err := scanReturnValue(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rv)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) ReturnFiles(dmName, returnName string) ([]string, error) {
+	rows, err := s.DB.Query(s.bind(`SELECT DISTINCT return_data.filename
+		FROM return_data
+		INNER JOIN datamap_line ON return_data.dml_id = datamap_line.id
+		INNER JOIN datamap ON datamap_line.dm_id = datamap.id
+		INNER JOIN return ON return_data.ret_id = return.id
+		WHERE datamap.name = ? AND return.name = ?
+		ORDER BY return_data.filename`), dmName, returnName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) ListReturnValues(dmName, returnName string, opts ListOptions) ([]ReturnValue, string, error) {
+	q := listQuery[ReturnValue]{
+		query:    returnValueQuery,
+		args:     []any{dmName, returnName},
+		idColumn: "return_data.id",
+		id:       func(rv ReturnValue) int64 { return rv.ID },
+		sorts: map[string]sortKey[ReturnValue]{
+			"":         {},
+			"key":      {"datamap_line.key", func(rv ReturnValue) any { return rv.Key }},
+			"filename": {"return_data.filename", func(rv ReturnValue) any { return rv.Filename }},
+		},
+		scan: func(rows *sql.Rows) (ReturnValue, error) { return scanReturnValue(rows) },
+	}
+	q.contains("datamap_line.key", opts.Query)
+	if opts.Sheet != "" {
+		q.where("datamap_line.sheet = ?", opts.Sheet)
+	}
+	if opts.Key != "" {
+		q.where("datamap_line.key = ?", opts.Key)
+	}
+	if opts.Filename != "" {
+		q.where("return_data.filename = ?", opts.Filename)
+	}
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) KeyHistory(key, filename string, opts ListOptions) ([]KeyValue, string, error) {
+	q := listQuery[KeyValue]{
+		query: `SELECT ` + returnColumns + `, ` + datamapColumns + `,
+				return_data.id, return_data.filename, return_data.value, return_data.vFormatted
+			FROM return_data
+			INNER JOIN datamap_line ON return_data.dml_id = datamap_line.id
+			INNER JOIN datamap ON datamap_line.dm_id = datamap.id
+			INNER JOIN return ON return_data.ret_id = return.id
+			WHERE datamap_line.key = ?`,
+		args:     []any{key},
+		idColumn: "return_data.id",
+		id:       func(kv KeyValue) int64 { return kv.ID },
+		// Returns created at the same time are kept apart by their id.
+		then: sortKey[KeyValue]{"return.id", func(kv KeyValue) any { return kv.Return.ID }},
+		sorts: map[string]sortKey[KeyValue]{
+			"": {"return.date_created", func(kv KeyValue) any { return kv.Return.Created }},
+		},
+		scan: func(rows *sql.Rows) (KeyValue, error) {
+			var (
+				kv                KeyValue
+				retOwner, dmOwner sql.NullInt64
+				value, formatted  sql.NullString
+			)
+			err := rows.Scan(&kv.Return.ID, &kv.Return.Name, (*timeValue)(&kv.Return.Created), &retOwner, &kv.Return.Visibility,
+				&kv.Datamap.ID, &kv.Datamap.Name, (*timeValue)(&kv.Datamap.Created), &dmOwner, &kv.Datamap.Visibility,
+				&kv.ID, &kv.Filename, &value, &formatted)
+			kv.Return.OwnerID, kv.Datamap.OwnerID = retOwner.Int64, dmOwner.Int64
+			kv.Value, kv.Formatted = value.String, formatted.String
+			return kv, err
+		},
+	}
+	if filename != "" {
+		q.where("return_data.filename = ?", filename)
+	}
+	q.visibleTo("return", opts.UserID)
+	q.visibleTo("datamap", opts.UserID)
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) QueryValues(f ValueFilter, opts ListOptions) ([]QueryValue, string, error) {
+	q := listQuery[QueryValue]{
+		query: `SELECT return_data.id, datamap.name, return.name, datamap_line.key, datamap_line.sheet,
+				datamap_line.cellref, return_data.filename, return_data.value, return_data.vFormatted
+			FROM return_data
+			INNER JOIN datamap_line ON return_data.dml_id = datamap_line.id
+			INNER JOIN datamap ON datamap_line.dm_id = datamap.id
+			INNER JOIN return ON return_data.ret_id = return.id
+			WHERE 1=1`,
+		idColumn: "return_data.id",
+		id:       func(v QueryValue) int64 { return v.ID },
+		sorts: map[string]sortKey[QueryValue]{
+			"":         {},
+			"key":      {"datamap_line.key", func(v QueryValue) any { return v.Key }},
+			"sheet":    {"datamap_line.sheet", func(v QueryValue) any { return v.Sheet }},
+			"filename": {"return_data.filename", func(v QueryValue) any { return v.Filename }},
+			"return":   {"return.name", func(v QueryValue) any { return v.Return }},
+			"datamap":  {"datamap.name", func(v QueryValue) any { return v.Datamap }},
+		},
+		scan: func(rows *sql.Rows) (QueryValue, error) {
+			var (
+				v                         QueryValue
+				cellref, value, formatted sql.NullString
+			)
+			err := rows.Scan(&v.ID, &v.Datamap, &v.Return, &v.Key, &v.Sheet, &cellref, &v.Filename, &value, &formatted)
+			v.Cellref, v.Value, v.Formatted = cellref.String, value.String, formatted.String
+			return v, err
+		},
+	}
+	q.like("datamap_line.key", f.Keys)
+	q.like("datamap_line.sheet", f.Sheets)
+	q.like("return_data.filename", f.Files)
+	q.like("return.name", f.Returns)
+	q.like("datamap.name", f.Datamaps)
+	q.visibleTo("return", opts.UserID)
+	q.visibleTo("datamap", opts.UserID)
+	return list(s, q, opts)
+}
+
+// nullID returns id as a value for a nullable foreign key column,
+// where 0 means NULL.
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// visibilityOrDefault returns v, or Public if v is empty.
+func visibilityOrDefault(v string) string {
+	if v == "" {
+		return Public
+	}
+	return v
+}
+
+// timeValue scans a date_created column, which holds a time.Time in Postgres
+// but may be text in SQLite databases created by earlier versions.
+type timeValue time.Time
+
+// timeLayouts are the formats in which SQLite may hold a date_created value.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05",
+}
+
+func (t *timeValue) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*t = timeValue(time.Time{})
+		return nil
+	case time.Time:
+		*t = timeValue(v)
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a time", src)
+	}
+
+	// time.Time.String() can add a monotonic clock reading, which we discard.
+	if i := strings.Index(s, " m="); i != -1 {
+		s = s[:i]
+	}
+	for _, layout := range timeLayouts {
+		if tt, err := time.Parse(layout, s); err == nil {
+			*t = timeValue(tt)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse %q as a time", s)
+}
@@ -0,0 +1,388 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// postgresDSNEnv names the environment variable holding the DSN of an empty
+// PostgreSQL database used to run the Store tests against PostgresStore.
+const postgresDSNEnv = "DATAMAPS_TEST_POSTGRES_DSN"
+
+// testStores returns each Store implementation that can be tested here.
+// PostgresStore is only included when postgresDSNEnv is set.
+func testStores(t *testing.T) map[string]func(t *testing.T) Store {
+	t.Helper()
+
+	return map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store {
+			s, err := Open(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			if _, err := s.MigrateUp(); err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		"postgres": func(t *testing.T) Store {
+			dsn := os.Getenv(postgresDSNEnv)
+			if dsn == "" {
+				t.Skipf("%s not set", postgresDSNEnv)
+			}
+			s, err := Open(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pg := s.(*PostgresStore)
+			drop := func() {
+				pg.DB.Exec("DROP TABLE IF EXISTS webhook_deliveries, webhooks, job_files, jobs, api_tokens, sessions, users, return_data, return, datamap_line, datamap, schema_version CASCADE")
+			}
+			drop()
+			t.Cleanup(func() {
+				drop()
+				s.Close()
+			})
+			if _, err := s.MigrateUp(); err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+}
+
+// runStoreTest runs test against every Store implementation.
+func runStoreTest(t *testing.T, test func(t *testing.T, s Store)) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			test(t, open(t))
+		})
+	}
+}
+
+var testLines = []DatamapLine{
+	{Key: "Project Name", Sheet: "Introduction", Cellref: "C9"},
+	{Key: "Department", Sheet: "Introduction", Cellref: "C10"},
+	{Key: "Total RDEL", Sheet: "Finance", Cellref: "B4", Type: TypeNumber},
+}
+
+func TestStoreDatamaps(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if _, err := s.GetDatamap("Tonk 1"); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for a missing datamap, got %v", err)
+		}
+
+		id, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, testLines)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dm, err := s.GetDatamap("Tonk 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dm.ID != id || dm.Name != "Tonk 1" {
+			t.Errorf("expected datamap %d named Tonk 1, got %d named %s", id, dm.ID, dm.Name)
+		}
+		if dm.Created.IsZero() {
+			t.Error("expected the datamap to have a creation date")
+		}
+		if _, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, testLines); !errors.Is(err, ErrDuplicateName) {
+			t.Errorf("expected ErrDuplicateName for a second datamap named Tonk 1, got %v", err)
+		}
+
+		dms, _, err := s.Datamaps(ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dms) != 1 {
+			t.Errorf("expected 1 datamap, got %d", len(dms))
+		}
+
+		lines, err := s.DatamapLines("Tonk 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != len(testLines) {
+			t.Fatalf("expected %d lines, got %d", len(testLines), len(lines))
+		}
+		for i, l := range lines {
+			if l.Key != testLines[i].Key || l.Sheet != testLines[i].Sheet || l.Cellref != testLines[i].Cellref || l.Type != testLines[i].Type {
+				t.Errorf("expected line %d to be %v, got %v", i, testLines[i], l)
+			}
+		}
+	})
+}
+
+func TestStoreReturns(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		dmID, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, testLines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines, err := s.DatamapLines("Tonk 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.GetReturn("Q1"); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for a missing return, got %v", err)
+		}
+
+		r, err := s.GetOrCreateReturn("Q1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := s.GetOrCreateReturn("Q1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ID != again.ID {
+			t.Errorf("expected GetOrCreateReturn to return existing return %d, got %d", r.ID, again.ID)
+		}
+		if _, err := s.InsertReturn(Return{Name: "Q1"}); !errors.Is(err, ErrDuplicateName) {
+			t.Errorf("expected ErrDuplicateName for a second return named Q1, got %v", err)
+		}
+
+		data := []ReturnData{
+			{DatamapLineID: lines[0].ID, ReturnID: r.ID, Filename: "b.xlsx", Value: "Bobbins", Formatted: "Bobbins"},
+			{DatamapLineID: lines[2].ID, ReturnID: r.ID, Filename: "a.xlsx", Value: "2.2", NumFmt: "0.0", Formatted: "2.2"},
+		}
+		if err := s.InsertReturnData(data); err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := s.ReturnValues("Tonk 1", "Q1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 2 {
+			t.Fatalf("expected 2 values, got %d", len(values))
+		}
+		want := ReturnValue{Key: "Total RDEL", Sheet: "Finance", Cellref: "B4", Filename: "a.xlsx", Value: "2.2", NumFmt: "0.0", Formatted: "2.2"}
+		want.ID = values[0].ID
+		if values[0] != want {
+			t.Errorf("expected %v, got %v", want, values[0])
+		}
+
+		files, err := s.ReturnFiles("Tonk 1", "Q1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(files, []string{"a.xlsx", "b.xlsx"}) {
+			t.Errorf("expected files a.xlsx and b.xlsx, got %v", files)
+		}
+
+		values, _, err = s.ListReturnValues("Tonk 1", "Q1", ListOptions{Key: "Total RDEL", Filename: "a.xlsx"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 1 || values[0] != want {
+			t.Errorf("expected only %v, got %v", want, values)
+		}
+		values, _, err = s.ListReturnValues("Tonk 1", "Q1", ListOptions{Key: "Total RDEL", Filename: "b.xlsx"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 0 {
+			t.Errorf("expected no values, got %v", values)
+		}
+
+		// Importing a.xlsx again replaces its value and leaves b.xlsx alone.
+		replacement := []ReturnData{{DatamapLineID: lines[2].ID, ReturnID: r.ID, Filename: "a.xlsx", Value: "3.3", Formatted: "3.3"}}
+		if err := s.ReplaceReturnData(dmID, r.ID, "a.xlsx", replacement); err != nil {
+			t.Fatal(err)
+		}
+		values, err = s.ReturnValues("Tonk 1", "Q1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 2 || values[0].Value != "3.3" || values[1].Filename != "b.xlsx" {
+			t.Errorf("expected a.xlsx's value to be replaced, got %v", values)
+		}
+
+		dms, err := s.ReturnDatamaps("Q1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dms) != 1 || dms[0].Name != "Tonk 1" {
+			t.Errorf("expected return Q1 to use datamap Tonk 1, got %v", dms)
+		}
+
+		rs, _, err := s.Returns(ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 1 || rs[0].Name != "Q1" {
+			t.Errorf("expected a single return named Q1, got %v", rs)
+		}
+	})
+}
+
+func TestStoreKeyHistory(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if _, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, testLines); err != nil {
+			t.Fatal(err)
+		}
+		lines, err := s.DatamapLines("Tonk 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Returns are created out of name order to check the ordering is by date.
+		for i, name := range []string{"Q2", "Q1"} {
+			r, err := s.InsertReturn(Return{Name: name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := []ReturnData{
+				{DatamapLineID: lines[2].ID, ReturnID: r.ID, Filename: "a.xlsx", Value: fmt.Sprint(i + 1), Formatted: fmt.Sprint(i + 1)},
+				{DatamapLineID: lines[2].ID, ReturnID: r.ID, Filename: "b.xlsx", Value: "9", Formatted: "9"},
+				{DatamapLineID: lines[0].ID, ReturnID: r.ID, Filename: "a.xlsx", Value: "Bobbins", Formatted: "Bobbins"},
+			}
+			if err := s.InsertReturnData(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		history, _, err := s.KeyHistory("Total RDEL", "a.xlsx", ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("expected 2 values, got %d", len(history))
+		}
+		for i, want := range []struct{ ret, value string }{{"Q2", "1"}, {"Q1", "2"}} {
+			got := history[i]
+			if got.Return.Name != want.ret || got.Value != want.value || got.Datamap.Name != "Tonk 1" {
+				t.Errorf("expected %s = %s at %d, got %+v", want.ret, want.value, i, got)
+			}
+		}
+
+		if all, _, _ := s.KeyHistory("Total RDEL", "", ListOptions{}); len(all) != 4 {
+			t.Errorf("expected 4 values across all files, got %d", len(all))
+		}
+
+		var paged []KeyValue
+		opts := ListOptions{Limit: 1}
+		for {
+			page, next, err := s.KeyHistory("Total RDEL", "", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paged = append(paged, page...)
+			if next == "" {
+				break
+			}
+			opts.Cursor = next
+		}
+		if len(paged) != 4 || paged[0].Return.Name != "Q2" || paged[1].Return.Name != "Q2" || paged[3].Return.Name != "Q1" {
+			t.Errorf("expected 4 values paged in date order, got %+v", paged)
+		}
+		if none, _, _ := s.KeyHistory("Bobbins", "", ListOptions{}); len(none) != 0 {
+			t.Errorf("expected no values for an unknown key, got %d", len(none))
+		}
+	})
+}
+
+func TestStoreQueryValues(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if _, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, testLines); err != nil {
+			t.Fatal(err)
+		}
+		lines, err := s.DatamapLines("Tonk 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range []string{"Q1 2026", "Q2 2026"} {
+			r, err := s.InsertReturn(Return{Name: name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := []ReturnData{
+				{DatamapLineID: lines[2].ID, ReturnID: r.ID, Filename: "a.xlsx", Value: fmt.Sprint(i + 1)},
+				{DatamapLineID: lines[2].ID, ReturnID: r.ID, Filename: "b.xlsx", Value: "9"},
+				{DatamapLineID: lines[0].ID, ReturnID: r.ID, Filename: "a.xlsx", Value: "Bobbins"},
+			}
+			if err := s.InsertReturnData(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name   string
+			filter ValueFilter
+			want   int
+		}{
+			{"everything", ValueFilter{}, 6},
+			{"key", ValueFilter{Keys: []string{"total rdel"}}, 4},
+			{"key pattern", ValueFilter{Keys: []string{"Total%"}}, 4},
+			{"keys", ValueFilter{Keys: []string{"Total%", lines[0].Key}}, 6},
+			{"file and return", ValueFilter{Files: []string{"a.%"}, Returns: []string{"Q2%"}}, 2},
+			{"single character", ValueFilter{Returns: []string{"Q_ 2026"}}, 6},
+			{"literal percent", ValueFilter{Keys: []string{`Total\%`}}, 0},
+			{"datamap", ValueFilter{Datamaps: []string{"Tonk 2"}}, 0},
+			{"quote", ValueFilter{Keys: []string{"'; DROP TABLE return_data; --"}}, 0},
+		}
+		for _, tt := range tests {
+			values, _, err := s.QueryValues(tt.filter, ListOptions{})
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if len(values) != tt.want {
+				t.Errorf("%s: expected %d values, got %d", tt.name, tt.want, len(values))
+			}
+		}
+
+		values, _, err := s.QueryValues(ValueFilter{Files: []string{"a.xlsx"}, Keys: []string{"Total RDEL"}}, ListOptions{Sort: "-return"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 2 || values[0].Return != "Q2 2026" || values[0].Value != "2" || values[0].Datamap != "Tonk 1" || values[0].Sheet != lines[2].Sheet {
+			t.Errorf("unexpected values %+v", values)
+		}
+	})
+}
+
+func TestBindDollar(t *testing.T) {
+	got := bindDollar("SELECT a FROM b WHERE c=? AND d=?")
+	if want := "SELECT a FROM b WHERE c=$1 AND d=$2"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestStoreSearchLines(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if _, err := s.InsertDatamap(Datamap{Name: "Tonk 1"}, testLines); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.InsertDatamap(Datamap{Name: "Tonk 2"}, append(testLines, DatamapLine{Key: "RDEL_100%", Sheet: "Finance", Cellref: "B5"})); err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			q    string
+			want int
+		}{
+			{"rdel", 3},
+			{"Department", 2},
+			{"_100%", 1},
+			{"%", 1},
+			{"bobbins", 0},
+		}
+		for _, tt := range tests {
+			got, err := s.SearchLines(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("expected %d matches for %q, got %d", tt.want, tt.q, len(got))
+			}
+		}
+	})
+}
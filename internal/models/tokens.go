@@ -0,0 +1,117 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Scopes of API tokens.
+const (
+	// ScopeRead tokens can only make requests which do not change data.
+	ScopeRead = "read"
+
+	// ScopeReadWrite tokens can make any request their user can.
+	ScopeReadWrite = "read-write"
+)
+
+// ErrInvalidScope is returned when creating an API token with a scope
+// other than ScopeRead or ScopeReadWrite.
+var ErrInvalidScope = errors.New("models: invalid token scope")
+
+// APIToken is a long-lived token with which a user's scripts can call the
+// server. Only a hash of the token itself is stored.
+type APIToken struct {
+	ID       int64     `json:"id"`
+	UserID   int64     `json:"user_id"`
+	Name     string    `json:"name"`
+	Scope    string    `json:"scope"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// CanWrite reports whether t allows requests which change data.
+func (t APIToken) CanWrite() bool {
+	return t.Scope == ScopeReadWrite
+}
+
+func (s *sqlStore) CreateToken(userID int64, name, scope string) (APIToken, string, error) {
+	if scope != ScopeRead && scope != ScopeReadWrite {
+		return APIToken{}, "", ErrInvalidScope
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+
+	t := APIToken{UserID: userID, Name: name, Scope: scope, Created: time.Now().UTC()}
+	err = s.DB.QueryRow(s.bind("INSERT INTO api_tokens (user_id, name, token_hash, scope, created) VALUES(?,?,?,?,?) RETURNING id"),
+		t.UserID, t.Name, hash, t.Scope, t.Created).Scan(&t.ID)
+	if err != nil {
+		return APIToken{}, "", fmt.Errorf("cannot create token %s - %v", name, err)
+	}
+	return t, token, nil
+}
+
+// tokenColumns are the columns read by scanToken.
+const tokenColumns = "api_tokens.id, api_tokens.user_id, api_tokens.name, api_tokens.scope, api_tokens.created, api_tokens.last_used"
+
+// scanToken scans a row of tokenColumns into an APIToken.
+func scanToken(row interface{ Scan(...any) error }) (APIToken, error) {
+	var t APIToken
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Scope, (*timeValue)(&t.Created), (*timeValue)(&t.LastUsed))
+	return t, err
+}
+
+func (s *sqlStore) Tokens(userID int64, opts ListOptions) ([]APIToken, string, error) {
+	q := listQuery[APIToken]{
+		query:    "SELECT " + tokenColumns + " FROM api_tokens WHERE user_id = ?",
+		args:     []any{userID},
+		idColumn: "api_tokens.id",
+		id:       func(t APIToken) int64 { return t.ID },
+		sorts: map[string]sortKey[APIToken]{
+			"":        {},
+			"created": {},
+			"name":    {"api_tokens.name", func(t APIToken) any { return t.Name }},
+		},
+		scan: func(rows *sql.Rows) (APIToken, error) { return scanToken(rows) },
+	}
+	q.contains("api_tokens.name", opts.Query)
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) DeleteToken(userID, id int64) error {
+	res, err := s.DB.Exec(s.bind("DELETE FROM api_tokens WHERE id=? AND user_id=?"), id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+func (s *sqlStore) TokenUser(token string) (User, APIToken, error) {
+	var t APIToken
+	u, err := scanUser(scanFunc(func(dest ...any) error {
+		return s.DB.QueryRow(s.bind(`SELECT `+userColumns+`, `+tokenColumns+` FROM api_tokens
+			JOIN users ON api_tokens.user_id = users.id
+			WHERE api_tokens.token_hash=?`), hashToken(token)).Scan(append(dest,
+			&t.ID, &t.UserID, &t.Name, &t.Scope, (*timeValue)(&t.Created), (*timeValue)(&t.LastUsed))...)
+	}))
+	if err != nil {
+		return User{}, APIToken{}, err
+	}
+
+	t.LastUsed = time.Now().UTC()
+	if _, err := s.DB.Exec(s.bind("UPDATE api_tokens SET last_used=? WHERE id=?"), t.LastUsed, t.ID); err != nil {
+		return User{}, APIToken{}, err
+	}
+	return u, t, nil
+}
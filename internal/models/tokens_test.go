@@ -0,0 +1,63 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTokens(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		alice, err := s.InsertUser("alice", "pa55word")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := s.InsertUser("bob", "pa55word")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := s.CreateToken(alice, "ci", "admin"); !errors.Is(err, ErrInvalidScope) {
+			t.Errorf("expected ErrInvalidScope, got %v", err)
+		}
+
+		tok, secret, err := s.CreateToken(alice, "ci", ScopeRead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.CanWrite() {
+			t.Error("expected a read token not to allow writes")
+		}
+
+		u, got, err := s.TokenUser(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != alice || got.ID != tok.ID || got.Scope != ScopeRead || got.LastUsed.IsZero() {
+			t.Errorf("unexpected token user %v and token %+v", u, got)
+		}
+		if _, _, err := s.TokenUser("bobbins"); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for an unknown token, got %v", err)
+		}
+
+		toks, _, err := s.Tokens(alice, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(toks) != 1 || toks[0].Name != "ci" {
+			t.Errorf("expected alice's ci token, got %+v", toks)
+		}
+		if toks, _, _ := s.Tokens(bob, ListOptions{}); len(toks) != 0 {
+			t.Errorf("expected bob to have no tokens, got %+v", toks)
+		}
+
+		if err := s.DeleteToken(bob, tok.ID); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord deleting another user's token, got %v", err)
+		}
+		if err := s.DeleteToken(alice, tok.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.TokenUser(secret); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for a revoked token, got %v", err)
+		}
+	})
+}
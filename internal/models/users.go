@@ -0,0 +1,167 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptCost is the cost used when hashing passwords.
+const bcryptCost = 12
+
+// User is someone who can log in to the server.
+type User struct {
+	ID             int64     `json:"id"`
+	Name           string    `json:"name"`
+	HashedPassword []byte    `json:"-"`
+	Created        time.Time `json:"created"`
+}
+
+// newToken returns a random token suitable for identifying a session,
+// along with the hash of it which is kept in the database.
+func newToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash of token as stored in the database. Tokens are
+// long and random so a fast hash is sufficient, unlike passwords.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *sqlStore) InsertUser(name, password string) (int64, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = s.DB.QueryRow(s.bind("INSERT INTO users (name, hashed_password, created) VALUES(?,?,?) RETURNING id"),
+		name, string(hashedPassword), time.Now().UTC()).Scan(&id)
+	if err != nil {
+		if s.isDuplicate(err) {
+			return 0, ErrDuplicateName
+		}
+		return 0, fmt.Errorf("cannot create user %s - %v", name, err)
+	}
+	return id, nil
+}
+
+func (s *sqlStore) Authenticate(name, password string) (int64, error) {
+	u, err := s.GetUserByName(name)
+	if errors.Is(err, ErrNoRecord) {
+		return 0, ErrInvalidCredentials
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return 0, ErrInvalidCredentials
+	}
+	if err != nil {
+		return 0, err
+	}
+	return u.ID, nil
+}
+
+// userColumns are the columns read by scanUser.
+const userColumns = "users.id, users.name, users.hashed_password, users.created"
+
+// scanUser scans a row of userColumns into a User.
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var (
+		u      User
+		hashed string
+	)
+	err := row.Scan(&u.ID, &u.Name, &hashed, (*timeValue)(&u.Created))
+	u.HashedPassword = []byte(hashed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrNoRecord
+	}
+	return u, err
+}
+
+func (s *sqlStore) GetUser(id int64) (User, error) {
+	return scanUser(s.DB.QueryRow(s.bind("SELECT "+userColumns+" FROM users WHERE id=?"), id))
+}
+
+func (s *sqlStore) GetUserByName(name string) (User, error) {
+	return scanUser(s.DB.QueryRow(s.bind("SELECT "+userColumns+" FROM users WHERE name=?"), name))
+}
+
+func (s *sqlStore) Users() ([]User, error) {
+	rows, err := s.DB.Query("SELECT " + userColumns + " FROM users ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) CreateSession(userID int64, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.DB.Exec(s.bind("INSERT INTO sessions (token_hash, user_id, expiry) VALUES(?,?,?)"),
+		hash, userID, time.Now().Add(ttl).UTC())
+	if err != nil {
+		return "", fmt.Errorf("cannot create session - %v", err)
+	}
+	return token, nil
+}
+
+func (s *sqlStore) SessionUser(token string) (User, error) {
+	var expiry time.Time
+	u, err := scanUser(scanFunc(func(dest ...any) error {
+		return s.DB.QueryRow(s.bind(`SELECT `+userColumns+`, sessions.expiry FROM sessions
+			JOIN users ON sessions.user_id = users.id
+			WHERE sessions.token_hash=?`), hashToken(token)).Scan(append(dest, (*timeValue)(&expiry))...)
+	}))
+	if err != nil {
+		return u, err
+	}
+	if time.Now().After(expiry) {
+		s.DeleteSession(token)
+		return User{}, ErrNoRecord
+	}
+	return u, nil
+}
+
+func (s *sqlStore) DeleteSession(token string) error {
+	_, err := s.DB.Exec(s.bind("DELETE FROM sessions WHERE token_hash=?"), hashToken(token))
+	return err
+}
+
+// scanFunc adapts a func to the interface used by the scan helpers, so
+// that extra columns can be scanned alongside them.
+type scanFunc func(dest ...any) error
+
+func (f scanFunc) Scan(dest ...any) error {
+	return f(dest...)
+}
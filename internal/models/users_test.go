@@ -0,0 +1,106 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsers(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		id, err := s.InsertUser("alice", "pa55word")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.InsertUser("alice", "different"); !errors.Is(err, ErrDuplicateName) {
+			t.Errorf("expected ErrDuplicateName, got %v", err)
+		}
+
+		var tests = []struct {
+			name, password string
+			wantErr        error
+		}{
+			{"alice", "pa55word", nil},
+			{"alice", "wrong", ErrInvalidCredentials},
+			{"bob", "pa55word", ErrInvalidCredentials},
+		}
+		for _, tt := range tests {
+			got, err := s.Authenticate(tt.name, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Authenticate(%q, %q): expected error %v, got %v", tt.name, tt.password, tt.wantErr, err)
+			}
+			if tt.wantErr == nil && got != id {
+				t.Errorf("Authenticate(%q, %q): expected id %d, got %d", tt.name, tt.password, id, got)
+			}
+		}
+
+		u, err := s.GetUser(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Name != "alice" || string(u.HashedPassword) == "pa55word" {
+			t.Errorf("unexpected user %v", u)
+		}
+		if _, err := s.GetUser(id + 100); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for a missing user, got %v", err)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		id, err := s.InsertUser("alice", "pa55word")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := s.CreateSession(id, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.SessionUser(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != id {
+			t.Errorf("expected session for user %d, got %d", id, u.ID)
+		}
+
+		if err := s.DeleteSession(token); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.SessionUser(token); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for a deleted session, got %v", err)
+		}
+
+		expired, err := s.CreateSession(id, -time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.SessionUser(expired); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord for an expired session, got %v", err)
+		}
+	})
+}
+
+func TestVisibleTo(t *testing.T) {
+	var tests = []struct {
+		name string
+		dm   Datamap
+		user int64
+		want bool
+	}{
+		{"No owner", Datamap{Visibility: Private}, 2, true},
+		{"Owner", Datamap{OwnerID: 1, Visibility: Private}, 1, true},
+		{"Private", Datamap{OwnerID: 1, Visibility: Private}, 2, false},
+		{"Public", Datamap{OwnerID: 1, Visibility: Public}, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dm.VisibleTo(tt.user); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
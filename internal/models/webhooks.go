@@ -0,0 +1,186 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Events which webhooks can subscribe to.
+const (
+	// EventImportFinished is sent when an import job finishes.
+	EventImportFinished = "import.finished"
+
+	// EventMasterFinished is sent when a master build job finishes.
+	EventMasterFinished = "master.finished"
+)
+
+// Events are all the events which webhooks can subscribe to.
+var Events = []string{EventImportFinished, EventMasterFinished}
+
+// ErrInvalidEvent is returned when creating a webhook subscribed to an
+// event not in Events.
+var ErrInvalidEvent = errors.New("models: invalid webhook event")
+
+// Webhook is a URL to which a user's events are posted.
+type Webhook struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"user_id"`
+	URL    string `json:"url"`
+
+	// Secret signs the payloads posted to URL. It is only shown when the
+	// webhook is created.
+	Secret string `json:"-"`
+
+	// Events are the events the webhook is sent.
+	Events  []string  `json:"events"`
+	Created time.Time `json:"created"`
+}
+
+// Subscribed reports whether w is sent event.
+func (w Webhook) Subscribed(event string) bool {
+	return slices.Contains(w.Events, event)
+}
+
+// WebhookDelivery records an attempt to post an event to a webhook.
+type WebhookDelivery struct {
+	ID        int64 `json:"id"`
+	WebhookID int64 `json:"webhook_id"`
+
+	// Delivery identifies the event, and is the same for each attempt to
+	// deliver it.
+	Delivery string          `json:"delivery"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempt  int             `json:"attempt"`
+
+	// StatusCode is the status of the response, or 0 if there was none.
+	StatusCode int `json:"status_code"`
+
+	// Error is why the attempt failed, or empty if it succeeded.
+	Error   string    `json:"error"`
+	Created time.Time `json:"created"`
+}
+
+func (s *sqlStore) CreateWebhook(userID int64, url string, events []string) (Webhook, error) {
+	if len(events) == 0 {
+		events = Events
+	}
+	for _, e := range events {
+		if !slices.Contains(Events, e) {
+			return Webhook{}, fmt.Errorf("%w: %s", ErrInvalidEvent, e)
+		}
+	}
+
+	secret, _, err := newToken()
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	w := Webhook{UserID: userID, URL: url, Secret: secret, Events: events, Created: time.Now().UTC()}
+	err = s.DB.QueryRow(s.bind("INSERT INTO webhooks (user_id, url, secret, events, created) VALUES(?,?,?,?,?) RETURNING id"),
+		w.UserID, w.URL, w.Secret, strings.Join(w.Events, ","), w.Created).Scan(&w.ID)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("cannot create webhook %s - %v", url, err)
+	}
+	return w, nil
+}
+
+// webhookColumns are the columns read by scanWebhook.
+const webhookColumns = "webhooks.id, webhooks.user_id, webhooks.url, webhooks.secret, webhooks.events, webhooks.created"
+
+// scanWebhook scans a row of webhookColumns into a Webhook.
+func scanWebhook(row interface{ Scan(...any) error }) (Webhook, error) {
+	var (
+		w      Webhook
+		events string
+	)
+	err := row.Scan(&w.ID, &w.UserID, &w.URL, &w.Secret, &events, (*timeValue)(&w.Created))
+	w.Events = strings.Split(events, ",")
+	return w, err
+}
+
+func (s *sqlStore) GetWebhook(userID, id int64) (Webhook, error) {
+	w, err := scanWebhook(s.DB.QueryRow(s.bind("SELECT "+webhookColumns+" FROM webhooks WHERE id=? AND user_id=?"), id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return w, ErrNoRecord
+	}
+	return w, err
+}
+
+func (s *sqlStore) Webhooks(userID int64, opts ListOptions) ([]Webhook, string, error) {
+	q := listQuery[Webhook]{
+		query:    "SELECT " + webhookColumns + " FROM webhooks WHERE user_id = ?",
+		args:     []any{userID},
+		idColumn: "webhooks.id",
+		id:       func(w Webhook) int64 { return w.ID },
+		sorts: map[string]sortKey[Webhook]{
+			"":        {},
+			"created": {},
+			"url":     {"webhooks.url", func(w Webhook) any { return w.URL }},
+		},
+		scan: func(rows *sql.Rows) (Webhook, error) { return scanWebhook(rows) },
+	}
+	q.contains("webhooks.url", opts.Query)
+	return list(s, q, opts)
+}
+
+func (s *sqlStore) EventWebhooks(userID int64, event string) ([]Webhook, error) {
+	hooks, _, err := s.Webhooks(userID, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(hooks, func(w Webhook) bool { return !w.Subscribed(event) }), nil
+}
+
+func (s *sqlStore) DeleteWebhook(userID, id int64) error {
+	res, err := s.DB.Exec(s.bind("DELETE FROM webhooks WHERE id=? AND user_id=?"), id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+func (s *sqlStore) InsertDelivery(d WebhookDelivery) (WebhookDelivery, error) {
+	d.Created = time.Now().UTC()
+	err := s.DB.QueryRow(s.bind(`INSERT INTO webhook_deliveries
+		(webhook_id, delivery, event, payload, attempt, status_code, error, created)
+		VALUES(?,?,?,?,?,?,?,?) RETURNING id`),
+		d.WebhookID, d.Delivery, d.Event, string(d.Payload), d.Attempt, d.StatusCode, d.Error, d.Created).Scan(&d.ID)
+	return d, err
+}
+
+func (s *sqlStore) Deliveries(webhookID int64, opts ListOptions) ([]WebhookDelivery, string, error) {
+	q := listQuery[WebhookDelivery]{
+		query: `SELECT id, webhook_id, delivery, event, payload, attempt, status_code, error, created
+			FROM webhook_deliveries WHERE webhook_id = ?`,
+		args:     []any{webhookID},
+		idColumn: "id",
+		id:       func(d WebhookDelivery) int64 { return d.ID },
+		sorts: map[string]sortKey[WebhookDelivery]{
+			"":        {},
+			"created": {},
+		},
+		scan: func(rows *sql.Rows) (WebhookDelivery, error) {
+			var (
+				d       WebhookDelivery
+				payload string
+			)
+			err := rows.Scan(&d.ID, &d.WebhookID, &d.Delivery, &d.Event, &payload, &d.Attempt, &d.StatusCode, &d.Error, (*timeValue)(&d.Created))
+			d.Payload = json.RawMessage(payload)
+			return d, err
+		},
+	}
+	return list(s, q, opts)
+}
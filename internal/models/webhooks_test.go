@@ -0,0 +1,77 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestStoreWebhooks(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		alice, err := s.InsertUser("alice", "correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := s.InsertUser("bob", "correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.CreateWebhook(alice, "http://example.com/", []string{"bobbins"}); !errors.Is(err, ErrInvalidEvent) {
+			t.Errorf("expected ErrInvalidEvent, got %v", err)
+		}
+
+		all, err := s.CreateWebhook(alice, "http://example.com/all", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if all.Secret == "" || len(all.Events) != len(Events) {
+			t.Errorf("expected a secret and every event, got %+v", all)
+		}
+		imports, err := s.CreateWebhook(alice, "http://example.com/imports", []string{EventImportFinished})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hooks, err := s.EventWebhooks(alice, EventMasterFinished)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hooks) != 1 || hooks[0].ID != all.ID || hooks[0].Secret != all.Secret {
+			t.Errorf("expected only the webhook for every event, got %+v", hooks)
+		}
+		if hooks, _ := s.EventWebhooks(bob, EventImportFinished); len(hooks) != 0 {
+			t.Errorf("expected bob to have no webhooks, got %+v", hooks)
+		}
+		if _, err := s.GetWebhook(bob, imports.ID); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord getting another user's webhook, got %v", err)
+		}
+
+		for attempt := 1; attempt <= 2; attempt++ {
+			_, err := s.InsertDelivery(WebhookDelivery{
+				WebhookID: imports.ID, Delivery: "d1", Event: EventImportFinished,
+				Payload: json.RawMessage(`{"a":1}`), Attempt: attempt, StatusCode: 500, Error: "500 Internal Server Error",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		deliveries, _, err := s.Deliveries(imports.ID, ListOptions{Sort: "-created"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 2 || deliveries[0].Attempt != 2 || string(deliveries[0].Payload) != `{"a":1}` {
+			t.Errorf("unexpected deliveries %+v", deliveries)
+		}
+
+		if err := s.DeleteWebhook(bob, imports.ID); !errors.Is(err, ErrNoRecord) {
+			t.Errorf("expected ErrNoRecord deleting another user's webhook, got %v", err)
+		}
+		if err := s.DeleteWebhook(alice, imports.ID); err != nil {
+			t.Fatal(err)
+		}
+		if deliveries, _, _ := s.Deliveries(imports.ID, ListOptions{}); len(deliveries) != 0 {
+			t.Errorf("expected deliveries to be deleted with their webhook, got %d", len(deliveries))
+		}
+	})
+}
@@ -0,0 +1,298 @@
+// Package webhooks posts events to the URLs users have subscribed to them.
+// Each payload is signed with an HMAC of the webhook's secret, so that the
+// receiver can check it came from datamaps, and delivery is retried with
+// backoff until the receiver responds with a 2xx status. Every attempt is
+// recorded in the delivery log of a models.WebhookStore. Events are only
+// delivered to public addresses, so that webhooks cannot be used to reach
+// the server's own network.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// Headers sent with each delivery.
+const (
+	// SignatureHeader holds "sha256=" followed by the hex HMAC-SHA256 of
+	// the body, keyed with the webhook's secret.
+	SignatureHeader = "X-Datamaps-Signature"
+
+	// EventHeader holds the name of the event.
+	EventHeader = "X-Datamaps-Event"
+
+	// DeliveryHeader identifies the event, and is the same for each
+	// attempt to deliver it.
+	DeliveryHeader = "X-Datamaps-Delivery"
+)
+
+// ErrNotPublic is returned when an event would be delivered to an address
+// which is not public, such as a loopback, private or link-local address.
+var ErrNotPublic = errors.New("webhooks: address is not public")
+
+// nonPublic are blocks of addresses, besides those recognised by isPublic
+// itself, which are not reachable across the internet.
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// isPublic reports whether ip is a public unicast address.
+func isPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublic {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sign returns the value of SignatureHeader for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature, the value of SignatureHeader, is the
+// signature of body with secret.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Dispatcher delivers events to webhooks in the background.
+type Dispatcher struct {
+	store  models.WebhookStore
+	logger *slog.Logger
+
+	// Client sends the deliveries.
+	Client *http.Client
+
+	// MaxAttempts is how many times a delivery is tried before giving up.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry, which doubles for each
+	// retry after it.
+	Backoff time.Duration
+
+	// AllowPrivate lets events be delivered to addresses which are not
+	// public, such as receivers on the same machine in tests.
+	AllowPrivate bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher returns a Dispatcher delivering the events of the webhooks
+// in store.
+func NewDispatcher(store models.WebhookStore, logger *slog.Logger) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		store:       store,
+		logger:      logger,
+		MaxAttempts: 5,
+		Backoff:     5 * time.Second,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	// Addresses are checked as they are dialled, once the receiver's name
+	// has been resolved, so that a name cannot be made to resolve to a
+	// private address after it was checked. A proxy would be dialled in the
+	// receiver's place, so none is used, and redirects, which could lead
+	// anywhere, are not followed.
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: d.checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.Client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// CheckURL returns an error wrapping ErrNotPublic if events could not be
+// delivered to u because its host is localhost or an address which is not
+// public. The addresses a name resolves to are checked as each event is
+// delivered.
+func (d *Dispatcher) CheckURL(u *url.URL) error {
+	if d.AllowPrivate {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrNotPublic, host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !isPublic(ip) {
+		return fmt.Errorf("%w: %s", ErrNotPublic, ip)
+	}
+	return nil
+}
+
+// checkDial is the Control function of the Dispatcher's dialer, which
+// refuses to connect to an address which is not public.
+func (d *Dispatcher) checkDial(network, address string, _ syscall.RawConn) error {
+	if d.AllowPrivate {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublic(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrNotPublic, ap.Addr())
+	}
+	return nil
+}
+
+// Notify posts payload, encoded as JSON, to each webhook of the user with id
+// userID which is subscribed to event. It returns once the deliveries have
+// been started.
+func (d *Dispatcher) Notify(userID int64, event string, payload any) error {
+	hooks, err := d.store.EventWebhooks(userID, event)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range hooks {
+		delivery, err := newDeliveryID()
+		if err != nil {
+			return err
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.deliver(w, delivery, event, body)
+		}()
+	}
+	return nil
+}
+
+// Wait waits for every delivery started so far to succeed or give up.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Close abandons any retries which are waiting and waits for attempts in
+// progress, which are limited by the Client's timeout, to finish.
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// deliver posts body to w until it succeeds, MaxAttempts is reached or the
+// Dispatcher is closed, recording each attempt.
+func (d *Dispatcher) deliver(w models.Webhook, delivery, event string, body []byte) {
+	logger := d.logger.With("webhook", w.ID, "delivery", delivery, "event", event)
+	wait := d.Backoff
+
+	for attempt := 1; attempt <= d.MaxAttempts; attempt++ {
+		code, err := d.post(w, delivery, event, body)
+
+		record := models.WebhookDelivery{
+			WebhookID:  w.ID,
+			Delivery:   delivery,
+			Event:      event,
+			Payload:    body,
+			Attempt:    attempt,
+			StatusCode: code,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if _, err := d.store.InsertDelivery(record); err != nil {
+			logger.Error("cannot record webhook delivery", "error", err)
+		}
+
+		if err == nil {
+			logger.Info("delivered webhook", "attempt", attempt)
+			return
+		}
+		logger.Info("failed to deliver webhook", "attempt", attempt, "error", err)
+
+		if attempt == d.MaxAttempts {
+			break
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	logger.Error("gave up delivering webhook", "attempts", d.MaxAttempts)
+}
+
+// post makes a single attempt to deliver body to w, returning the status
+// code of the response, if there was one, and an error unless it was 2xx.
+func (d *Dispatcher) post(w models.Webhook, delivery, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "datamaps-webhooks")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, delivery)
+	req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+
+	rs, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rs.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(rs.Body, 64<<10))
+
+	if rs.StatusCode < 200 || rs.StatusCode > 299 {
+		return rs.StatusCode, fmt.Errorf("receiver responded %s", rs.Status)
+	}
+	return rs.StatusCode, nil
+}
+
+// newDeliveryID returns a random id for a delivery.
+func newDeliveryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
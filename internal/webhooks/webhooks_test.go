@@ -0,0 +1,283 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.yulqen.org/go/datamaps-go/internal/models"
+)
+
+// receiver is an httptest server which records the deliveries it receives,
+// failing the first failures of them.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	got      []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, failures int) *receiver {
+	rcv := &receiver{failures: failures}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.got = append(rcv.got, r)
+		rcv.bodies = append(rcv.bodies, body)
+		if len(rcv.got) <= rcv.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *receiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.got)
+}
+
+// newTestDispatcher returns a Dispatcher, which retries quickly, using a
+// migrated SQLite database in a temporary directory holding a user.
+func newTestDispatcher(t *testing.T) (*Dispatcher, models.Store, int64) {
+	t.Helper()
+
+	store, err := models.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	uid, err := store.InsertUser("alice", "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(store, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	d.Backoff = time.Millisecond
+	d.MaxAttempts = 3
+	d.AllowPrivate = true
+	return d, store, uid
+}
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"event":"import.finished"}`)
+	sig := Sign("secret", body)
+	if !Verify("secret", body, sig) {
+		t.Error("expected the signature to verify")
+	}
+	if Verify("other", body, sig) || Verify("secret", []byte(`{}`), sig) || Verify("secret", body, "sha256=00") {
+		t.Error("expected a wrong secret, body or signature not to verify")
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	d, store, uid := newTestDispatcher(t)
+	rcv := newReceiver(t, 2)
+
+	w, err := store.CreateWebhook(uid, rcv.URL, []string{models.EventImportFinished})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateWebhook(uid, rcv.URL+"/masters", []string{models.EventMasterFinished}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Notify(uid, models.EventImportFinished, map[string]any{"return": "Q1", "files": 2}); err != nil {
+		t.Fatal(err)
+	}
+	d.Wait()
+
+	if rcv.count() != 3 {
+		t.Fatalf("expected 2 failed attempts and 1 success, got %d requests", rcv.count())
+	}
+	for i, r := range rcv.got {
+		if r.URL.Path != "/" || r.Header.Get(EventHeader) != models.EventImportFinished {
+			t.Errorf("expected only the import webhook to be sent the event, got %s %s", r.URL.Path, r.Header.Get(EventHeader))
+		}
+		if !Verify(w.Secret, rcv.bodies[i], r.Header.Get(SignatureHeader)) {
+			t.Errorf("attempt %d: signature %q does not verify", i+1, r.Header.Get(SignatureHeader))
+		}
+		if r.Header.Get(DeliveryHeader) != rcv.got[0].Header.Get(DeliveryHeader) {
+			t.Error("expected every attempt to have the same delivery id")
+		}
+	}
+	var payload struct {
+		Return string
+		Files  int
+	}
+	if err := json.Unmarshal(rcv.bodies[2], &payload); err != nil || payload.Return != "Q1" || payload.Files != 2 {
+		t.Errorf("unexpected payload %s, %v", rcv.bodies[2], err)
+	}
+
+	deliveries, _, err := store.Deliveries(w.ID, models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 attempts in the delivery log, got %d", len(deliveries))
+	}
+	if deliveries[0].StatusCode != 500 || deliveries[0].Error == "" || deliveries[2].StatusCode != 200 || deliveries[2].Error != "" || deliveries[2].Attempt != 3 {
+		t.Errorf("unexpected delivery log %+v", deliveries)
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	d, store, uid := newTestDispatcher(t)
+	rcv := newReceiver(t, 10)
+
+	w, err := store.CreateWebhook(uid, rcv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(uid, models.EventMasterFinished, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	d.Wait()
+
+	if rcv.count() != d.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d", d.MaxAttempts, rcv.count())
+	}
+	deliveries, _, err := store.Deliveries(w.ID, models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dl := range deliveries {
+		if dl.Error == "" {
+			t.Errorf("expected every attempt to have failed, got %+v", dl)
+		}
+	}
+}
+
+func TestDispatcherClose(t *testing.T) {
+	d, store, uid := newTestDispatcher(t)
+	d.Backoff = time.Hour
+	rcv := newReceiver(t, 10)
+
+	if _, err := store.CreateWebhook(uid, rcv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(uid, models.EventImportFinished, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	for rcv.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to abandon the waiting retry")
+	}
+	if rcv.count() != 1 {
+		t.Errorf("expected 1 attempt before closing, got %d", rcv.count())
+	}
+}
+
+func TestDispatcherRefusesPrivateAddresses(t *testing.T) {
+	d, store, uid := newTestDispatcher(t)
+	d.AllowPrivate = false
+	d.MaxAttempts = 1
+	rcv := newReceiver(t, 0)
+
+	// The receiver is on a loopback address, as are internal services.
+	w, err := store.CreateWebhook(uid, rcv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(uid, models.EventImportFinished, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	d.Wait()
+
+	if rcv.count() != 0 {
+		t.Errorf("expected nothing to be sent to a loopback address, got %d requests", rcv.count())
+	}
+	deliveries, _, err := store.Deliveries(w.ID, models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || !strings.Contains(deliveries[0].Error, ErrNotPublic.Error()) {
+		t.Errorf("expected the attempt to be refused, got %+v", deliveries)
+	}
+}
+
+func TestDispatcherDoesNotFollowRedirects(t *testing.T) {
+	d, store, uid := newTestDispatcher(t)
+	d.MaxAttempts = 1
+	target := newReceiver(t, 0)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+
+	w, err := store.CreateWebhook(uid, redirect.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(uid, models.EventImportFinished, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	d.Wait()
+
+	if target.count() != 0 {
+		t.Errorf("expected the redirect not to be followed, got %d requests", target.count())
+	}
+	deliveries, _, err := store.Deliveries(w.ID, models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].StatusCode != http.StatusTemporaryRedirect || deliveries[0].Error == "" {
+		t.Errorf("expected the redirect to fail the delivery, got %+v", deliveries)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	d := NewDispatcher(nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tests := []struct {
+		url    string
+		public bool
+	}{
+		{"https://reports.example.com/hook", true},
+		{"http://93.184.215.14/hook", true},
+		{"http://localhost:8080/", false},
+		{"http://api.localhost/", false},
+		{"http://127.0.0.1/", false},
+		{"http://10.1.2.3/", false},
+		{"http://192.168.0.1/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://100.64.0.1/", false},
+		{"http://0.0.0.0/", false},
+		{"http://[::1]/", false},
+		{"http://[fd00::1]/", false},
+		{"http://[fe80::1]/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.CheckURL(u); (err == nil) != tt.public {
+			t.Errorf("CheckURL(%s) = %v, expected public %v", tt.url, err, tt.public)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// Package ui holds the templates and static assets for the web interface,
+// embedded into the binary.
+package ui
+
+import "embed"
+
+//go:embed "html" "static"
+var Files embed.FS